@@ -0,0 +1,537 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const activityStreams = "https://www.w3.org/ns/activitystreams"
+
+// Someone on the fediverse that follows the blog
+type Follower struct {
+	Actor     string // ID of their actor
+	Inbox     string // Their shared inbox if they have one
+	Following string // ID of our actor that they followed
+	Since     time.Time
+}
+
+// The parts of a remote actor's document that we care about
+type remoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// How long fetched actors are kept around, and how many of them at most.
+// Actors change their keys and anyone can get us to fetch one
+const (
+	actorCacheTime = 24 * time.Hour
+	actorCacheSize = 1000
+)
+
+type cachedActor struct {
+	actor   *remoteActor
+	fetched time.Time
+}
+
+// An incoming activity, the object is kept raw since it can be anything
+type activity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+type ActivityPub struct {
+	ps        *PostStats
+	key       *rsa.PrivateKey
+	client    *http.Client
+	queue     *RetryQueue
+	followers []Follower
+	actors    map[string]cachedActor // Cache of fetched actors
+	lock      sync.RWMutex
+}
+
+func LoadActivityPub(ps *PostStats) (*ActivityPub, error) {
+	key, err := LoadSigningKey(filepath.Join(ps.Cfg.PostDir, "activitypub.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	ap := &ActivityPub{
+		ps:        ps,
+		key:       key,
+		client:    newPublicClient(), // Actors and inboxes come from whoever posts to the inbox
+		queue:     NewRetryQueue("activitypub", 6, time.Minute),
+		followers: make([]Follower, 0),
+		actors:    make(map[string]cachedActor),
+	}
+
+	var file struct{ Followers []Follower }
+	if data, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, "followers.toml")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := toml.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		ap.followers = file.Followers
+	}
+	return ap, nil
+}
+
+// Saves the followers, expects the lock to already be held
+func (ap *ActivityPub) save() error {
+	if data, err := toml.Marshal(struct{ Followers []Follower }{ap.followers}); err != nil {
+		return err
+	} else {
+		return os.WriteFile(filepath.Join(ap.ps.Cfg.PostDir, "followers.toml"), data, 0664)
+	}
+}
+
+func actorID(origin string) string {
+	return origin + "/actor"
+}
+
+func writeActivityJSON(w http.ResponseWriter, contentType string, v any) {
+	w.Header().Set("Content-Type", contentType)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// Fetches an actor (or the key of an actor), using the cache if possible.
+// Returns whether it came from the cache
+func (ap *ActivityPub) fetchActor(id, origin string, fresh bool) (*remoteActor, bool, error) {
+	if u, err := url.Parse(id); err == nil {
+		u.Fragment = ""
+		id = u.String()
+	}
+
+	ap.lock.RLock()
+	cached, ok := ap.actors[id]
+	ap.lock.RUnlock()
+	if ok && !fresh && time.Since(cached.fetched) < actorCacheTime {
+		return cached.actor, true, nil
+	}
+
+	// Some servers only answer signed requests
+	resp, err := signedRequest(ap.client, http.MethodGet, id, nil, ap.key, actorID(origin)+"#main-key")
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("Fetching %s returned %s", id, resp.Status)
+	}
+
+	actor := &remoteActor{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(actor); err != nil {
+		return nil, false, err
+	}
+
+	ap.lock.Lock()
+	defer ap.lock.Unlock()
+	if _, ok := ap.actors[id]; !ok && len(ap.actors) >= actorCacheSize {
+		// Make room by dropping the actors that have been around the longest
+		for id, cached := range ap.actors {
+			if time.Since(cached.fetched) >= actorCacheTime {
+				delete(ap.actors, id)
+			}
+		}
+		for len(ap.actors) >= actorCacheSize {
+			oldest := ""
+			for id, cached := range ap.actors {
+				if oldest == "" || cached.fetched.Before(ap.actors[oldest].fetched) {
+					oldest = id
+				}
+			}
+			delete(ap.actors, oldest)
+		}
+	}
+	ap.actors[id] = cachedActor{actor: actor, fetched: time.Now()}
+	return actor, false, nil
+}
+
+// Makes sure that the actor of an activity is the one that signed the request.
+// Returns the key id that signed it
+func (ap *ActivityPub) verify(r *http.Request, body []byte, act activity, origin string) (string, error) {
+	try := func(fresh bool) (bool, string, error) {
+		cached := false
+		keyID, err := VerifyRequest(r, body, func(keyID string) (*rsa.PublicKey, error) {
+			actor, fromCache, err := ap.fetchActor(keyID, origin, fresh)
+			if err != nil {
+				return nil, err
+			}
+			cached = fromCache
+			if actor.PublicKey.Owner != act.Actor {
+				return nil, fmt.Errorf("Key %s is not owned by %s", keyID, act.Actor)
+			}
+			return ParsePublicKeyPEM(actor.PublicKey.PublicKeyPem)
+		})
+		return cached, keyID, err
+	}
+
+	// The actor might have changed their key since it was cached
+	cached, keyID, err := try(false)
+	if err != nil && cached {
+		_, keyID, err = try(true)
+	}
+	return keyID, err
+}
+
+// Posts an activity to an inbox, meant to be run from the queue
+func (ap *ActivityPub) deliver(inbox, origin string, activity any) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		// Trying again won't help
+		log.Println(err)
+		return nil
+	}
+
+	resp, err := signedRequest(ap.client, http.MethodPost, inbox, body, ap.key, actorID(origin)+"#main-key")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%s returned %s", inbox, resp.Status)
+	} else if resp.StatusCode >= 400 {
+		log.Printf("activitypub: %s rejected delivery with %s\n", inbox, resp.Status)
+	}
+	return nil
+}
+
+// Queues an activity for every inbox following our actor at origin
+func (ap *ActivityPub) broadcast(origin string, build func(origin string) JSONLD) {
+	ap.lock.RLock()
+	inboxes := make([]string, 0)
+	for _, f := range ap.followers {
+		if f.Following == actorID(origin) && !slices.Contains(inboxes, f.Inbox) {
+			inboxes = append(inboxes, f.Inbox)
+		}
+	}
+	ap.lock.RUnlock()
+
+	activity := build(origin)
+	for _, inbox := range inboxes {
+		ap.queue.Push(func(int) error {
+			return ap.deliver(inbox, origin, activity)
+		})
+	}
+}
+
+// Every host that people have followed us through
+func (ap *ActivityPub) origins() []string {
+	ap.lock.RLock()
+	defer ap.lock.RUnlock()
+
+	origins := make([]string, 0)
+	for _, f := range ap.followers {
+		if origin, ok := strings.CutSuffix(f.Following, "/actor"); ok && !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// The ActivityStreams version of a post
+func (ap *ActivityPub) article(origin string, post *Post) JSONLD {
+	links := Links{Base: origin}
+	url := links.Post(post.Id)
+	tags := make([]JSONLD, len(post.Info.Tags))
+	ap.ps.Lock.RLock()
+	for i, tag := range post.Info.Tags {
+		tags[i] = JSONLD{
+			"type": "Hashtag",
+			"name": "#" + strings.ReplaceAll(tag, " ", ""),
+			"href": links.Tag(ap.ps.TagDB.FindTagID(tag)),
+		}
+	}
+	ap.ps.Lock.RUnlock()
+
+	article := JSONLD{
+		"id":           url,
+		"type":         "Article",
+		"attributedTo": actorID(origin),
+		"name":         post.Info.Title,
+		"content":      string(post.Document),
+		"mediaType":    "text/html",
+		"url":          url,
+		"published":    post.Info.Date.Format(time.RFC3339),
+		"to":           []string{activityStreams + "#Public"},
+		"cc":           []string{origin + "/followers"},
+		"tag":          tags,
+	}
+	if !post.Info.Updated.IsZero() {
+		article["updated"] = post.Info.Updated.Format(time.RFC3339)
+	}
+	return article
+}
+
+// Sends out posts as they get published, updated or deleted
+func (ap *ActivityPub) postListener(event PostEvent, id PostID, info PostInfo) {
+	var post Post
+	if event != PostDeleted {
+		var err error
+		if post, err = LoadPost(filepath.Join(ap.ps.Cfg.PostDir, string(id))); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	for _, origin := range ap.origins() {
+		ap.broadcast(origin, func(origin string) JSONLD {
+			url := Links{Base: origin}.Post(id)
+			activity := JSONLD{
+				"@context": activityStreams,
+				"actor":    actorID(origin),
+				"to":       []string{activityStreams + "#Public"},
+				"cc":       []string{origin + "/followers"},
+			}
+
+			switch event {
+			case PostCreated:
+				activity["id"] = url + "#create"
+				activity["type"] = "Create"
+				activity["object"] = ap.article(origin, &post)
+			case PostUpdated:
+				activity["id"] = fmt.Sprintf("%s#update-%d", url, time.Now().Unix())
+				activity["type"] = "Update"
+				activity["object"] = ap.article(origin, &post)
+			case PostDeleted:
+				activity["id"] = url + "#delete"
+				activity["type"] = "Delete"
+				activity["object"] = JSONLD{"id": url, "type": "Tombstone"}
+			}
+			return activity
+		})
+	}
+}
+
+func (ap *ActivityPub) follow(act activity, origin string) error {
+	var object string
+	if err := json.Unmarshal(act.Object, &object); err != nil || object != actorID(origin) {
+		return fmt.Errorf("Follow is not for this actor")
+	}
+
+	actor, _, err := ap.fetchActor(act.Actor, origin, false)
+	if err != nil {
+		return err
+	}
+	inbox := actor.Endpoints.SharedInbox
+	if inbox == "" {
+		inbox = actor.Inbox
+	}
+	if inbox == "" {
+		return fmt.Errorf("%s has no inbox", act.Actor)
+	}
+
+	ap.lock.Lock()
+	i := slices.IndexFunc(ap.followers, func(f Follower) bool {
+		return f.Actor == act.Actor && f.Following == object
+	})
+	if i == -1 {
+		ap.followers = append(ap.followers, Follower{
+			Actor:     act.Actor,
+			Inbox:     inbox,
+			Following: object,
+			Since:     time.Now(),
+		})
+		log.Printf("activitypub: %s followed the blog\n", act.Actor)
+	}
+	err = ap.save()
+	ap.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Followers are always accepted
+	accept := JSONLD{
+		"@context": activityStreams,
+		"id":       fmt.Sprintf("%s#accept-%d", actorID(origin), time.Now().UnixNano()),
+		"type":     "Accept",
+		"actor":    actorID(origin),
+		"object":   act,
+	}
+	ap.queue.Push(func(int) error {
+		return ap.deliver(actor.Inbox, origin, accept)
+	})
+	return nil
+}
+
+func (ap *ActivityPub) unfollow(act activity) error {
+	var undone activity
+	if err := json.Unmarshal(act.Object, &undone); err != nil || undone.Type != "Follow" {
+		// Nothing else can be undone
+		return nil
+	}
+	if undone.Actor != act.Actor {
+		return fmt.Errorf("Can't undo another actor's follow")
+	}
+	// They might follow us on more than one host, only that one is undone
+	var object string
+	if err := json.Unmarshal(undone.Object, &object); err != nil {
+		return fmt.Errorf("Follow has no object")
+	}
+
+	ap.lock.Lock()
+	defer ap.lock.Unlock()
+	ap.followers = slices.DeleteFunc(ap.followers, func(f Follower) bool {
+		return f.Actor == act.Actor && f.Following == object
+	})
+	log.Printf("activitypub: %s unfollowed the blog\n", act.Actor)
+	return ap.save()
+}
+
+func HandleActivityPub(ps *PostStats) {
+	ap, err := LoadActivityPub(ps)
+	if err != nil {
+		log.Println(err)
+		log.Println("ActivityPub is disabled")
+		return
+	}
+	ps.Listen(ap.postListener)
+
+	http.HandleFunc("GET /.well-known/webfinger", func(w http.ResponseWriter, r *http.Request) {
+		origin := ps.Links(r).Base
+		resource := r.URL.Query().Get("resource")
+		base, _ := url.Parse(origin)
+		acct := "acct:" + ps.Cfg.Username + "@" + base.Host
+		if !strings.EqualFold(resource, acct) && resource != actorID(origin) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeActivityJSON(w, "application/jrd+json", JSONLD{
+			"subject": acct,
+			"aliases": []string{actorID(origin)},
+			"links": []JSONLD{
+				{
+					"rel":  "self",
+					"type": "application/activity+json",
+					"href": actorID(origin),
+				},
+				{
+					"rel":  "http://webfinger.net/rel/profile-page",
+					"type": "text/html",
+					"href": origin + "/",
+				},
+			},
+		})
+	})
+
+	http.HandleFunc("GET /actor", func(w http.ResponseWriter, r *http.Request) {
+		origin := ps.Links(r).Base
+		writeActivityJSON(w, "application/activity+json", JSONLD{
+			"@context":                  []string{activityStreams, "https://w3id.org/security/v1"},
+			"id":                        actorID(origin),
+			"type":                      "Person",
+			"preferredUsername":         ps.Cfg.Username,
+			"name":                      ps.Cfg.Title,
+			"summary":                   "Posts from " + ps.Cfg.Title + " by " + ps.Cfg.Author,
+			"url":                       origin + "/",
+			"inbox":                     origin + "/inbox",
+			"outbox":                    origin + "/outbox",
+			"followers":                 origin + "/followers",
+			"manuallyApprovesFollowers": false,
+			"discoverable":              true,
+			"publicKey": JSONLD{
+				"id":           actorID(origin) + "#main-key",
+				"owner":        actorID(origin),
+				"publicKeyPem": PublicKeyPEM(ap.key),
+			},
+		})
+	})
+
+	http.HandleFunc("GET /followers", func(w http.ResponseWriter, r *http.Request) {
+		origin := ps.Links(r).Base
+		items := make([]string, 0)
+		ap.lock.RLock()
+		for _, f := range ap.followers {
+			if f.Following == actorID(origin) {
+				items = append(items, f.Actor)
+			}
+		}
+		ap.lock.RUnlock()
+
+		writeActivityJSON(w, "application/activity+json", JSONLD{
+			"@context":     activityStreams,
+			"id":           origin + "/followers",
+			"type":         "OrderedCollection",
+			"totalItems":   len(items),
+			"orderedItems": items,
+		})
+	})
+
+	http.HandleFunc("GET /outbox", func(w http.ResponseWriter, r *http.Request) {
+		origin := ps.Links(r).Base
+		ps.Lock.RLock()
+		total := len(ps.ByDate)
+		ps.Lock.RUnlock()
+
+		writeActivityJSON(w, "application/activity+json", JSONLD{
+			"@context":   activityStreams,
+			"id":         origin + "/outbox",
+			"type":       "OrderedCollection",
+			"totalItems": total,
+		})
+	})
+
+	http.HandleFunc("POST /inbox", func(w http.ResponseWriter, r *http.Request) {
+		origin := ps.Links(r).Base
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var act activity
+		if err := json.Unmarshal(body, &act); err != nil {
+			http.Error(w, "Invalid activity", http.StatusBadRequest)
+			return
+		}
+
+		keyID, err := ap.verify(r, body, act, origin)
+		if err != nil {
+			log.Printf("activitypub: rejected %s from %s: %s\n", act.Type, act.Actor, err)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		switch act.Type {
+		case "Follow":
+			err = ap.follow(act, origin)
+		case "Undo":
+			err = ap.unfollow(act)
+		default:
+			log.Printf("activitypub: ignoring %s from %s signed by %s\n", act.Type, act.Actor, keyID)
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testActivityPub(t *testing.T) *ActivityPub {
+	t.Helper()
+	ps := testBlog(t, map[PostID]string{
+		"gc": `Title = "Garbage collection"` + "\n" + `Tags = ["Go"]`,
+	})
+	ap, err := LoadActivityPub(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ap
+}
+
+func TestActivityPubRefusesLocalAddresses(t *testing.T) {
+	ap := testActivityPub(t)
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(`{"id":"` + r.URL.String() + `"}`))
+	}))
+	defer srv.Close()
+
+	// Anyone can put any key id in a signature or any inbox in their actor
+	if _, _, err := ap.fetchActor(srv.URL+"/actor#main-key", "https://blog.example", false); err == nil {
+		t.Error("fetched an actor from a local address")
+	}
+	if err := ap.deliver(srv.URL+"/inbox", "https://blog.example", JSONLD{"type": "Accept"}); err == nil {
+		t.Error("delivered to a local inbox")
+	}
+	if hits != 0 {
+		t.Errorf("the local server got %d requests", hits)
+	}
+}
+
+func TestArticle(t *testing.T) {
+	ap := testActivityPub(t)
+	post, err := LoadPost(filepath.Join(ap.ps.Cfg.PostDir, "gc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Info.Tags = append(post.Info.Tags, "Garbage Collection")
+
+	article := ap.article("https://blog.example", &post)
+	if article["id"] != "https://blog.example/post/gc" || article["name"] != "Garbage collection" {
+		t.Errorf("article is %v", article)
+	}
+	want := []JSONLD{
+		{"type": "Hashtag", "name": "#Go", "href": "https://blog.example/tags/go"},
+		{"type": "Hashtag", "name": "#GarbageCollection", "href": "https://blog.example/tags/garbage-collection"},
+	}
+	if tags := article["tag"].([]JSONLD); !slices.EqualFunc(tags, want, maps.Equal) {
+		t.Errorf("tags are %v, want %v", tags, want)
+	}
+	// Tags only get added to the database when a post has them
+	if _, ok := ap.ps.TagDB.Tags["Garbage Collection"]; ok {
+		t.Error("making the article added a tag")
+	}
+}
+
+// An actor on another server that can change its key
+type fakeActor struct {
+	lock    sync.Mutex
+	key     *rsa.PrivateKey
+	fetches int
+	url     string
+}
+
+func (a *fakeActor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.fetches++
+	writeActivityJSON(w, "application/activity+json", JSONLD{
+		"id":    a.url,
+		"inbox": a.url + "/inbox",
+		"publicKey": JSONLD{
+			"id":           a.url + "#main-key",
+			"owner":        a.url,
+			"publicKeyPem": PublicKeyPEM(a.key),
+		},
+	})
+}
+
+func testFakeActor(t *testing.T, ap *ActivityPub) *fakeActor {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := &fakeActor{key: key}
+	srv := httptest.NewServer(actor)
+	t.Cleanup(srv.Close)
+	actor.url = srv.URL + "/actor"
+	ap.client = srv.Client()
+	return actor
+}
+
+func TestActorCache(t *testing.T) {
+	ap := testActivityPub(t)
+	actor := testFakeActor(t, ap)
+
+	for range 2 {
+		if _, _, err := ap.fetchActor(actor.url+"#main-key", "https://blog.example", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if actor.fetches != 1 {
+		t.Errorf("fetched the actor %d times, want once", actor.fetches)
+	}
+
+	// Old ones get fetched again
+	cached := ap.actors[actor.url]
+	cached.fetched = time.Now().Add(-actorCacheTime)
+	ap.actors[actor.url] = cached
+	if _, fromCache, err := ap.fetchActor(actor.url, "https://blog.example", false); err != nil || fromCache {
+		t.Fatalf("got %v, from the cache = %v", err, fromCache)
+	}
+	if actor.fetches != 2 {
+		t.Errorf("fetched the actor %d times, want twice", actor.fetches)
+	}
+
+	// There's only room for so many
+	delete(ap.actors, actor.url)
+	for i := range actorCacheSize {
+		ap.actors[fmt.Sprintf("https://other.example/%d", i)] = cachedActor{actor: &remoteActor{}, fetched: time.Now().Add(-time.Hour)}
+	}
+	if _, _, err := ap.fetchActor(actor.url, "https://blog.example", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ap.actors) > actorCacheSize {
+		t.Errorf("%d actors are cached", len(ap.actors))
+	}
+	if _, ok := ap.actors[actor.url]; !ok {
+		t.Error("the actor that was just fetched isn't cached")
+	}
+}
+
+func TestVerifyFetchesChangedKeys(t *testing.T) {
+	ap := testActivityPub(t)
+	actor := testFakeActor(t, ap)
+	if _, _, err := ap.fetchActor(actor.url, "https://blog.example", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The actor gets a new key after it was cached
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor.key = key
+
+	act := activity{Type: "Like", Actor: actor.url}
+	body, _ := json.Marshal(act)
+	r := httptest.NewRequest("POST", "https://blog.example/inbox", bytes.NewReader(body))
+	if err := SignRequest(r, key, actor.url+"#main-key", body); err != nil {
+		t.Fatal(err)
+	}
+	if keyID, err := ap.verify(r, body, act, "https://blog.example"); err != nil || keyID != actor.url+"#main-key" {
+		t.Errorf("got %q, %v", keyID, err)
+	}
+	if actor.fetches != 2 {
+		t.Errorf("fetched the actor %d times, want twice", actor.fetches)
+	}
+
+	// Someone else's signature still doesn't work, but only gets one fetch
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignRequest(r, other, actor.url+"#main-key", body); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ap.verify(r, body, act, "https://blog.example"); err == nil {
+		t.Error("verified a request signed by the wrong key")
+	}
+	if actor.fetches != 3 {
+		t.Errorf("fetched the actor %d times, want three times", actor.fetches)
+	}
+}
+
+func TestUnfollow(t *testing.T) {
+	ap := testActivityPub(t)
+	const them = "https://social.example/users/reader"
+	ap.followers = []Follower{
+		{Actor: them, Following: "https://blog.example/actor"},
+		{Actor: them, Following: "https://www.blog.example/actor"},
+		{Actor: "https://social.example/users/other", Following: "https://blog.example/actor"},
+	}
+
+	undo := func(follow string) activity {
+		return activity{Type: "Undo", Actor: them, Object: json.RawMessage(follow)}
+	}
+	if err := ap.unfollow(undo(`{"type":"Follow","actor":"https://social.example/users/other","object":"https://blog.example/actor"}`)); err == nil {
+		t.Error("undid someone else's follow")
+	}
+	if err := ap.unfollow(undo(`{"type":"Follow","actor":"` + them + `","object":"https://blog.example/actor"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Follower{
+		{Actor: them, Following: "https://www.blog.example/actor"},
+		{Actor: "https://social.example/users/other", Following: "https://blog.example/actor"},
+	}
+	if !slices.Equal(ap.followers, want) {
+		t.Errorf("followers are %+v, want %+v", ap.followers, want)
+	}
+}
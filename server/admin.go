@@ -84,11 +84,23 @@ func GeneratePostID(dir string) (PostID, error) {
 	return "", fmt.Errorf("Couldn't generate post ID")
 }
 
-func HandleAdmin(ps *PostStats) {
+// Returns the admin session so that other admin pages can check it
+func HandleAdmin(ps *PostStats) *Session {
 	type Info struct {
 		Info *PostInfo
 		Date string
 		ID string
+		Sent []Delivery
+		Snippets []template.HTML // Where a search matched the post
+	}
+
+	makeinfo := func(id PostID, info PostInfo) Info {
+		return Info{
+			Info: &info,
+			Date: FormatDate(info.Date),
+			ID: string(id),
+			Sent: ps.Sent.Get(id),
+		}
 	}
 
 	// Only 1 admin account allowed, session is just saved as string and randomly generated uuid
@@ -104,7 +116,8 @@ func HandleAdmin(ps *PostStats) {
 			return
 		}
 
-		// Create the directory for the new post
+		// Get an ID for the new post, the files go in a staging directory until
+		// the post is known to be good
 		id, err := GeneratePostID(ps.Cfg.PostDir)
 		if err != nil {
 			log.Println(err)
@@ -112,12 +125,13 @@ func HandleAdmin(ps *PostStats) {
 			return
 		}
 
-		postdir := filepath.Join(ps.Cfg.PostDir, string(id))
-		if err := os.Mkdir(postdir, 0755); err != nil {
+		postdir, err := newStagingDir(ps.Cfg.PostDir)
+		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		defer os.RemoveAll(postdir)
 
 		// Copy all files in
 		if headers, ok := r.MultipartForm.File["post"]; !ok {
@@ -152,12 +166,18 @@ func HandleAdmin(ps *PostStats) {
 			}
 		}
 
-		// Validate/lint the resulting post directory
-		if ok, err := ValidatePost(postdir); err != nil {
+		// Validate/lint the resulting post directory, updates keep the old ID
+		target := id
+		if postid := r.PathValue("postid"); postid != "" {
+			target = PostID(postid)
+		}
+		ok, warnings, err := ValidatePost(ps, postdir, target)
+		if perr, isperr := err.(*PostError); isperr {
+			log.Println(perr)
+			http.Error(w, perr.Msg, http.StatusBadRequest)
+			return
+		} else if err != nil {
 			log.Println(err)
-			if err := os.RemoveAll(postdir); err != nil {
-				log.Println(err)
-			}
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		} else if !ok {
@@ -165,43 +185,69 @@ func HandleAdmin(ps *PostStats) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if err := ps.Add(id); err != nil {
+		info, err := LoadPostInfo(postdir)
+		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if info, err := LoadPostInfo(filepath.Join(ps.Cfg.PostDir, string(id))); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-		} else if r.PathValue("postid") != "" {
-			// If this is is an update response return the new row
-			tmpl, err := template.ParseFiles("views/admin-post.html")
-			if err != nil {
+		if r.PathValue("postid") == "" {
+			// Do normal upload response
+			if err := replaceDir(postdir, filepath.Join(ps.Cfg.PostDir, string(id))); err != nil {
 				log.Println(err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-
-			// Now that we have the new ID, lets try to get the old ID from postid and swap the two
-			postid := PostID(r.PathValue("postid"))
-			ps.Remove(postid, true)
-			ps.Remove(id, false)
-			os.Rename(filepath.Join(ps.Cfg.PostDir, string(id)), filepath.Join(ps.Cfg.PostDir, string(postid)))
-			ps.Add(postid)
-
-			if err := tmpl.ExecuteTemplate(w, "post", Info{
-				Info: &info,
-				Date: FormatDate(info.Date),
-				ID: string(postid),
-			}); err != nil {
+			if err := ps.Add(id); err != nil {
 				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
 			}
-		} else {
-			// Do normal upload response
+			SendWebmentions(ps, ps.Links(r), id)
 			fmt.Fprintln(w, info.Title)
 			fmt.Fprintln(w, id)
+			fmt.Fprintln(w, ps.Links(r).Post(id))
+			for _, warning := range warnings {
+				fmt.Fprintln(w, "Warning: "+warning)
+			}
+			return
+		}
+
+		// If this is is an update response return the new row
+		tmpl, err := template.New("post").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/admin-post.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Now that we have the new post, move it over the old one so it keeps the old ID
+		postid := PostID(r.PathValue("postid"))
+		ps.Lock.RLock()
+		_, exists := ps.Posts[postid]
+		ps.Lock.RUnlock()
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// The old post is only removed once the new one is in place
+		if err := replaceDir(postdir, filepath.Join(ps.Cfg.PostDir, string(postid))); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if err := ps.Add(postid); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		SendWebmentions(ps, ps.Links(r), postid)
+
+		if err := tmpl.ExecuteTemplate(w, "post", makeinfo(postid, info)); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
 		}
 	}
 
@@ -215,7 +261,8 @@ func HandleAdmin(ps *PostStats) {
 			return
 		}
 
-		if _, err := ps.Remove(PostID(r.PathValue("postid")), true); err != nil {
+		if _, err := DeletePost(ps, PostID(r.PathValue("postid"))); err != nil {
+			log.Println(err)
 			w.WriteHeader(http.StatusNoContent)
 		} else {
 			w.WriteHeader(http.StatusOK)
@@ -249,7 +296,7 @@ func HandleAdmin(ps *PostStats) {
 			return
 		}
 
-		tmpl, err := template.ParseFiles(
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles(
 			"views/admin.html",
 			"views/admin-posts.html",
 			"views/admin-post.html",
@@ -261,29 +308,38 @@ func HandleAdmin(ps *PostStats) {
 			return
 		}
 
-		// Get every post ordered by date
+		// Get every page and then every post ordered by date
 		posts := make([]Info, 0)
+		pages := ps.NavPages(ps.Links(r))
 		ps.Lock.RLock()
+		for _, page := range pages {
+			posts = append(posts, makeinfo(page.Id, ps.Posts[page.Id]))
+		}
 		for _, id := range ps.ByDate {
-			info := ps.Posts[id]
-			posts = append(posts, Info{
-				Date: FormatDate(info.Date),
-				Info: &info,
-				ID: string(id),
-			})
+			posts = append(posts, makeinfo(id, ps.Posts[id]))
 		}
 		ps.Lock.RUnlock()
 
 		term := strings.TrimSpace(r.Form.Get("Search"))
 		if term != "" {
+			ids, err := ps.SearchAndRank(term)
+			if qerr, ok := err.(*QueryError); ok {
+				fmt.Fprintf(w, "<h3 class=\"search-error\"><em>%s</em></h3>", template.HTMLEscapeString(qerr.Error()))
+				return
+			} else if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			terms := ps.HighlightTerms(term)
 			posts = make([]Info, 0)
-			for _, id := range ps.SearchAndRank(term) {
-				info := ps.Posts[id]
-				posts = append(posts, Info{
-					Date: FormatDate(info.Date),
-					Info: &info,
-					ID: string(id),
-				})
+			for _, id := range ids {
+				info := makeinfo(id, ps.Posts[id])
+				if post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id))); err == nil {
+					info.Snippets = terms.Snippets(post.Text, 2)
+				}
+				posts = append(posts, info)
 			}
 
 			if len(posts) == 0 {
@@ -304,10 +360,12 @@ func HandleAdmin(ps *PostStats) {
 			Title        string
 			SearchTarget string
 			Posts        []Info
+			Pending      int
 		}{
 			Title:        "Eklipsed Blog Admin Page",
 			SearchTarget: "#posts-list",
 			Posts:        posts,
+			Pending:      ps.Mentions.Pending(),
 		}); err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -315,23 +373,67 @@ func HandleAdmin(ps *PostStats) {
 		}
 	}
 
-	// Handle getting the main admin page and returning for htmx the posts list
-	http.HandleFunc("/admin", getposts)
+	// Handle getting the main admin page and returning for htmx the posts list.
+	// Methods are needed so that pages can be served at any other address
+	http.HandleFunc("GET /admin", getposts)
+	http.HandleFunc("POST /admin", getposts)
 	http.HandleFunc("GET /admin/posts", getposts)
+
+	return &session
+}
+
+// Deletes a post and everything that refers to it
+// If the post doesn't exist it will return false
+func DeletePost(ps *PostStats, id PostID) (bool, error) {
+	if ok, err := ps.Remove(id, true); !ok || err != nil {
+		return ok, err
+	}
+	if err := ps.Mentions.RemovePost(id); err != nil {
+		return true, err
+	}
+	return true, ps.Sent.RemovePost(id)
 }
 
-// This removes uneeded files and makes sure that the post is correct.
-// If the post is completely invalid, it will return false
-func ValidatePost(dir string) (bool, error) {
+// Something about a post that means it can't be published
+type PostError struct {
+	Msg string
+}
+
+func (e *PostError) Error() string {
+	return e.Msg
+}
+
+// This removes uneeded files and makes sure that the post is correct. The id
+// is the post the directory is going to become, which is different for updates.
+// If the post is completely invalid, it will return false along with a
+// *PostError when there's something to tell the author. Warnings are about
+// things that are allowed but probably mistakes
+func ValidatePost(ps *PostStats, dir string, id PostID) (bool, []string, error) {
 	// Just try to load the post first
 	post, err := LoadPost(dir)
 	if err != nil {
-		return false, err
+		return false, nil, err
+	}
+
+	// Catch tags that are spelled a little differently from ones that exist
+	ps.Lock.RLock()
+	warnings := ps.TagDB.NearDuplicates(post.Info.Tags)
+	ps.Lock.RUnlock()
+	// Pages nobody could get to are no use
+	if slug := post.Info.Page; slug != "" {
+		if pageHidden(slug) {
+			return false, warnings, &PostError{fmt.Sprintf("/%s is already used by another part of the site", slug)}
+		} else if other, ok := ps.Page(slug); ok && other != id {
+			return false, warnings, &PostError{fmt.Sprintf("/%s is already the page of post %s", slug, other)}
+		}
+	}
+	for _, warning := range warnings {
+		log.Println(warning)
 	}
 
 	// Now remove everthing in the directory that is not a part of the post
 	if ents, err := os.ReadDir(dir); err != nil {
-		return false, err
+		return false, warnings, err
 	} else {
 		for _, ent := range ents {
 			name := ent.Name()
@@ -343,10 +445,10 @@ func ValidatePost(dir string) (bool, error) {
 			}
 			if err := os.Remove(filepath.Join(dir, name)); err != nil {
 				log.Println(err)
-				return false, nil
+				return false, warnings, nil
 			}
 		}
 	}
 
-	return true, nil
+	return true, warnings, nil
 }
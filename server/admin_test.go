@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Uploads the files of a post through the admin page
+func adminUpload(t *testing.T, mux *http.ServeMux, session *Session, target string, files map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, data := range files {
+		part, err := form.CreateFormFile("post", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(data))
+	}
+	form.Close()
+
+	r := httptest.NewRequest("POST", "http://localhost"+target, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.AddCookie(session.GetCookie())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminUploadAndUpdate(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{})
+	mux := testMux(t)
+	session := HandleAdmin(ps)
+	t.Chdir("..")
+
+	w := adminUpload(t, mux, session, "/admin/upload", map[string]string{
+		"post.toml": `Title = "Hello"`,
+		"post.md":   "Some text",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload got %d: %s", w.Code, w.Body)
+	}
+	id := PostID(strings.Split(w.Body.String(), "\n")[1])
+	if ps.Posts[id].Title != "Hello" {
+		t.Fatalf("posts are %v", ps.Posts)
+	}
+
+	// A broken update leaves the post alone
+	w = adminUpload(t, mux, session, "/admin/update/"+string(id), map[string]string{
+		"post.toml": `Title = `,
+		"post.md":   "Other text",
+	})
+	if w.Code == http.StatusOK {
+		t.Errorf("broken update got %d", w.Code)
+	}
+	if info, err := LoadPostInfo(filepath.Join(ps.Cfg.PostDir, string(id))); err != nil || info.Title != "Hello" {
+		t.Errorf("post is %+v after a broken update: %v", info, err)
+	}
+
+	w = adminUpload(t, mux, session, "/admin/update/"+string(id), map[string]string{
+		"post.toml": `Title = "Hello again"`,
+		"post.md":   "Other text",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("update got %d: %s", w.Code, w.Body)
+	}
+	if text, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, string(id), "post.md")); err != nil || string(text) != "Other text" || ps.Posts[id].Title != "Hello again" {
+		t.Errorf("post has %q and the title %q after updating", text, ps.Posts[id].Title)
+	}
+
+	// Nothing gets left behind for the loader to find
+	if dirs := postDirs(t, ps); !slices.Equal(dirs, []string{string(id)}) {
+		t.Errorf("posts directory has %v", dirs)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/kljensen/snowball/english"
+	"github.com/kljensen/snowball/french"
+	"github.com/kljensen/snowball/hungarian"
+	"github.com/kljensen/snowball/norwegian"
+	"github.com/kljensen/snowball/russian"
+	"github.com/kljensen/snowball/spanish"
+	"github.com/kljensen/snowball/swedish"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Stemmers and stop words for every language that search understands
+var languages = map[string]struct {
+	stem   func(word string, stemStopWords bool) string
+	isStop func(word string) bool
+}{
+	"english":   {english.Stem, english.IsStopWord},
+	"french":    {french.Stem, french.IsStopWord},
+	"hungarian": {hungarian.Stem, hungarian.IsStopWord},
+	"norwegian": {norwegian.Stem, norwegian.IsStopWord},
+	"russian":   {russian.Stem, russian.IsStopWord},
+	"spanish":   {spanish.Stem, spanish.IsStopWord},
+	"swedish":   {swedish.Stem, swedish.IsStopWord},
+}
+
+// A term and which word of the text it came from, stop words still count
+// towards the position so that phrases don't match across them
+type token struct {
+	Term string
+	Pos  int
+}
+
+// Turns text into the terms that go into the search index. The same analyzer
+// has to be used for indexing and for searching so that the terms line up
+type Analyzer struct {
+	stem      func(word string) string
+	stopwords map[string]struct{}    // Custom stop words as terms, nil uses the language's
+	isStop    func(word string) bool // The language's stop words, checked before stemming
+	signature string                 // Changes whenever the settings do, so old indexes can be thrown out
+}
+
+// Language can be "none" to turn stemming off. Stop words replace the ones that
+// come with the language unless they are nil
+func NewAnalyzer(language string, stopwords []string) (*Analyzer, error) {
+	a := &Analyzer{
+		stem:   func(word string) string { return word },
+		isStop: func(word string) bool { return false },
+	}
+
+	a.signature = language + "|default"
+	if stopwords != nil {
+		sorted := slices.Sorted(slices.Values(stopwords))
+		a.signature = language + "|" + strings.Join(sorted, ",")
+	}
+
+	if language != "none" {
+		lang, ok := languages[language]
+		if !ok {
+			return nil, fmt.Errorf("Search doesn't know the language %s", language)
+		}
+		a.stem = func(word string) string { return lang.stem(word, true) }
+		a.isStop = lang.isStop
+	}
+
+	// Custom stop words go through the same steps as the text, so "Café" gets
+	// caught by a stop word of "cafe"
+	if stopwords != nil {
+		a.isStop = func(word string) bool { return false }
+		terms := make(map[string]struct{}, len(stopwords))
+		for _, word := range stopwords {
+			if term, ok := a.Term(word); ok {
+				terms[term] = struct{}{}
+			}
+		}
+		a.stopwords = terms
+	}
+	return a, nil
+}
+
+// Whether a rune is part of a word. Combining marks are kept so that accents
+// don't split words up
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Mn, r)
+}
+
+// Where a word is in a piece of text
+type wordSpan struct {
+	start, end int
+}
+
+// Finds the byte offsets of every word in some text
+func wordSpans(text string) []wordSpan {
+	spans := make([]wordSpan, 0)
+	start := -1
+	for i, r := range text {
+		if isWordRune(r) && start == -1 {
+			start = i
+		} else if !isWordRune(r) && start != -1 {
+			spans = append(spans, wordSpan{start, i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		spans = append(spans, wordSpan{start, len(text)})
+	}
+	return spans
+}
+
+// Strips accents so that "café" and "cafe" are the same term
+func newAccentFolder() transform.Transformer {
+	return transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+}
+
+// Turns a single word into a term, returning false for stop words. The folders
+// aren't safe to share, so each call of Tokens makes its own
+func (a *Analyzer) term(word string, caser cases.Caser, accents transform.Transformer) (string, bool) {
+	word = caser.String(word)
+	if a.isStop(word) {
+		return "", false
+	}
+	word = a.stem(word)
+	if folded, _, err := transform.String(accents, word); err == nil {
+		word = folded
+	}
+	if _, ok := a.stopwords[word]; ok {
+		return "", false
+	}
+	return word, word != ""
+}
+
+func (a *Analyzer) Tokens(text string) []token {
+	caser, accents := cases.Fold(), newAccentFolder()
+	tokens := make([]token, 0)
+	text = norm.NFKC.String(text)
+	for pos, span := range wordSpans(text) {
+		if term, ok := a.term(text[span.start:span.end], caser, accents); ok {
+			tokens = append(tokens, token{Term: term, Pos: pos})
+		}
+	}
+	return tokens
+}
+
+// Just the terms of some text, without their positions
+func (a *Analyzer) Terms(text string) []string {
+	tokens := a.Tokens(text)
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = t.Term
+	}
+	return terms
+}
+
+// The term for a single word, if it isn't a stop word
+func (a *Analyzer) Term(word string) (string, bool) {
+	return a.term(norm.NFKC.String(word), cases.Fold(), newAccentFolder())
+}
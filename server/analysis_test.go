@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAnalyzer(t *testing.T) {
+	tests := []struct {
+		name      string
+		language  string
+		stopwords []string
+		text      string
+		want      []token
+	}{
+		{
+			name:     "stems and skips stop words",
+			language: "english",
+			text:     "The collectors were running",
+			want:     []token{{"collector", 1}, {"run", 3}},
+		},
+		{
+			name:     "folds case and accents",
+			language: "english",
+			text:     "Café CAFÉ cafe",
+			want:     []token{{"cafe", 0}, {"cafe", 1}, {"cafe", 2}},
+		},
+		{
+			name:     "punctuation splits words",
+			language: "english",
+			text:     "Go's garbage-collector, v1.22!",
+			want:     []token{{"go", 0}, {"garbag", 2}, {"collector", 3}, {"v1", 4}, {"22", 5}},
+		},
+		{
+			name:     "no stemming",
+			language: "none",
+			text:     "The collectors",
+			want:     []token{{"the", 0}, {"collectors", 1}},
+		},
+		{
+			name:      "custom stop words",
+			language:  "english",
+			stopwords: []string{"Go"},
+			text:      "the Go language",
+			want:      []token{{"the", 0}, {"languag", 2}},
+		},
+		{
+			name:      "custom stop words get folded and stemmed too",
+			language:  "english",
+			stopwords: []string{"cafe", "Collectors"},
+			text:      "Café collector CAFES open",
+			want:      []token{{"open", 3}},
+		},
+		{
+			name:     "other languages",
+			language: "french",
+			text:     "chats noirs",
+			want:     []token{{"chat", 0}, {"noir", 1}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			analyzer, err := NewAnalyzer(test.language, test.stopwords)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := analyzer.Tokens(test.text); !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := NewAnalyzer("klingon", nil); err == nil {
+		t.Error("made an analyzer for a language that doesn't exist")
+	}
+}
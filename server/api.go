@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lithammer/fuzzysearch/fuzzy"
+)
+
+type SearchResult struct {
+	ID      PostID    `json:"id"`
+	Title   string    `json:"title"`
+	Date    time.Time `json:"date"`
+	Tags    []string  `json:"tags"`
+	URL     string    `json:"url"`
+	Snippet string    `json:"snippet"` // HTML with matches wrapped in <mark>
+	Score   float64   `json:"score"`
+}
+
+type Suggestion struct {
+	Text  string `json:"text"`
+	Type  string `json:"type"`  // Either title or tag
+	Query string `json:"query"` // What to search for to use the suggestion
+	URL   string `json:"url"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// Reads a positive number from the query, clamped to max
+func queryInt(r *http.Request, name string, def, max int) int {
+	if i, err := strconv.Atoi(r.URL.Query().Get(name)); err == nil && i > 0 {
+		return min(i, max)
+	}
+	return def
+}
+
+// Quotes a tag so that it can be put into a search
+func tagQuery(tag string) string {
+	if strings.ContainsFunc(tag, func(r rune) bool { return r == ' ' || r == '"' }) {
+		return `tag:"` + strings.ReplaceAll(tag, `"`, "") + `"`
+	}
+	return "tag:" + tag
+}
+
+func HandleAPI(ps *PostStats) {
+	http.HandleFunc("GET /api/search", func(w http.ResponseWriter, r *http.Request) {
+		links := ps.Links(r)
+		term := strings.TrimSpace(r.URL.Query().Get("q"))
+		limit := queryInt(r, "limit", 10, 50)
+		page := queryInt(r, "page", 1, 1<<20)
+		if term == "" {
+			writeJSON(w, http.StatusOK, map[string]any{
+				"query":   term,
+				"total":   0,
+				"page":    page,
+				"limit":   limit,
+				"results": []SearchResult{},
+			})
+			return
+		}
+
+		ids, scores, err := ps.SearchAndScore(term)
+		if qerr, ok := err.(*QueryError); ok {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": qerr.Msg, "position": qerr.Pos})
+			return
+		} else if err != nil {
+			log.Println(err)
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "Search failed"})
+			return
+		}
+
+		terms := ps.HighlightTerms(term)
+		results := make([]SearchResult, 0, limit)
+		for _, id := range ids[min((page-1)*limit, len(ids)):min(page*limit, len(ids))] {
+			post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id)))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			// Snippets are html, so the summary has to be too
+			snippet := template.HTMLEscapeString(post.Summary)
+			if snippets := terms.Snippets(post.Text, 1); len(snippets) > 0 {
+				snippet = string(snippets[0])
+			}
+			results = append(results, SearchResult{
+				ID:      id,
+				Title:   post.Info.Title,
+				Date:    post.Info.Date,
+				Tags:    post.Info.Tags,
+				URL:     links.Post(id),
+				Snippet: snippet,
+				Score:   scores[id],
+			})
+		}
+
+		writeJSON(w, http.StatusOK, map[string]any{
+			"query":   term,
+			"total":   len(ids),
+			"page":    page,
+			"limit":   limit,
+			"results": results,
+		})
+	})
+
+	http.HandleFunc("GET /api/suggest", func(w http.ResponseWriter, r *http.Request) {
+		links := ps.Links(r)
+		term := strings.TrimSpace(r.URL.Query().Get("q"))
+		limit := queryInt(r, "limit", 8, 20)
+		suggestions := make([]Suggestion, 0, limit)
+		if term == "" {
+			writeJSON(w, http.StatusOK, suggestions)
+			return
+		}
+
+		type candidate struct {
+			Suggestion
+			rank   int
+			prefix bool
+		}
+		candidates := make([]candidate, 0)
+
+		ps.Lock.RLock()
+		for id, info := range ps.Posts {
+			if info.Page != "" {
+				continue
+			}
+			if rank := fuzzy.RankMatchNormalizedFold(term, info.Title); rank != -1 {
+				candidates = append(candidates, candidate{
+					Suggestion: Suggestion{Text: info.Title, Type: "title", Query: info.Title, URL: links.Post(id)},
+					rank:       rank,
+					prefix:     strings.HasPrefix(strings.ToLower(info.Title), strings.ToLower(term)),
+				})
+			}
+		}
+		for tag, id := range ps.TagDB.Tags {
+			if rank := fuzzy.RankMatchNormalizedFold(term, tag); rank != -1 {
+				candidates = append(candidates, candidate{
+					Suggestion: Suggestion{Text: tag, Type: "tag", Query: tagQuery(tag), URL: links.Tag(id)},
+					rank:       rank,
+					prefix:     strings.HasPrefix(strings.ToLower(tag), strings.ToLower(term)),
+				})
+			}
+		}
+		ps.Lock.RUnlock()
+
+		// Things that start with what was typed come first, then the closest matches
+		slices.SortFunc(candidates, func(a, b candidate) int {
+			if a.prefix != b.prefix {
+				if a.prefix {
+					return -1
+				}
+				return 1
+			} else if a.rank != b.rank {
+				return a.rank - b.rank
+			}
+			return strings.Compare(a.Text, b.Text)
+		})
+		for _, c := range candidates[:min(limit, len(candidates))] {
+			suggestions = append(suggestions, c.Suggestion)
+		}
+
+		// Fill up the rest with posts that mention the words somewhere else
+		if len(suggestions) < limit {
+			ids, _ := ps.SearchAndRank(term)
+			ps.Lock.RLock()
+			for _, id := range ids {
+				if len(suggestions) == limit {
+					break
+				}
+				url := links.Post(id)
+				if slices.ContainsFunc(suggestions, func(s Suggestion) bool { return s.URL == url }) {
+					continue
+				}
+				if info, ok := ps.Posts[id]; ok {
+					suggestions = append(suggestions, Suggestion{Text: info.Title, Type: "title", Query: info.Title, URL: url})
+				}
+			}
+			ps.Lock.RUnlock()
+		}
+
+		writeJSON(w, http.StatusOK, suggestions)
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Gives a post of a test blog some text and lists it again
+func writePostText(t *testing.T, ps *PostStats, id PostID, text string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(ps.Cfg.PostDir, string(id), "post.md"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Add(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAPI(t *testing.T) *http.ServeMux {
+	t.Helper()
+	ps := testBlog(t, map[PostID]string{
+		"gc":    `Title = "Garbage collection in Go"` + "\n" + `Date = 2024-03-01T00:00:00Z` + "\n" + `Tags = ["go"]`,
+		"rust":  `Title = "Ownership in Rust"` + "\n" + `Date = 2024-05-01T00:00:00Z` + "\n" + `Tags = ["rust", "Systems Programming"]`,
+		"paris": `Title = "A trip to Paris"` + "\n" + `Date = 2023-07-01T00:00:00Z` + "\n" + `Tags = ["travel"]`,
+	})
+	ps.Cfg.BaseURL = "https://blog.example"
+	writePostText(t, ps, "gc", "The garbage collector frees memory that is no longer used.")
+	writePostText(t, ps, "rust", "Rust has no garbage collector, memory is freed by ownership instead.")
+	writePostText(t, ps, "paris", "We sat in a café & talked about how bad our memory is <3")
+
+	mux := testMux(t)
+	HandleAPI(ps)
+	return mux
+}
+
+func getAPI(t *testing.T, mux *http.ServeMux, path string, query url.Values, v any) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+path+"?"+query.Encode(), nil))
+	if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("headers are %v", w.Header())
+	}
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code
+}
+
+type apiResults struct {
+	Query   string
+	Total   int
+	Page    int
+	Limit   int
+	Results []SearchResult
+}
+
+func TestAPISearch(t *testing.T) {
+	mux := testAPI(t)
+
+	var res apiResults
+	if code := getAPI(t, mux, "/api/search", url.Values{"q": {" garbage "}}, &res); code != http.StatusOK {
+		t.Fatalf("got %d", code)
+	}
+	if res.Query != "garbage" || res.Total != 2 || res.Page != 1 || res.Limit != 10 || len(res.Results) != 2 {
+		t.Fatalf("got %+v", res)
+	}
+	first := res.Results[0]
+	if first.ID != "gc" || first.Title != "Garbage collection in Go" || first.URL != "https://blog.example/post/gc" ||
+		!slices.Equal(first.Tags, []string{"go"}) || first.Score <= res.Results[1].Score {
+		t.Errorf("first result is %+v", first)
+	}
+	if first.Snippet != "The <mark>garbage</mark> collector frees memory that is no longer used." {
+		t.Errorf("snippet is %q", first.Snippet)
+	}
+
+	// Posts that only match in the title show the summary, escaped like the snippets
+	if getAPI(t, mux, "/api/search", url.Values{"q": {"tag:travel"}}, &res); len(res.Results) != 1 ||
+		res.Results[0].Snippet != "We sat in a café &amp; talked about how bad our memory is &lt;3" {
+		t.Errorf("got %+v", res)
+	}
+
+	// Nothing to search for finds nothing, not every post
+	for _, q := range []string{"", "   "} {
+		res = apiResults{}
+		if code := getAPI(t, mux, "/api/search", url.Values{"q": {q}}, &res); code != http.StatusOK || res.Total != 0 || res.Results == nil || len(res.Results) != 0 {
+			t.Errorf("searching for %q gave %d %+v", q, code, res)
+		}
+	}
+}
+
+func TestAPISearchPages(t *testing.T) {
+	mux := testAPI(t)
+
+	// Every post has memory in it, paging goes through them in the same order
+	var all apiResults
+	getAPI(t, mux, "/api/search", url.Values{"q": {"memory"}}, &all)
+	ranked := make([]PostID, len(all.Results))
+	for i, result := range all.Results {
+		ranked[i] = result.ID
+	}
+	if len(ranked) != 3 {
+		t.Fatalf("got %v", ranked)
+	}
+
+	tests := []struct {
+		limit, page string
+		wantLimit   int
+		wantPage    int
+		ids         []PostID
+	}{
+		{"1", "1", 1, 1, ranked[:1]},
+		{"1", "2", 1, 2, ranked[1:2]},
+		{"2", "2", 2, 2, ranked[2:]},
+		{"2", "5", 2, 5, []PostID{}},
+		{"0", "0", 10, 1, ranked},
+		{"1000", "x", 50, 1, ranked},
+	}
+
+	for _, test := range tests {
+		t.Run(test.limit+"/"+test.page, func(t *testing.T) {
+			var res apiResults
+			getAPI(t, mux, "/api/search", url.Values{"q": {"memory"}, "limit": {test.limit}, "page": {test.page}}, &res)
+			ids := make([]PostID, len(res.Results))
+			for i, result := range res.Results {
+				ids[i] = result.ID
+			}
+			if res.Total != 3 || res.Limit != test.wantLimit || res.Page != test.wantPage || !slices.Equal(ids, test.ids) {
+				t.Errorf("got %d of %v on page %d of %d, want %v on page %d of %d",
+					res.Total, ids, res.Page, res.Limit, test.ids, test.wantPage, test.wantLimit)
+			}
+		})
+	}
+}
+
+func TestAPISearchErrors(t *testing.T) {
+	mux := testAPI(t)
+
+	var res struct {
+		Error    string
+		Position int
+	}
+	if code := getAPI(t, mux, "/api/search", url.Values{"q": {`go "unclosed`}}, &res); code != http.StatusBadRequest {
+		t.Errorf("got %d", code)
+	}
+	if res.Position != 3 || !strings.Contains(res.Error, "quote") {
+		t.Errorf("got %+v", res)
+	}
+}
+
+func TestAPISuggest(t *testing.T) {
+	mux := testAPI(t)
+
+	tests := []struct {
+		query string
+		limit string
+		want  []Suggestion
+	}{
+		{"", "", []Suggestion{}},
+		{
+			query: "own",
+			want: []Suggestion{
+				{Text: "Ownership in Rust", Type: "title", Query: "Ownership in Rust", URL: "https://blog.example/post/rust"},
+			},
+		},
+		{
+			// Tags with spaces get quoted, and posts with the tag fill up the rest
+			query: "syst",
+			want: []Suggestion{
+				{Text: "Systems Programming", Type: "tag", Query: `tag:"Systems Programming"`, URL: "https://blog.example/tags/systems-programming"},
+				{Text: "Ownership in Rust", Type: "title", Query: "Ownership in Rust", URL: "https://blog.example/post/rust"},
+			},
+		},
+		{
+			// Starting with the words goes first, then other posts that have them
+			query: "garbage",
+			want: []Suggestion{
+				{Text: "Garbage collection in Go", Type: "title", Query: "Garbage collection in Go", URL: "https://blog.example/post/gc"},
+				{Text: "Ownership in Rust", Type: "title", Query: "Ownership in Rust", URL: "https://blog.example/post/rust"},
+			},
+		},
+		{
+			query: "garbage",
+			limit: "1",
+			want: []Suggestion{
+				{Text: "Garbage collection in Go", Type: "title", Query: "Garbage collection in Go", URL: "https://blog.example/post/gc"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query+"/"+test.limit, func(t *testing.T) {
+			var got []Suggestion
+			getAPI(t, mux, "/api/suggest", url.Values{"q": {test.query}, "limit": {test.limit}}, &got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got  %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
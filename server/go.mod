@@ -6,7 +6,8 @@ require (
 	github.com/BurntSushi/toml v1.5.0
 	github.com/gomarkdown/markdown v0.0.0-20250311123330-531bef5e742b
 	github.com/joho/godotenv v1.5.1
+	github.com/kljensen/snowball v0.10.0
 	github.com/lithammer/fuzzysearch v1.1.8
+	golang.org/x/net v0.40.0
+	golang.org/x/text v0.25.0
 )
-
-require golang.org/x/text v0.9.0 // indirect
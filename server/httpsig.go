@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Loads the private key used to sign ActivityPub requests, creating it if needed
+func LoadSigningKey(path string) (*rsa.PrivateKey, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No PEM data found in %s", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsakey, ok := key.(*rsa.PrivateKey); ok {
+			return rsakey, nil
+		}
+		return nil, fmt.Errorf("Key in %s is not an RSA key", path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return key, os.WriteFile(path, data, 0600)
+}
+
+func PublicKeyPEM(key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func ParsePublicKeyPEM(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if rsakey, ok := key.(*rsa.PublicKey); ok {
+		return rsakey, nil
+	}
+	return nil, fmt.Errorf("Public key is not an RSA key")
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Builds the string that gets signed out of the listed headers
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines[i] = h + ": " + strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			host := r.Host
+			if host == "" {
+				host = r.URL.Host
+			}
+			lines[i] = h + ": " + host
+		default:
+			lines[i] = h + ": " + strings.Join(r.Header.Values(h), ", ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Signs an outgoing request with the draft-cavage HTTP signatures that the
+// fediverse uses. Body should be nil for requests without one.
+func SignRequest(r *http.Request, key *rsa.PrivateKey, keyID string, body []byte) error {
+	headers := []string{"(request-target)", "host", "date"}
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if body != nil {
+		r.Header.Set("Digest", bodyDigest(body))
+		headers = append(headers, "digest")
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID,
+		strings.Join(headers, " "),
+		base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// Parses the parameters out of a Signature header
+func parseSignature(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		if key, val, ok := strings.Cut(strings.TrimSpace(part), "="); ok {
+			params[key] = strings.Trim(val, "\"")
+		}
+	}
+	return params
+}
+
+// Checks the signature of an incoming request. The key is looked up through
+// getkey from the keyId in the signature. Returns the keyId that signed it.
+func VerifyRequest(r *http.Request, body []byte, getkey func(keyID string) (*rsa.PublicKey, error)) (string, error) {
+	params := parseSignature(r.Header.Get("Signature"))
+	keyID, sig64 := params["keyId"], params["signature"]
+	if keyID == "" || sig64 == "" {
+		return "", fmt.Errorf("Request is not signed")
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	// Make sure the important parts of the request are covered by the signature
+	for _, required := range []string{"(request-target)", "host", "date"} {
+		if !slices.Contains(headers, required) {
+			return "", fmt.Errorf("Signature doesn't cover %s", required)
+		}
+	}
+	if body != nil {
+		if r.Header.Get("Digest") != bodyDigest(body) {
+			return "", fmt.Errorf("Digest doesn't match the body")
+		}
+		if !slices.Contains(headers, "digest") {
+			return "", fmt.Errorf("Signature doesn't cover digest")
+		}
+	}
+
+	// Don't accept replays of old requests
+	if date, err := http.ParseTime(r.Header.Get("Date")); err != nil {
+		return "", err
+	} else if d := time.Since(date); d > time.Hour || d < -time.Hour {
+		return "", fmt.Errorf("Request date is too far off")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sig64)
+	if err != nil {
+		return "", err
+	}
+	key, err := getkey(keyID)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(signingString(r, headers)))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+// Sends a signed request, body is nil for GET requests
+func signedRequest(client *http.Client, method, url string, body []byte, key *rsa.PrivateKey, keyID string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/activity+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/activity+json")
+	}
+	if err := SignRequest(req, key, keyID, body); err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyRequest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keyID = "https://blog.example/actor#main-key"
+	body := []byte(`{"type":"Follow"}`)
+
+	tests := []struct {
+		name   string
+		body   []byte                       // What gets signed
+		change func(r *http.Request) []byte // Messes with the request, returns the body that arrives
+		key    *rsa.PublicKey
+		ok     bool
+	}{
+		{
+			name: "get without a body",
+			ok:   true,
+		},
+		{
+			name:   "post with a body",
+			body:   body,
+			change: func(r *http.Request) []byte { return body },
+			ok:     true,
+		},
+		{
+			name: "tampered digest",
+			body: body,
+			change: func(r *http.Request) []byte {
+				r.Header.Set("Digest", bodyDigest([]byte(`{"type":"Delete"}`)))
+				return []byte(`{"type":"Delete"}`)
+			},
+		},
+		{
+			name:   "tampered body",
+			body:   body,
+			change: func(r *http.Request) []byte { return []byte(`{"type":"Delete"}`) },
+		},
+		{
+			name: "digest left out of the signature",
+			change: func(r *http.Request) []byte {
+				r.Header.Set("Digest", bodyDigest(body))
+				return body
+			},
+		},
+		{
+			name: "different path",
+			change: func(r *http.Request) []byte {
+				r.URL.Path = "/outbox"
+				return nil
+			},
+		},
+		{
+			name: "different host",
+			change: func(r *http.Request) []byte {
+				r.Host = "evil.example"
+				return nil
+			},
+		},
+		{
+			name: "old date",
+			change: func(r *http.Request) []byte {
+				r.Header.Set("Date", time.Now().Add(-2*time.Hour).UTC().Format(http.TimeFormat))
+				return nil
+			},
+		},
+		{
+			name: "not covering the date",
+			change: func(r *http.Request) []byte {
+				r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), `headers="(request-target) host date"`, `headers="(request-target) host"`, 1))
+				return nil
+			},
+		},
+		{
+			name: "unsigned",
+			change: func(r *http.Request) []byte {
+				r.Header.Del("Signature")
+				return nil
+			},
+		},
+		{
+			name: "someone else's key",
+			key:  &other.PublicKey,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodPost, "https://them.example/inbox", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := SignRequest(r, key, keyID, test.body); err != nil {
+				t.Fatal(err)
+			}
+
+			received := test.body
+			if test.change != nil {
+				received = test.change(r)
+			}
+			pub := test.key
+			if pub == nil {
+				pub = &key.PublicKey
+			}
+
+			got, err := VerifyRequest(r, received, func(id string) (*rsa.PublicKey, error) {
+				if id != keyID {
+					return nil, fmt.Errorf("unknown key %s", id)
+				}
+				return pub, nil
+			})
+			if test.ok && (err != nil || got != keyID) {
+				t.Errorf("got %q, %v, want it signed by %s", got, err, keyID)
+			} else if !test.ok && err == nil {
+				t.Error("verified a request that shouldn't have been")
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Bump this whenever indexedDoc or the way text gets analyzed changes, old
+// index files get rebuilt instead of being read
+const searchIndexVersion = 2
+
+const searchIndexFile = "search-index.gob"
+
+// Saving the whole index after every change is slow with a lot of posts, so
+// changes get saved every so often instead. Posts that changed after the last
+// save just get indexed again on the next start
+const searchIndexSaveFrequency = time.Minute
+
+// What gets written to disk
+type indexFile struct {
+	Version  int
+	Analyzer string
+	Docs     map[PostID]indexedDoc
+}
+
+// When the files of a post last changed, used to know if the saved index is
+// still right about the post
+func PostModTime(dir string) (time.Time, error) {
+	var newest time.Time
+	for _, name := range []string{"post.toml", "post.md"} {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return newest, err
+		}
+		if stat.ModTime().After(newest) {
+			newest = stat.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// Reads the posts that were indexed last time. Anything wrong with the file
+// just means the posts have to be indexed again
+func (idx *SearchIndex) Load(path string) (map[PostID]indexedDoc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file indexFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file); err != nil {
+		return nil, err
+	} else if file.Version != searchIndexVersion {
+		return nil, fmt.Errorf("Search index is version %d, expected version %d", file.Version, searchIndexVersion)
+	} else if file.Analyzer != idx.Analyzer.signature {
+		return nil, fmt.Errorf("Search settings changed since the index was saved")
+	}
+	return file.Docs, nil
+}
+
+// Saves the index, only one save happens at a time
+func (idx *SearchIndex) Save(path string) error {
+	idx.saving.Lock()
+	defer idx.saving.Unlock()
+
+	// Changes that happen while saving get saved next time
+	idx.changed.Store(false)
+	var buf bytes.Buffer
+	idx.Lock.RLock()
+	err := gob.NewEncoder(&buf).Encode(indexFile{
+		Version:  searchIndexVersion,
+		Analyzer: idx.Analyzer.signature,
+		Docs:     idx.Docs,
+	})
+	idx.Lock.RUnlock()
+	if err == nil {
+		err = WriteFileAtomic(path, buf.Bytes(), 0664)
+	}
+	if err != nil {
+		idx.changed.Store(true)
+	}
+	return err
+}
+
+// Saves the index if any posts changed since the last save
+func (idx *SearchIndex) SaveChanged(path string) error {
+	if !idx.changed.Load() {
+		return nil
+	}
+	return idx.Save(path)
+}
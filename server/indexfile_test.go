@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSearchIndexFile(t *testing.T) {
+	english, err := NewAnalyzer("english", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), searchIndexFile)
+	modtime := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	idx := NewSearchIndex(english)
+	posts := slices.Clone(searchTestPosts)
+	for i := range posts {
+		idx.Add(&posts[i], modtime)
+	}
+	if err := idx.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	docs, err := NewSearchIndex(english).Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 || docs["gc"].Info.Title != "Garbage collection in Go" || !docs["gc"].ModTime.Equal(modtime) ||
+		!slices.Equal(docs["rust"].Positions["memori"], []int{5}) {
+		t.Errorf("got %+v", docs)
+	}
+
+	// Other settings analyze text differently, so the index can't be used
+	for _, settings := range []struct {
+		language  string
+		stopwords []string
+	}{{"french", nil}, {"english", []string{"go"}}, {"none", nil}} {
+		analyzer, err := NewAnalyzer(settings.language, settings.stopwords)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewSearchIndex(analyzer).Load(path); err == nil {
+			t.Errorf("loaded an index saved with other settings for %v", settings)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("nonsense"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSearchIndex(english).Load(path); err == nil {
+		t.Error("loaded a broken index")
+	}
+}
+
+func TestSavedIndexChecksModTimes(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"abc": `Title = "Cats"`,
+		"def": `Title = "Dogs"`,
+	})
+	dir := ps.Cfg.PostDir
+	if _, err := os.Stat(filepath.Join(dir, searchIndexFile)); err != nil {
+		t.Fatal("index wasn't saved: ", err)
+	}
+
+	// Posts that look unchanged come from the saved index without being read
+	path := filepath.Join(dir, "abc", "post.md")
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("Hamsters"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	search := func(query string) []PostID {
+		ps, err := NewPostStats(ps.Cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := ps.SearchAndRank(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	if got := search("hamsters"); len(got) != 0 {
+		t.Errorf("got %v from a post that should have come from the saved index", got)
+	}
+
+	// Changed posts get read again
+	later := stat.ModTime().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("hamsters"); !slices.Equal(got, []PostID{"abc"}) {
+		t.Errorf("got %v after the post changed", got)
+	}
+
+	// Deleted posts go away
+	if err := os.RemoveAll(filepath.Join(dir, "def")); err != nil {
+		t.Fatal(err)
+	}
+	if got := search("dogs"); len(got) != 0 {
+		t.Errorf("got %v after the post was deleted", got)
+	}
+}
+
+func TestSaveChangedIndex(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"abc": `Title = "Cats"`,
+	})
+	path := filepath.Join(ps.Cfg.PostDir, searchIndexFile)
+	saved := func() time.Time {
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.ModTime()
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changed so nothing gets written
+	ps.SaveIndex()
+	if !saved().Equal(old) {
+		t.Error("saved the index without any changes")
+	}
+
+	// Changes wait for the next save
+	writePostText(t, ps, "abc", "Hamsters")
+	if !saved().Equal(old) {
+		t.Error("saved the index straight away")
+	}
+	ps.SaveIndex()
+	if saved().Equal(old) {
+		t.Error("didn't save the changed index")
+	}
+	docs, err := ps.Index.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := docs["abc"].Positions["hamster"]; !ok {
+		t.Errorf("saved index has %v", docs["abc"].Positions)
+	}
+}
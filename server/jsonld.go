@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+)
+
+// Structured data is just a tree of maps that html/template serializes as JSON
+// when it is placed inside of a <script type="application/ld+json"> tag
+type JSONLD map[string]any
+
+func jsonldPerson(cfg *BlogConfig) JSONLD {
+	return JSONLD{
+		"@type": "Person",
+		"name":  cfg.Author,
+	}
+}
+
+// Structured data for a single post page
+func PostJSONLD(cfg *BlogConfig, links Links, post *Post) JSONLD {
+	url := links.Post(post.Id)
+	updated := post.Info.Updated
+	if updated.IsZero() {
+		updated = post.Info.Date
+	}
+
+	images := make([]string, len(post.Images))
+	for i, img := range post.Images {
+		images[i] = links.Abs(img)
+	}
+
+	data := JSONLD{
+		"@context":         "https://schema.org",
+		"@type":            "BlogPosting",
+		"@id":              url,
+		"url":              url,
+		"mainEntityOfPage": url,
+		"headline":         post.Info.Title,
+		"datePublished":    post.Info.Date.Format(time.RFC3339),
+		"dateModified":     updated.Format(time.RFC3339),
+		"author":           jsonldPerson(cfg),
+		"isPartOf": JSONLD{
+			"@type": "Blog",
+			"@id":   links.Home(),
+			"name":  cfg.Title,
+		},
+	}
+	if len(post.Info.Tags) > 0 {
+		data["keywords"] = post.Info.Tags
+	}
+	if len(images) > 0 {
+		data["image"] = images
+	}
+	return data
+}
+
+// Structured data for the home page, describes both the blog and the website so
+// that search engines can use the search box
+func BlogJSONLD(cfg *BlogConfig, links Links) []JSONLD {
+	return []JSONLD{
+		{
+			"@context": "https://schema.org",
+			"@type":    "Blog",
+			"@id":      links.Home(),
+			"url":      links.Home(),
+			"name":     cfg.Title,
+			"author":   jsonldPerson(cfg),
+		},
+		{
+			"@context": "https://schema.org",
+			"@type":    "WebSite",
+			"url":      links.Home(),
+			"name":     cfg.Title,
+			"potentialAction": JSONLD{
+				"@type":       "SearchAction",
+				"target":      links.Base + "/home?Search={search_term_string}",
+				"query-input": "required name=search_term_string",
+			},
+		},
+	}
+}
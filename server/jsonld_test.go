@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostJSONLD(t *testing.T) {
+	cfg := &BlogConfig{Title: "My Blog", Author: "Jo"}
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	post := &Post{
+		Id:     "abc",
+		Info:   PostInfo{Title: "Hello", Date: date, Tags: []string{"go"}},
+		Images: []string{"/attachments/abc/cat.png", "https://elsewhere.example/dog.png"},
+	}
+
+	data := PostJSONLD(cfg, Links{Base: "https://blog.example"}, post)
+	for key, want := range map[string]string{
+		"@type":         "BlogPosting",
+		"@id":           "https://blog.example/post/abc",
+		"url":           "https://blog.example/post/abc",
+		"headline":      "Hello",
+		"datePublished": "2024-03-01T12:00:00Z",
+		// Falls back to the date it was posted
+		"dateModified": "2024-03-01T12:00:00Z",
+	} {
+		if data[key] != want {
+			t.Errorf("%s is %v, want %s", key, data[key], want)
+		}
+	}
+	if author := data["author"].(JSONLD); author["name"] != "Jo" {
+		t.Errorf("author is %v", author)
+	}
+	if blog := data["isPartOf"].(JSONLD); blog["@id"] != "https://blog.example/" || blog["name"] != "My Blog" {
+		t.Errorf("isPartOf is %v", blog)
+	}
+	if keywords := data["keywords"].([]string); !slices.Equal(keywords, []string{"go"}) {
+		t.Errorf("keywords are %v", keywords)
+	}
+	// Images on the blog get the whole url
+	want := []string{"https://blog.example/attachments/abc/cat.png", "https://elsewhere.example/dog.png"}
+	if images := data["image"].([]string); !slices.Equal(images, want) {
+		t.Errorf("images are %v, want %v", images, want)
+	}
+
+	post.Info.Updated = date.Add(24 * time.Hour)
+	post.Info.Tags = nil
+	post.Images = nil
+	data = PostJSONLD(cfg, Links{Base: "https://blog.example"}, post)
+	if data["dateModified"] != "2024-03-02T12:00:00Z" {
+		t.Errorf("dateModified is %v", data["dateModified"])
+	}
+	for _, key := range []string{"keywords", "image"} {
+		if _, ok := data[key]; ok {
+			t.Errorf("%s is set without any", key)
+		}
+	}
+}
+
+func TestBlogJSONLD(t *testing.T) {
+	data := BlogJSONLD(&BlogConfig{Title: "My Blog", Author: "Jo"}, Links{Base: "https://blog.example"})
+	if len(data) != 2 || data[0]["@type"] != "Blog" || data[1]["@type"] != "WebSite" {
+		t.Fatalf("got %v", data)
+	}
+	if data[0]["url"] != "https://blog.example/" || data[0]["name"] != "My Blog" {
+		t.Errorf("blog is %v", data[0])
+	}
+	action := data[1]["potentialAction"].(JSONLD)
+	if action["target"] != "https://blog.example/home?Search={search_term_string}" {
+		t.Errorf("search target is %v", action["target"])
+	}
+}
+
+func TestPostPageJSONLD(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc":   `Title = "Garbage collection"`,
+		"rust": `Title = "Ownership in Rust"`,
+	})
+	mux := testMux(t)
+	HandlePosts(ps)
+	t.Chdir("..")
+
+	// Searching from a post still describes the post in the address
+	for _, target := range []string{"/post/gc", "/post/gc?Search=ownership"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+target, nil))
+		body := w.Body.String()
+		start := strings.Index(body, `<script type="application/ld+json">`)
+		end := strings.Index(body[max(start, 0):], "</script>")
+		if w.Code != http.StatusOK || start == -1 || end == -1 {
+			t.Fatalf("%s gave %d without any structured data:\n%s", target, w.Code, body)
+		}
+		var data struct {
+			Headline string `json:"headline"`
+		}
+		if err := json.Unmarshal([]byte(body[start+len(`<script type="application/ld+json">`):start+end]), &data); err != nil {
+			t.Fatal(err)
+		}
+		if data.Headline != "Garbage collection" {
+			t.Errorf("%s has the structured data of %q", target, data.Headline)
+		}
+	}
+}
@@ -5,12 +5,15 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -19,12 +22,44 @@ type BlogConfig struct {
 	PostDir  string
 	Password string
 	Title    string
+	Author   string
+	Username string
 	CertFile string
 	KeyFile  string
 	Addr     string
 	Secure   bool
 	PIDFile  string
 	LogFile  string
+	MediaDir string
+	BaseURL  string // Public url of the site, like https://blog.eklipsed.net
+
+	// Whether there is a proxy in front that sets X-Forwarded-Proto
+	TrustProxy bool
+
+	MicropubToken string
+
+	// Newsletter settings, the newsletter is disabled without an SMTP server or a base url
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	MailFrom     string
+	Newsletter   string // Either immediate or weekly
+
+	// Outside WebSub hub to ping, the blog is its own hub without one
+	WebSubHub string
+
+	// Language used for stemming search terms, or none
+	SearchLanguage string
+	StopWords      []string // Leave nil to use the language's stop words
+
+	// How long to keep statistics about what readers search for
+	SearchRetention time.Duration
+
+	// Order of the pages in the navigation bar by slug, pages left out go last
+	Pages []string
+
+	// Slug of the page about the author, embeds link to it
+	AboutPage string
 
 	Daemon bool
 }
@@ -49,13 +84,24 @@ func LoadBlogConfig() *BlogConfig {
 		PostDir:  "posts",
 		Password: "admin",
 		Title:    "Eklipsed's Blog",
+		Author:   "Eklipsed",
+		Username: "blog",
 		CertFile: "server.crt",
 		KeyFile:  "server.key",
 		Addr:     ":3000",
 		Secure:	  false,
 		PIDFile:  "",
 		LogFile:  "",
+		MediaDir: "media",
 		Daemon:   false,
+
+		Newsletter: "immediate",
+
+		SearchLanguage:  "english",
+		SearchRetention: 90 * 24 * time.Hour,
+
+		Pages:     []string{"about"},
+		AboutPage: "about",
 	}
 
 	// Load environment variables
@@ -91,6 +137,12 @@ func LoadBlogConfig() *BlogConfig {
 	if val, ok := os.LookupEnv("BLOG_TITLE"); ok {
 		cfg.Title = val
 	}
+	if val, ok := os.LookupEnv("BLOG_AUTHOR"); ok {
+		cfg.Author = val
+	}
+	if val, ok := os.LookupEnv("BLOG_USERNAME"); ok {
+		cfg.Username = val
+	}
 	if val, ok := os.LookupEnv("BLOG_CERT_FILE"); ok {
 		cfg.CertFile = val
 	}
@@ -106,6 +158,83 @@ func LoadBlogConfig() *BlogConfig {
 	if val, ok := os.LookupEnv("BLOG_PIDFILE"); ok {
 		cfg.PIDFile = val
 	}
+	if val, ok := os.LookupEnv("BLOG_BASE_URL"); ok {
+		if u, err := url.Parse(val); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Println("BLOG_BASE_URL must be an absolute http or https url")
+		} else if strings.Trim(u.Path, "/") != "" {
+			log.Println("BLOG_BASE_URL can't have a path, the blog has to be at the root of the site")
+		} else {
+			cfg.BaseURL = u.Scheme + "://" + u.Host
+		}
+	}
+	if val, ok := os.LookupEnv("BLOG_TRUST_PROXY"); ok {
+		cfg.TrustProxy = val != "0"
+	}
+	if val, ok := os.LookupEnv("BLOG_MEDIA_DIR"); ok {
+		cfg.MediaDir = val
+	}
+	if val, ok := os.LookupEnv("BLOG_MICROPUB_TOKEN"); ok {
+		cfg.MicropubToken = val
+	}
+	if val, ok := os.LookupEnv("BLOG_SMTP_ADDR"); ok {
+		cfg.SMTPAddr = val
+	}
+	if val, ok := os.LookupEnv("BLOG_SMTP_USER"); ok {
+		cfg.SMTPUser = val
+	}
+	if val, ok := os.LookupEnv("BLOG_SMTP_PASSWORD"); ok {
+		cfg.SMTPPassword = val
+	}
+	if val, ok := os.LookupEnv("BLOG_MAIL_FROM"); ok {
+		cfg.MailFrom = val
+	}
+	if val, ok := os.LookupEnv("BLOG_NEWSLETTER"); ok {
+		if val != "immediate" && val != "weekly" {
+			log.Println("BLOG_NEWSLETTER must be either immediate or weekly")
+		} else {
+			cfg.Newsletter = val
+		}
+	}
+	if val, ok := os.LookupEnv("BLOG_WEBSUB_HUB"); ok {
+		cfg.WebSubHub = val
+	}
+	if val, ok := os.LookupEnv("BLOG_SEARCH_LANGUAGE"); ok {
+		cfg.SearchLanguage = strings.ToLower(val)
+	}
+	if val, ok := os.LookupEnv("BLOG_STOP_WORDS"); ok {
+		// Comma separated, setting it to nothing turns stop words off
+		cfg.StopWords = make([]string, 0)
+		for _, word := range strings.Split(val, ",") {
+			if word = strings.TrimSpace(word); word != "" {
+				cfg.StopWords = append(cfg.StopWords, word)
+			}
+		}
+	}
+	if val, ok := os.LookupEnv("BLOG_SEARCH_RETENTION"); ok {
+		// In days
+		if days, err := strconv.Atoi(val); err != nil || days <= 0 {
+			log.Println("BLOG_SEARCH_RETENTION must be a positive number of days")
+		} else {
+			cfg.SearchRetention = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if val, ok := os.LookupEnv("BLOG_PAGES"); ok {
+		// Comma separated slugs
+		cfg.Pages = make([]string, 0)
+		for _, slug := range strings.Split(val, ",") {
+			if slug = strings.TrimSpace(slug); slug != "" {
+				cfg.Pages = append(cfg.Pages, string(TagSlug(slug)))
+			}
+		}
+	}
+	if val, ok := os.LookupEnv("BLOG_ABOUT_PAGE"); ok {
+		// Empty when there isn't one
+		if val = strings.TrimSpace(val); val == "" {
+			cfg.AboutPage = ""
+		} else {
+			cfg.AboutPage = PageSlug(val)
+		}
+	}
 	if val, ok := os.LookupEnv("BLOG_LOGFILE"); ok {
 		logFile = openLogFile(val)
 	}
@@ -116,7 +245,8 @@ func LoadBlogConfig() *BlogConfig {
 func main() {
 	cfg := LoadBlogConfig()
 	server := &http.Server{
-		Addr: cfg.Addr,
+		Addr:    cfg.Addr,
+		Handler: CanonicalRedirect(cfg, http.DefaultServeMux),
 	}
 
 	// Handle automatic deployment and daemon
@@ -129,13 +259,37 @@ func main() {
 	}
 
 	// Handle uploads, admin page, and the upload page
-	HandleAdmin(ps)
+	session := HandleAdmin(ps)
 
 	// Handle viewing posts/main pages
 	HandlePosts(ps)
 
 	// Handle viewing posts by tags
-	HandleTags(ps)
+	HandleTags(ps, session)
+
+	// Handle receiving and moderating webmentions
+	HandleWebmentions(ps, session)
+
+	// Handle statistics about what readers search for
+	HandleSearchLog(ps, session)
+
+	// Handle fediverse followers
+	HandleActivityPub(ps)
+
+	// Handle publishing from micropub clients
+	HandleMicropub(ps)
+
+	// Handle embedding posts on other sites
+	HandleOEmbed(ps)
+
+	// Handle email subscriptions
+	HandleNewsletter(ps)
+
+	// Handle the feed and pushing it to feed readers
+	HandleWebSub(ps)
+
+	// Handle searching from other programs
+	HandleAPI(ps)
 
 	// Serve attachments
 	http.HandleFunc("/attachments/{postid}/{file}", func(w http.ResponseWriter, r *http.Request) {
@@ -159,6 +313,12 @@ func main() {
 		return
 	}
 
+	// Don't lose the searches and index changes since the last save
+	if err := ps.Searches.Save(); err != nil {
+		log.Println(err)
+	}
+	ps.SaveIndex()
+
 	// Run deployment script if nessesary
 	if !runDeployment {
 		// Close the old logfile
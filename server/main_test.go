@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Handlers get registered on the default mux, so every test gets a fresh one
+func testMux(t *testing.T) *http.ServeMux {
+	old := http.DefaultServeMux
+	http.DefaultServeMux = http.NewServeMux()
+	t.Cleanup(func() { http.DefaultServeMux = old })
+	return http.DefaultServeMux
+}
+
+func writePostInfo(t *testing.T, dir string, id PostID, info string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, string(id)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, string(id), "post.toml"), []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Starts a blog with some posts in a temporary directory, the posts are the
+// contents of their post.toml
+func testBlog(t *testing.T, posts map[PostID]string) *PostStats {
+	t.Helper()
+	dir := t.TempDir()
+	for id, info := range posts {
+		writePostInfo(t, dir, id, info)
+		if err := os.WriteFile(filepath.Join(dir, string(id), "post.md"), []byte("Some text"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Changes made by the test have to look newer than the post, even
+		// when the clock doesn't tick in between
+		old := time.Now().Add(-time.Hour)
+		for _, name := range []string{"post.toml", "post.md"} {
+			if err := os.Chtimes(filepath.Join(dir, string(id), name), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ps, err := NewPostStats(&BlogConfig{PostDir: dir, SearchLanguage: "english"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.toml")
+
+	// Writes at the same time never mix, one of them wins whole
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := WriteFileAtomic(path, bytes.Repeat([]byte{byte('a' + i)}, 1<<16), 0600); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1<<16 || len(bytes.Trim(data, string(data[:1]))) != 0 {
+		t.Errorf("file is a mix of writes")
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("file has mode %v", stat.Mode())
+	}
+	if ents, err := os.ReadDir(dir); err != nil || len(ents) != 1 {
+		t.Errorf("left behind %v", ents)
+	}
+}
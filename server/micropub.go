@@ -0,0 +1,633 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	maxMicropubUpload = (1 << 20) * 64
+	maxMicropubForm   = 1 << 20 // Limit when the token is in the body and has to be read first
+)
+
+// Properties of an h-entry, values are either strings or objects like {"html": ...}
+type mf2Props map[string][]any
+
+// A post being created or edited through micropub
+type micropubPost struct {
+	Dir     string
+	Info    PostInfo
+	Content string
+}
+
+type micropubRequest struct {
+	Action  string
+	URL     string
+	Props   mf2Props // Properties for creating a post
+	Replace mf2Props
+	Add     mf2Props
+	Delete  mf2Props // A nil list means remove the whole property
+	Files   []*multipart.FileHeader
+}
+
+func micropubError(w http.ResponseWriter, code int, err, desc string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             err,
+		"error_description": desc,
+	})
+}
+
+// Checks the bearer token from the header or the form
+func checkMicropubToken(cfg *BlogConfig, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.FormValue("access_token")
+	}
+	if cfg.MicropubToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MicropubToken)) == 1
+}
+
+// Limits the body and checks the token before anything big gets read, so only
+// clients sending the token in the header can upload large files
+func authorizeMicropub(cfg *BlogConfig, w http.ResponseWriter, r *http.Request) bool {
+	limit := int64(maxMicropubForm)
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		limit = maxMicropubUpload
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return checkMicropubToken(cfg, r)
+}
+
+// Gets the string values of a property
+func (props mf2Props) strings(key string) []string {
+	vals := make([]string, 0, len(props[key]))
+	for _, val := range props[key] {
+		switch v := val.(type) {
+		case string:
+			vals = append(vals, v)
+		case map[string]any:
+			// Rich content and photos with alt text are objects
+			for _, k := range []string{"html", "markdown", "value"} {
+				if s, ok := v[k].(string); ok {
+					vals = append(vals, s)
+					break
+				}
+			}
+		}
+	}
+	return vals
+}
+
+func (props mf2Props) first(key string) string {
+	if vals := props.strings(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Reads either a form encoded or JSON micropub request
+func parseMicropubRequest(r *http.Request) (micropubRequest, error) {
+	var req micropubRequest
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			Type       []string        `json:"type"`
+			Properties mf2Props        `json:"properties"`
+			Action     string          `json:"action"`
+			URL        string          `json:"url"`
+			Replace    mf2Props        `json:"replace"`
+			Add        mf2Props        `json:"add"`
+			Delete     json.RawMessage `json:"delete"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMicropubForm)).Decode(&body); err != nil {
+			return req, err
+		}
+		if body.Action == "" && !slices.Contains(body.Type, "h-entry") {
+			return req, fmt.Errorf("Only h-entry posts are supported")
+		}
+
+		req.Action, req.URL = body.Action, body.URL
+		req.Props, req.Replace, req.Add = body.Properties, body.Replace, body.Add
+
+		// Deletes are either a list of properties or values to remove from properties
+		if len(body.Delete) > 0 {
+			var names []string
+			if err := json.Unmarshal(body.Delete, &names); err == nil {
+				req.Delete = make(mf2Props)
+				for _, name := range names {
+					req.Delete[name] = nil
+				}
+			} else if err := json.Unmarshal(body.Delete, &req.Delete); err != nil {
+				return req, err
+			}
+		}
+		return req, nil
+	}
+
+	if err := r.ParseMultipartForm(maxMicropubUpload); err != nil && err != http.ErrNotMultipart {
+		return req, err
+	}
+	req.Action, req.URL = r.PostForm.Get("action"), r.PostForm.Get("url")
+	if req.Action == "" && r.PostForm.Get("h") != "entry" {
+		return req, fmt.Errorf("Only h-entry posts are supported")
+	}
+
+	req.Props = make(mf2Props)
+	for key, vals := range r.PostForm {
+		key = strings.TrimSuffix(key, "[]")
+		if key == "h" || key == "action" || key == "url" || key == "access_token" || strings.HasPrefix(key, "mp-") {
+			continue
+		}
+		for _, val := range vals {
+			req.Props[key] = append(req.Props[key], val)
+		}
+	}
+	if r.MultipartForm != nil {
+		req.Files = append(r.MultipartForm.File["photo"], r.MultipartForm.File["photo[]"]...)
+	}
+	return req, nil
+}
+
+// Copies a file into the post, returning it's name in the post directory
+func (mp *micropubPost) copyFile(src io.Reader, name string) (string, error) {
+	name = filepath.Base(name)
+	file, err := os.Create(filepath.Join(mp.Dir, name))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, src)
+	return name, err
+}
+
+// Adds photos to the end of the post. Photos that were uploaded to the media
+// endpoint get copied in as attachments of the post.
+func (mp *micropubPost) addPhotos(cfg *BlogConfig, links Links, photos []string, files []*multipart.FileHeader) error {
+	images := make([]string, 0)
+	for _, photo := range photos {
+		if name, ok := strings.CutPrefix(photo, links.Abs("/media/")); ok {
+			src, err := os.Open(filepath.Join(cfg.MediaDir, filepath.Base(name)))
+			if err != nil {
+				return err
+			}
+			photo, err = mp.copyFile(src, name)
+			src.Close()
+			if err != nil {
+				return err
+			}
+		}
+		images = append(images, photo)
+	}
+	for _, h := range files {
+		src, err := h.Open()
+		if err != nil {
+			return err
+		}
+		name, err := mp.copyFile(src, h.Filename)
+		src.Close()
+		if err != nil {
+			return err
+		}
+		images = append(images, name)
+	}
+
+	for _, image := range images {
+		mp.Content = strings.TrimRight(mp.Content, "\n") + fmt.Sprintf("\n\n![](%s)\n", image)
+	}
+	return nil
+}
+
+// Applies properties to the post, replacing what was there before
+func (mp *micropubPost) replace(props mf2Props) error {
+	if _, ok := props["name"]; ok {
+		mp.Info.Title = props.first("name")
+	}
+	if _, ok := props["content"]; ok {
+		mp.Content = props.first("content")
+	}
+	if _, ok := props["category"]; ok {
+		mp.Info.Tags = props.strings("category")
+	}
+	if _, ok := props["published"]; ok {
+		date, err := time.Parse(time.RFC3339, props.first("published"))
+		if err != nil {
+			return err
+		}
+		mp.Info.Date = date
+	}
+	return nil
+}
+
+func (mp *micropubPost) add(props mf2Props) {
+	for _, tag := range props.strings("category") {
+		if !slices.Contains(mp.Info.Tags, tag) {
+			mp.Info.Tags = append(mp.Info.Tags, tag)
+		}
+	}
+	if content := props.first("content"); content != "" {
+		mp.Content = strings.TrimRight(mp.Content, "\n") + "\n\n" + content
+	}
+}
+
+func (mp *micropubPost) delete(props mf2Props) {
+	for key, vals := range props {
+		switch key {
+		case "category":
+			if vals == nil {
+				mp.Info.Tags = nil
+			} else {
+				remove := props.strings("category")
+				mp.Info.Tags = slices.DeleteFunc(mp.Info.Tags, func(tag string) bool {
+					return slices.Contains(remove, tag)
+				})
+			}
+		case "name":
+			mp.Info.Title = ""
+		case "content":
+			mp.Content = ""
+		}
+	}
+}
+
+// Writes the post out in the same layout that uploaded posts use
+func (mp *micropubPost) save() error {
+	// Notes don't have a name so use the start of the content
+	if strings.TrimSpace(mp.Info.Title) == "" {
+		line, _, _ := strings.Cut(strings.TrimSpace(mp.Content), "\n")
+		if runes := []rune(line); len(runes) > 60 {
+			line = string(runes[:60]) + "…"
+		}
+		if line == "" {
+			line = FormatDate(mp.Info.Date)
+		}
+		mp.Info.Title = line
+	}
+
+	if err := SavePostInfo(mp.Dir, mp.Info); err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(mp.Dir, "post.md"), []byte(mp.Content), 0664)
+}
+
+// Makes a directory in the posts directory that the loader skips, so a post
+// can be written there and only show up once it's moved into place
+func newStagingDir(postdir string) (string, error) {
+	return os.MkdirTemp(postdir, ".staged-*")
+}
+
+// Whether a directory in the posts directory is a post. Hidden ones are posts
+// being staged or replaced
+func isPostDir(ent os.DirEntry) bool {
+	return ent.IsDir() && !strings.HasPrefix(ent.Name(), ".")
+}
+
+// Copies a post into a staging directory so it can be changed without
+// touching the original, returning the new directory
+func stagePost(postdir, dir string) (string, error) {
+	staged, err := newStagingDir(postdir)
+	if err != nil {
+		return "", err
+	}
+
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		os.RemoveAll(staged)
+		return "", err
+	}
+	for _, ent := range ents {
+		if !ent.Type().IsRegular() {
+			continue
+		}
+		src, err := os.Open(filepath.Join(dir, ent.Name()))
+		if err != nil {
+			os.RemoveAll(staged)
+			return "", err
+		}
+		mp := micropubPost{Dir: staged}
+		_, err = mp.copyFile(src, ent.Name())
+		src.Close()
+		if err != nil {
+			os.RemoveAll(staged)
+			return "", err
+		}
+	}
+	return staged, nil
+}
+
+// The hidden name a post gets while it's being replaced
+func replacedDir(dst string) string {
+	return filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".old")
+}
+
+// Moves a directory into place, over the old one if there is one. The old one
+// is kept until the new one is there
+func replaceDir(src, dst string) error {
+	old := replacedDir(dst)
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// Tidies up after a crash in the middle of staging or replacing a post. Posts
+// that were moved out of the way but never replaced get put back
+func cleanStagingDirs(postdir string) error {
+	ents, err := os.ReadDir(postdir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		name := ent.Name()
+		if !ent.IsDir() {
+			continue
+		} else if strings.HasPrefix(name, ".staged-") {
+			err = os.RemoveAll(filepath.Join(postdir, name))
+		} else if id, ok := strings.CutSuffix(strings.TrimPrefix(name, "."), ".old"); ok && strings.HasPrefix(name, ".") {
+			dst := filepath.Join(postdir, id)
+			if _, err = os.Stat(dst); os.IsNotExist(err) {
+				log.Printf("Putting back post %s, it was never replaced\n", id)
+				err = os.Rename(filepath.Join(postdir, name), dst)
+			} else if err == nil {
+				err = os.RemoveAll(filepath.Join(postdir, name))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func HandleMicropub(ps *PostStats) {
+	// Finds the post that a url is pointing to
+	getpost := func(r *http.Request, rawurl string) (*micropubPost, bool) {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, false
+		}
+		id, ok := ps.targetPost(r, u)
+		if !ok {
+			return nil, false
+		}
+
+		mp := &micropubPost{Dir: filepath.Join(ps.Cfg.PostDir, string(id))}
+		if mp.Info, err = LoadPostInfo(mp.Dir); err != nil {
+			return nil, false
+		}
+		if data, err := os.ReadFile(filepath.Join(mp.Dir, "post.md")); err != nil {
+			return nil, false
+		} else {
+			mp.Content = string(data)
+		}
+		return mp, true
+	}
+
+	// Makes sure the post is valid and then lists it. The post gets written to
+	// a staging directory first and only gets moved into place, over the old
+	// post if it's an update, once it's known to be good
+	publish := func(w http.ResponseWriter, r *http.Request, mp *micropubPost, id PostID) bool {
+		if err := mp.save(); err != nil {
+			log.Println(err)
+			micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't save the post")
+			return false
+		}
+		if ok, _, err := ValidatePost(ps, mp.Dir, id); err != nil || !ok {
+			desc := "The post is not valid"
+			if perr, isperr := err.(*PostError); isperr {
+				desc = perr.Msg
+			} else if err != nil {
+				log.Println(err)
+			}
+			micropubError(w, http.StatusBadRequest, "invalid_request", desc)
+			return false
+		}
+
+		if dir := filepath.Join(ps.Cfg.PostDir, string(id)); dir != mp.Dir {
+			if err := replaceDir(mp.Dir, dir); err != nil {
+				log.Println(err)
+				micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't save the post")
+				return false
+			}
+			mp.Dir = dir
+		}
+		if err := ps.Add(id); err != nil {
+			log.Println(err)
+			micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't add the post")
+			return false
+		}
+		SendWebmentions(ps, ps.Links(r), id)
+		return true
+	}
+
+	http.HandleFunc("GET /micropub", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMicropubToken(ps.Cfg, r) {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid access token")
+			return
+		}
+
+		links := ps.Links(r)
+		var resp any
+		switch r.URL.Query().Get("q") {
+		case "config":
+			resp = map[string]any{
+				"media-endpoint": links.Abs("/micropub/media"),
+				"syndicate-to":   []string{},
+			}
+		case "syndicate-to":
+			resp = map[string]any{"syndicate-to": []string{}}
+		case "source":
+			mp, ok := getpost(r, r.URL.Query().Get("url"))
+			if !ok {
+				micropubError(w, http.StatusBadRequest, "invalid_request", "Post not found")
+				return
+			}
+			props := mf2Props{
+				"name":      {mp.Info.Title},
+				"content":   {mp.Content},
+				"published": {mp.Info.Date.Format(time.RFC3339)},
+				"category":  {},
+			}
+			for _, tag := range mp.Info.Tags {
+				props["category"] = append(props["category"], tag)
+			}
+			resp = map[string]any{"type": []string{"h-entry"}, "properties": props}
+		default:
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Unknown query")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	http.HandleFunc("POST /micropub", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeMicropub(ps.Cfg, w, r) {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid access token")
+			return
+		}
+		req, err := parseMicropubRequest(r)
+		if err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		links := ps.Links(r)
+		switch req.Action {
+		case "":
+			id, err := GeneratePostID(ps.Cfg.PostDir)
+			if err != nil {
+				log.Println(err)
+				micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't create the post")
+				return
+			}
+			staged, err := newStagingDir(ps.Cfg.PostDir)
+			if err != nil {
+				log.Println(err)
+				micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't create the post")
+				return
+			}
+			defer os.RemoveAll(staged)
+			mp := &micropubPost{
+				Dir:  staged,
+				Info: PostInfo{Date: time.Now(), Tags: []string{}},
+			}
+
+			err = mp.replace(req.Props)
+			if err == nil {
+				err = mp.addPhotos(ps.Cfg, links, req.Props.strings("photo"), req.Files)
+			}
+			if err != nil {
+				micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			if !publish(w, r, mp, id) {
+				os.RemoveAll(mp.Dir)
+				return
+			}
+
+			w.Header().Set("Location", links.Post(id))
+			w.WriteHeader(http.StatusCreated)
+
+		case "update":
+			mp, ok := getpost(r, req.URL)
+			if !ok {
+				micropubError(w, http.StatusBadRequest, "invalid_request", "Post not found")
+				return
+			}
+
+			// Work on a copy so a bad update can't break the live post
+			id := PostID(filepath.Base(mp.Dir))
+			staged, err := stagePost(ps.Cfg.PostDir, mp.Dir)
+			if err != nil {
+				log.Println(err)
+				micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't update the post")
+				return
+			}
+			defer os.RemoveAll(staged)
+			mp.Dir = staged
+
+			mp.delete(req.Delete)
+			err = mp.replace(req.Replace)
+			if err == nil {
+				mp.add(req.Add)
+				err = mp.addPhotos(ps.Cfg, links, req.Add.strings("photo"), nil)
+			}
+			if err != nil {
+				micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+				return
+			}
+			mp.Info.Updated = time.Now()
+			if publish(w, r, mp, id) {
+				w.WriteHeader(http.StatusNoContent)
+			}
+
+		case "delete":
+			u, err := url.Parse(req.URL)
+			if err != nil {
+				micropubError(w, http.StatusBadRequest, "invalid_request", "Invalid url")
+				return
+			}
+			if id, ok := ps.targetPost(r, u); !ok {
+				micropubError(w, http.StatusBadRequest, "invalid_request", "Post not found")
+			} else if _, err := DeletePost(ps, id); err != nil {
+				log.Println(err)
+				micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't delete the post")
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+
+		default:
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Unsupported action")
+		}
+	})
+
+	// Media gets stored outside of the posts until a post uses it
+	http.HandleFunc("POST /micropub/media", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeMicropub(ps.Cfg, w, r) {
+			micropubError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid access token")
+			return
+		} else if err := r.ParseMultipartForm(maxMicropubUpload); err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			micropubError(w, http.StatusBadRequest, "invalid_request", "Missing file")
+			return
+		}
+		defer file.Close()
+
+		if err := os.MkdirAll(ps.Cfg.MediaDir, 0755); err != nil {
+			log.Println(err)
+			micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't save the file")
+			return
+		}
+		id, err := GeneratePostID(ps.Cfg.MediaDir)
+		if err != nil {
+			log.Println(err)
+			micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't save the file")
+			return
+		}
+		name := string(id) + strings.ToLower(filepath.Ext(header.Filename))
+
+		dst, err := os.Create(filepath.Join(ps.Cfg.MediaDir, name))
+		if err != nil {
+			log.Println(err)
+			micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't save the file")
+			return
+		}
+		defer dst.Close()
+		if _, err := io.Copy(dst, file); err != nil {
+			log.Println(err)
+			micropubError(w, http.StatusInternalServerError, "server_error", "Couldn't save the file")
+			return
+		}
+
+		w.Header().Set("Location", ps.Links(r).Abs("/media/"+name))
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	http.HandleFunc("GET /media/{file}", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, filepath.Join(ps.Cfg.MediaDir, r.PathValue("file")))
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testMicropub(t *testing.T, token string) (*PostStats, *http.ServeMux) {
+	t.Helper()
+	cfg := &BlogConfig{PostDir: t.TempDir(), MediaDir: t.TempDir(), MicropubToken: token, SearchLanguage: "english"}
+	ps, err := NewPostStats(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := testMux(t)
+	HandleMicropub(ps)
+	return ps, mux
+}
+
+// Sends a micropub request with the token in the header
+func micropub(mux *http.ServeMux, method, target, contentType string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://blog.example"+target, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestMicropubAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string // Token the blog is set up with
+		header string
+		query  string
+		code   int
+	}{
+		{"bearer token", "secret", "Bearer secret", "", http.StatusOK},
+		{"token in the query", "secret", "", "&access_token=secret", http.StatusOK},
+		{"no token", "secret", "", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer guess", "", http.StatusUnauthorized},
+		{"wrong token in the query", "secret", "", "&access_token=guess", http.StatusUnauthorized},
+		{"other kind of auth", "secret", "Basic secret", "", http.StatusUnauthorized},
+		{"micropub isn't set up", "", "Bearer ", "&access_token=", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, mux := testMicropub(t, test.token)
+			r := httptest.NewRequest("GET", "http://blog.example/micropub?q=config"+test.query, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("got %d, want %d", w.Code, test.code)
+			}
+		})
+	}
+
+	// Nothing gets posted without the token
+	ps, mux := testMicropub(t, "secret")
+	r := httptest.NewRequest("POST", "http://blog.example/micropub", strings.NewReader("h=entry&content=Hi"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer guess")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || len(ps.Posts) != 0 {
+		t.Errorf("got %d and %d posts", w.Code, len(ps.Posts))
+	}
+}
+
+// Gets the post that a micropub response points to
+func createdPost(t *testing.T, ps *PostStats, w *httptest.ResponseRecorder) (PostID, string) {
+	t.Helper()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	id, ok := strings.CutPrefix(w.Header().Get("Location"), "http://blog.example/post/")
+	if !ok {
+		t.Fatalf("created at %s", w.Header().Get("Location"))
+	}
+	content, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, id, "post.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PostID(id), string(content)
+}
+
+func TestMicropubCreate(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		title       string
+		content     string
+		tags        []string
+	}{
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"h": {"entry"}, "name": {"Hello"}, "content": {"Some text"}, "category[]": {"go", "web"}}.Encode(),
+			title:       "Hello",
+			content:     "Some text",
+			tags:        []string{"go", "web"},
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"type": ["h-entry"], "properties": {"name": ["Hello"], "content": [{"html": "<p>Some text</p>"}], "category": ["go"]}}`,
+			title:       "Hello",
+			content:     "<p>Some text</p>",
+			tags:        []string{"go"},
+		},
+		{
+			name:        "note without a name",
+			contentType: "application/x-www-form-urlencoded",
+			body:        url.Values{"h": {"entry"}, "content": {"Just a note\nwith two lines"}}.Encode(),
+			title:       "Just a note",
+			content:     "Just a note\nwith two lines",
+			tags:        []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps, mux := testMicropub(t, "secret")
+			id, content := createdPost(t, ps, micropub(mux, "POST", "/micropub", test.contentType, test.body))
+			if content != test.content {
+				t.Errorf("content is %q, want %q", content, test.content)
+			}
+			info, ok := ps.Posts[id]
+			if !ok {
+				t.Fatal("post wasn't listed")
+			}
+			if info.Title != test.title || !slices.Equal(info.Tags, test.tags) {
+				t.Errorf("got %q tagged %v, want %q tagged %v", info.Title, info.Tags, test.title, test.tags)
+			}
+		})
+	}
+
+	t.Run("not an entry", func(t *testing.T) {
+		ps, mux := testMicropub(t, "secret")
+		w := micropub(mux, "POST", "/micropub", "application/json", `{"type": ["h-event"], "properties": {}}`)
+		if w.Code != http.StatusBadRequest || len(ps.Posts) != 0 {
+			t.Errorf("got %d and %d posts", w.Code, len(ps.Posts))
+		}
+	})
+}
+
+func TestMicropubUpdateAndDelete(t *testing.T) {
+	ps, mux := testMicropub(t, "secret")
+	body := url.Values{"h": {"entry"}, "name": {"Hello"}, "content": {"Some text"}, "category": {"go", "web"}}.Encode()
+	id, _ := createdPost(t, ps, micropub(mux, "POST", "/micropub", "application/x-www-form-urlencoded", body))
+	postURL := "http://blog.example/post/" + string(id)
+
+	update := `{"action": "update", "url": "` + postURL + `",
+		"replace": {"name": ["Hi"]},
+		"add": {"category": ["rust"], "content": ["More text"]},
+		"delete": {"category": ["web"]}}`
+	if w := micropub(mux, "POST", "/micropub", "application/json", update); w.Code != http.StatusNoContent {
+		t.Fatalf("updating got %d: %s", w.Code, w.Body)
+	}
+
+	w := micropub(mux, "GET", "/micropub?q=source&url="+url.QueryEscape(postURL), "", "")
+	var source struct {
+		Properties map[string][]string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&source); err != nil {
+		t.Fatal(err)
+	}
+	props := source.Properties
+	if !slices.Equal(props["name"], []string{"Hi"}) ||
+		!slices.Equal(props["content"], []string{"Some text\n\nMore text"}) ||
+		!slices.Equal(props["category"], []string{"go", "rust"}) {
+		t.Errorf("after updating the post is %v", props)
+	}
+	if ps.Posts[id].Updated.IsZero() {
+		t.Error("the post wasn't marked as updated")
+	}
+
+	// Removing a whole property
+	update = `{"action": "update", "url": "` + postURL + `", "delete": ["category"]}`
+	if w := micropub(mux, "POST", "/micropub", "application/json", update); w.Code != http.StatusNoContent {
+		t.Fatalf("updating got %d: %s", w.Code, w.Body)
+	}
+	if tags := ps.Posts[id].Tags; len(tags) != 0 {
+		t.Errorf("tags are %v after deleting them", tags)
+	}
+
+	// Posts on other sites can't be updated
+	update = `{"action": "update", "url": "http://other.example/post/` + string(id) + `", "replace": {"name": ["Bye"]}}`
+	if w := micropub(mux, "POST", "/micropub", "application/json", update); w.Code != http.StatusBadRequest {
+		t.Errorf("updating another site got %d", w.Code)
+	}
+
+	w = micropub(mux, "POST", "/micropub", "application/x-www-form-urlencoded", url.Values{"action": {"delete"}, "url": {postURL}}.Encode())
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting got %d: %s", w.Code, w.Body)
+	}
+	if _, ok := ps.Posts[id]; ok {
+		t.Error("post is still listed")
+	}
+	if _, err := os.Stat(filepath.Join(ps.Cfg.PostDir, string(id))); !os.IsNotExist(err) {
+		t.Error("post is still there")
+	}
+}
+
+// Directories in the posts directory, which should only ever be posts
+func postDirs(t *testing.T, ps *PostStats) []string {
+	t.Helper()
+	ents, err := os.ReadDir(ps.Cfg.PostDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs := make([]string, 0)
+	for _, ent := range ents {
+		if ent.IsDir() {
+			dirs = append(dirs, ent.Name())
+		}
+	}
+	return dirs
+}
+
+func TestMicropubBadUpdate(t *testing.T) {
+	ps, mux := testMicropub(t, "secret")
+	body := url.Values{"h": {"entry"}, "name": {"Hello"}, "content": {"Some text"}}.Encode()
+	id, _ := createdPost(t, ps, micropub(mux, "POST", "/micropub", "application/x-www-form-urlencoded", body))
+	before, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, string(id), "post.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The name gets changed before the date turns out to be wrong
+	update := `{"action": "update", "url": "http://blog.example/post/` + string(id) + `",
+		"replace": {"name": ["Bye"], "published": ["yesterday"]}}`
+	if w := micropub(mux, "POST", "/micropub", "application/json", update); w.Code != http.StatusBadRequest {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	after, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, string(id), "post.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) || ps.Posts[id].Title != "Hello" {
+		t.Errorf("post changed from\n%s\nto\n%s", before, after)
+	}
+	if dirs := postDirs(t, ps); !slices.Equal(dirs, []string{string(id)}) {
+		t.Errorf("left behind %v", dirs)
+	}
+}
+
+func TestMicropubBodyLimit(t *testing.T) {
+	ps, mux := testMicropub(t, "secret")
+
+	// Without the token in the header the body has to be read to find it, so it
+	// can't be big
+	body := url.Values{"h": {"entry"}, "content": {strings.Repeat("a", maxMicropubForm)}, "access_token": {"secret"}}.Encode()
+	r := httptest.NewRequest("POST", "http://blog.example/micropub", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || len(ps.Posts) != 0 {
+		t.Errorf("got %d and %d posts", w.Code, len(ps.Posts))
+	}
+
+	// It's fine with the token in the header
+	w = micropub(mux, "POST", "/micropub", "application/x-www-form-urlencoded", body)
+	if w.Code != http.StatusCreated {
+		t.Errorf("got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestMicropubMedia(t *testing.T) {
+	ps, mux := testMicropub(t, "secret")
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "Cat.PNG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte("not really a png"))
+	mw.Close()
+
+	w := micropub(mux, "POST", "/micropub/media", mw.FormDataContentType(), body.String())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("uploading got %d: %s", w.Code, w.Body)
+	}
+	media := w.Header().Get("Location")
+	name, ok := strings.CutPrefix(media, "http://blog.example/media/")
+	if !ok || filepath.Ext(name) != ".png" {
+		t.Fatalf("uploaded to %s", media)
+	}
+
+	// Posts get their own copy of the photo
+	form := url.Values{"h": {"entry"}, "content": {"Look"}, "photo": {media}}.Encode()
+	id, content := createdPost(t, ps, micropub(mux, "POST", "/micropub", "application/x-www-form-urlencoded", form))
+	if content != "Look\n\n![]("+name+")\n" {
+		t.Errorf("content is %q", content)
+	}
+	if data, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, string(id), name)); err != nil || string(data) != "not really a png" {
+		t.Errorf("photo wasn't copied: %v", err)
+	}
+}
+
+func TestCleanStagingDirs(t *testing.T) {
+	dir := t.TempDir()
+	writePostInfo(t, dir, "abc", `Title = "Current"`)
+	writePostInfo(t, dir, ".abc.old", `Title = "Replaced"`)
+	writePostInfo(t, dir, ".def.old", `Title = "Never replaced"`)
+	writePostInfo(t, dir, ".staged-123", `Title = "Half done"`)
+	for _, id := range []string{"abc", ".abc.old", ".def.old", ".staged-123"} {
+		if err := os.WriteFile(filepath.Join(dir, id, "post.md"), []byte("Some text"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A crash in the middle of an update leaves these behind
+	ps, err := NewPostStats(&BlogConfig{PostDir: dir, SearchLanguage: "english"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.Posts) != 2 || ps.Posts["abc"].Title != "Current" || ps.Posts["def"].Title != "Never replaced" {
+		t.Errorf("posts are %v", ps.Posts)
+	}
+	if dirs := postDirs(t, ps); !slices.Equal(dirs, []string{"abc", "def"}) {
+		t.Errorf("left behind %v", dirs)
+	}
+}
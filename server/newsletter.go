@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// How long someone has to click the link in their confirmation email
+const confirmWindow = 7 * 24 * time.Hour
+
+// How long to wait before sending someone another confirmation email, so
+// signing up over and over doesn't flood their inbox
+const confirmResendWait = time.Hour
+
+// Someone who signed up for the newsletter
+type Subscriber struct {
+	Email     string
+	Token     string // Secret used for confirming and unsubscribing
+	Confirmed bool
+	Since     time.Time
+	Sent      time.Time // When the last confirmation email went out
+}
+
+type Newsletter struct {
+	ps          *PostStats
+	queue       *RetryQueue
+	subscribers []Subscriber
+	digest      []PostID // Posts waiting for the next weekly digest
+	lastDigest  time.Time
+	lock        sync.RWMutex
+}
+
+// Layout of subscribers.toml
+type newsletterFile struct {
+	Subscribers []Subscriber
+	Digest      []PostID
+	LastDigest  time.Time
+}
+
+func LoadNewsletter(ps *PostStats) (*Newsletter, error) {
+	nl := &Newsletter{
+		ps:          ps,
+		queue:       NewRetryQueue("newsletter", 5, time.Minute),
+		subscribers: make([]Subscriber, 0),
+		digest:      make([]PostID, 0),
+	}
+
+	var file newsletterFile
+	if data, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, "subscribers.toml")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := toml.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		nl.subscribers = file.Subscribers
+		nl.digest = file.Digest
+		nl.lastDigest = file.LastDigest
+	}
+
+	// Start counting the week from when the newsletter was first turned on
+	if nl.lastDigest.IsZero() {
+		nl.lastDigest = time.Now()
+	}
+	return nl, nil
+}
+
+// Saves the subscribers, expects the lock to already be held
+func (nl *Newsletter) save() error {
+	if data, err := toml.Marshal(newsletterFile{
+		Subscribers: nl.subscribers,
+		Digest:      nl.digest,
+		LastDigest:  nl.lastDigest,
+	}); err != nil {
+		return err
+	} else {
+		return WriteFileAtomic(filepath.Join(nl.ps.Cfg.PostDir, "subscribers.toml"), data, 0600)
+	}
+}
+
+func newToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Finds a subscriber by their token, expects the lock to already be held
+func (nl *Newsletter) find(token string) int {
+	if token == "" {
+		return -1
+	}
+	return slices.IndexFunc(nl.subscribers, func(s Subscriber) bool { return s.Token == token })
+}
+
+// Links in emails always use the configured base url, the host a request
+// came in on could be anything
+func (nl *Newsletter) links() Links {
+	return Links{Base: nl.ps.Cfg.BaseURL}
+}
+
+// Sends a single plain text email
+func (nl *Newsletter) send(to Subscriber, subject, body string) error {
+	cfg := nl.ps.Cfg
+	unsubscribe := nl.links().Abs("/unsubscribe?token=" + to.Token)
+
+	from := cfg.MailFrom
+	if from == "" {
+		from = cfg.Username + "@localhost"
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+	if sender.Name == "" {
+		sender.Name = cfg.Title
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", sender.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.Email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", newToken(), sender.Address[strings.LastIndex(sender.Address, "@")+1:])
+	fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", unsubscribe)
+	fmt.Fprintf(&msg, "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	fmt.Fprintf(&msg, "\r\n-- \r\nUnsubscribe: %s\r\n", unsubscribe)
+
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		host := cfg.SMTPAddr
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(cfg.SMTPAddr, auth, sender.Address, []string{to.Email}, []byte(msg.String()))
+}
+
+// Queues an email for every confirmed subscriber. The subscriber is looked up
+// again before sending so that people who unsubscribe in the meantime are skipped
+func (nl *Newsletter) broadcast(subject string, body func(links Links) string) {
+	nl.lock.RLock()
+	tokens := make([]string, 0)
+	for _, s := range nl.subscribers {
+		if s.Confirmed {
+			tokens = append(tokens, s.Token)
+		}
+	}
+	nl.lock.RUnlock()
+
+	for _, token := range tokens {
+		nl.queue.Push(func(int) error {
+			nl.lock.RLock()
+			i := nl.find(token)
+			var to Subscriber
+			if i != -1 {
+				to = nl.subscribers[i]
+			}
+			nl.lock.RUnlock()
+			if i == -1 || !to.Confirmed {
+				return nil
+			}
+
+			return nl.send(to, subject, body(nl.links()))
+		})
+	}
+}
+
+// Short plain text version of a post for emails
+func postBlurb(links Links, post *Post) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s\n%s\n\n", post.Info.Title, FormatDate(post.Info.Date))
+	if post.Summary != "" {
+		fmt.Fprintf(&text, "%s\n\n", post.Summary)
+	}
+	fmt.Fprintf(&text, "Read it here: %s\n", links.Post(post.Id))
+	return text.String()
+}
+
+// Sends new posts out right away or saves them for the digest
+func (nl *Newsletter) postListener(event PostEvent, id PostID, info PostInfo) {
+	if event != PostCreated {
+		return
+	}
+
+	if nl.ps.Cfg.Newsletter == "weekly" {
+		nl.lock.Lock()
+		defer nl.lock.Unlock()
+		nl.digest = append(nl.digest, id)
+		if err := nl.save(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	post, err := LoadPost(filepath.Join(nl.ps.Cfg.PostDir, string(id)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	nl.broadcast(post.Info.Title, func(links Links) string {
+		return postBlurb(links, &post)
+	})
+}
+
+// Sends out the weekly digest once a week has passed since the last one
+func (nl *Newsletter) sendDigest() {
+	nl.lock.Lock()
+	if time.Since(nl.lastDigest) < 7*24*time.Hour {
+		nl.lock.Unlock()
+		return
+	}
+	ids := nl.digest
+	nl.digest = make([]PostID, 0)
+	nl.lastDigest = time.Now()
+	if err := nl.save(); err != nil {
+		log.Println(err)
+	}
+	nl.lock.Unlock()
+
+	// Posts may have been deleted since they were published
+	posts := make([]Post, 0, len(ids))
+	for _, id := range ids {
+		if post, err := LoadPost(filepath.Join(nl.ps.Cfg.PostDir, string(id))); err == nil {
+			posts = append(posts, post)
+		}
+	}
+	if len(posts) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("This week on %s", nl.ps.Cfg.Title)
+	nl.broadcast(subject, func(links Links) string {
+		var text strings.Builder
+		fmt.Fprintf(&text, "%d new posts this week:\n\n", len(posts))
+		for i := range posts {
+			text.WriteString(postBlurb(links, &posts[i]))
+			text.WriteString("\n")
+		}
+		return text.String()
+	})
+}
+
+// Adds someone to the newsletter and sends them a link to confirm it
+func (nl *Newsletter) subscribe(email string) error {
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+
+	// Forget about people who never confirmed
+	nl.subscribers = slices.DeleteFunc(nl.subscribers, func(s Subscriber) bool {
+		return !s.Confirmed && time.Since(s.Since) > confirmWindow
+	})
+
+	i := slices.IndexFunc(nl.subscribers, func(s Subscriber) bool { return strings.EqualFold(s.Email, email) })
+	if i != -1 && (nl.subscribers[i].Confirmed || time.Since(nl.subscribers[i].Sent) < confirmResendWait) {
+		// Don't tell anyone who is already subscribed or was just sent an email
+		return nil
+	} else if i == -1 {
+		nl.subscribers = append(nl.subscribers, Subscriber{
+			Email: email,
+			Token: newToken(),
+			Since: time.Now(),
+		})
+		i = len(nl.subscribers) - 1
+	}
+	nl.subscribers[i].Sent = time.Now()
+	if err := nl.save(); err != nil {
+		return err
+	}
+
+	to := nl.subscribers[i]
+	nl.queue.Push(func(int) error {
+		return nl.send(to, "Confirm your subscription to "+nl.ps.Cfg.Title, fmt.Sprintf(
+			"Someone (hopefully you) signed up for %s with this address.\n\n"+
+				"Click here to confirm: %s\n\n"+
+				"If it wasn't you, just ignore this email.\n",
+			nl.ps.Cfg.Title, nl.links().Abs("/subscribe/confirm?token="+to.Token)))
+	})
+	return nil
+}
+
+func (nl *Newsletter) confirm(token string) (bool, error) {
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+
+	i := nl.find(token)
+	if i == -1 || (!nl.subscribers[i].Confirmed && time.Since(nl.subscribers[i].Since) > confirmWindow) {
+		return false, nil
+	} else if nl.subscribers[i].Confirmed {
+		return true, nil
+	}
+
+	nl.subscribers[i].Confirmed = true
+	nl.subscribers[i].Since = time.Now()
+	log.Printf("newsletter: %s subscribed\n", nl.subscribers[i].Email)
+	return true, nl.save()
+}
+
+// Whether a token belongs to anyone
+func (nl *Newsletter) subscribed(token string) bool {
+	nl.lock.RLock()
+	defer nl.lock.RUnlock()
+	return nl.find(token) != -1
+}
+
+func (nl *Newsletter) unsubscribe(token string) (bool, error) {
+	nl.lock.Lock()
+	defer nl.lock.Unlock()
+
+	i := nl.find(token)
+	if i == -1 {
+		return false, nil
+	}
+	log.Printf("newsletter: %s unsubscribed\n", nl.subscribers[i].Email)
+	nl.subscribers = slices.Delete(nl.subscribers, i, i+1)
+	return true, nl.save()
+}
+
+func HandleNewsletter(ps *PostStats) {
+	if ps.Cfg.SMTPAddr == "" {
+		return
+	} else if ps.Cfg.BaseURL == "" {
+		log.Println("The newsletter is disabled, BLOG_BASE_URL needs to be set for the links in emails")
+		return
+	}
+	nl, err := LoadNewsletter(ps)
+	if err != nil {
+		log.Println(err)
+		log.Println("The newsletter is disabled")
+		return
+	}
+	ps.Listen(nl.postListener)
+
+	if ps.Cfg.Newsletter == "weekly" {
+		go func() {
+			for range time.Tick(time.Hour) {
+				nl.sendDigest()
+			}
+		}()
+	}
+
+	// Shows a short message, either in place of the form or as its own page.
+	// With a token it asks whether to unsubscribe
+	page := func(w http.ResponseWriter, r *http.Request, code int, msg, token string) {
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/base.html", "views/nav.html", "views/subscribe.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		exec := "base"
+		if r.Header.Get("HX-Request") == "true" {
+			exec = "subscribed"
+		} else {
+			w.WriteHeader(code)
+		}
+		if err := tmpl.ExecuteTemplate(w, exec, struct {
+			Title        string
+			SearchTarget string
+			Message      string
+			Token        string
+		}{
+			Title:        ps.Cfg.Title,
+			SearchTarget: "main",
+			Message:      msg,
+			Token:        token,
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+	message := func(w http.ResponseWriter, r *http.Request, code int, msg string) {
+		page(w, r, code, msg, "")
+	}
+
+	http.HandleFunc("POST /subscribe", func(w http.ResponseWriter, r *http.Request) {
+		addr, err := mail.ParseAddress(r.FormValue("Email"))
+		if err != nil {
+			message(w, r, http.StatusBadRequest, "That doesn't look like an email address.")
+			return
+		}
+		if err := nl.subscribe(addr.Address); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		message(w, r, http.StatusOK, "Check your inbox for a link to confirm your subscription.")
+	})
+
+	http.HandleFunc("GET /subscribe/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if ok, err := nl.confirm(r.FormValue("token")); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if !ok {
+			message(w, r, http.StatusNotFound, "That confirmation link has expired, try subscribing again.")
+		} else {
+			message(w, r, http.StatusOK, "You're subscribed!")
+		}
+	})
+
+	// The link in an email only asks, mail scanners open links without anyone
+	// clicking them
+	http.HandleFunc("GET /unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		if token := r.FormValue("token"); !nl.subscribed(token) {
+			message(w, r, http.StatusNotFound, "You aren't subscribed.")
+		} else {
+			page(w, r, http.StatusOK, "Unsubscribe from "+ps.Cfg.Title+"?", token)
+		}
+	})
+
+	// Either the form from the link or a one-click unsubscribe from the mail client
+	http.HandleFunc("POST /unsubscribe", func(w http.ResponseWriter, r *http.Request) {
+		if ok, err := nl.unsubscribe(r.FormValue("token")); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if !ok {
+			message(w, r, http.StatusNotFound, "You aren't subscribed.")
+		} else {
+			message(w, r, http.StatusOK, "You've been unsubscribed.")
+		}
+	})
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An email the fake SMTP server got
+type smtpMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Starts an SMTP server that accepts everything and hands over what it gets
+func fakeSMTP(t *testing.T) (string, <-chan smtpMail) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	mails := make(chan smtpMail, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, mails)
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func serveSMTP(conn net.Conn, mails chan<- smtpMail) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+
+	var m smtpMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 fake")
+		case "MAIL":
+			m = smtpMail{From: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			m.To = append(m.To, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			m.Data = string(data)
+			tp.PrintfLine("250 OK")
+			mails <- m
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func receiveMail(t *testing.T, mails <-chan smtpMail) smtpMail {
+	t.Helper()
+	select {
+	case m := <-mails:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+		return smtpMail{}
+	}
+}
+
+func expectNoMail(t *testing.T, mails <-chan smtpMail) {
+	t.Helper()
+	select {
+	case m := <-mails:
+		t.Fatalf("didn't expect an email, got one to %v:\n%s", m.To, m.Data)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func testNewsletter(t *testing.T, cfg BlogConfig) (*Newsletter, <-chan smtpMail) {
+	addr, mails := fakeSMTP(t)
+	cfg.PostDir = t.TempDir()
+	cfg.SMTPAddr = addr
+	cfg.BaseURL = "https://blog.example"
+	nl, err := LoadNewsletter(&PostStats{Cfg: &cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nl, mails
+}
+
+func TestNewsletterSend(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      BlogConfig
+		subject  string
+		body     string
+		from     string // Envelope sender
+		fromName string
+	}{
+		{
+			name:     "plain",
+			cfg:      BlogConfig{Title: "My Blog", MailFrom: "news@blog.example"},
+			subject:  "Hello",
+			body:     "Hi there",
+			from:     "news@blog.example",
+			fromName: "My Blog",
+		},
+		{
+			name:     "sender with a name",
+			cfg:      BlogConfig{Title: "My Blog", MailFrom: "Jo <jo@blog.example>"},
+			subject:  "Hello",
+			body:     "Hi there",
+			from:     "jo@blog.example",
+			fromName: "Jo",
+		},
+		{
+			name:     "no sender set",
+			cfg:      BlogConfig{Title: "My Blog", Username: "jo"},
+			subject:  "Hello",
+			body:     "Hi there",
+			from:     "jo@localhost",
+			fromName: "My Blog",
+		},
+		{
+			name:     "subject that isn't ascii",
+			cfg:      BlogConfig{Title: "My Blog", MailFrom: "news@blog.example"},
+			subject:  "Café ☕ time",
+			body:     "Hi there",
+			from:     "news@blog.example",
+			fromName: "My Blog",
+		},
+		{
+			name:     "lines starting with dots",
+			cfg:      BlogConfig{Title: "My Blog", MailFrom: "news@blog.example"},
+			subject:  "Dots",
+			body:     "First line\n.\n..two dots\nlast line",
+			from:     "news@blog.example",
+			fromName: "My Blog",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nl, mails := testNewsletter(t, test.cfg)
+			to := Subscriber{Email: "reader@them.example", Token: "secret"}
+			if err := nl.send(to, test.subject, test.body); err != nil {
+				t.Fatal(err)
+			}
+
+			m := receiveMail(t, mails)
+			if m.From != test.from || len(m.To) != 1 || m.To[0] != to.Email {
+				t.Errorf("sent from %s to %v, want %s to %s", m.From, m.To, test.from, to.Email)
+			}
+
+			msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(m.Data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from, err := mail.ParseAddress(msg.Header.Get("From")); err != nil || from.Address != test.from || from.Name != test.fromName {
+				t.Errorf("From is %q, want %s <%s>", msg.Header.Get("From"), test.fromName, test.from)
+			}
+			if subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil || subject != test.subject {
+				t.Errorf("Subject is %q, want %q", msg.Header.Get("Subject"), test.subject)
+			}
+			if got, want := msg.Header.Get("List-Unsubscribe"), "<https://blog.example/unsubscribe?token=secret>"; got != want {
+				t.Errorf("List-Unsubscribe is %q, want %q", got, want)
+			}
+			if got := msg.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+				t.Errorf("List-Unsubscribe-Post is %q", got)
+			}
+
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The line endings were turned back into \n when reading it
+			want := test.body + "\n-- \nUnsubscribe: https://blog.example/unsubscribe?token=secret\n"
+			if string(body) != want {
+				t.Errorf("body is %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestNewsletterSubscribe(t *testing.T) {
+	nl, mails := testNewsletter(t, BlogConfig{Title: "My Blog", MailFrom: "news@blog.example"})
+
+	if err := nl.subscribe("reader@them.example"); err != nil {
+		t.Fatal(err)
+	}
+	m := receiveMail(t, mails)
+	if len(m.To) != 1 || m.To[0] != "reader@them.example" {
+		t.Fatalf("confirmation went to %v", m.To)
+	}
+	token := nl.subscribers[0].Token
+	if !strings.Contains(m.Data, "https://blog.example/subscribe/confirm?token="+token) {
+		t.Errorf("confirmation doesn't have the link to confirm:\n%s", m.Data)
+	}
+
+	// Signing up again right away doesn't send another one
+	if err := nl.subscribe("Reader@them.example"); err != nil {
+		t.Fatal(err)
+	}
+	expectNoMail(t, mails)
+
+	// Nothing gets sent before confirming
+	nl.broadcast("New post", func(links Links) string { return "Read it" })
+	expectNoMail(t, mails)
+
+	if ok, err := nl.confirm(token); err != nil || !ok {
+		t.Fatalf("confirming gave %v, %v", ok, err)
+	}
+	nl.broadcast("New post", func(links Links) string { return "Read it at " + links.Post("abc") })
+	m = receiveMail(t, mails)
+	if !strings.Contains(m.Data, "Read it at https://blog.example/post/abc") {
+		t.Errorf("broadcast has the wrong body:\n%s", m.Data)
+	}
+
+	// Subscribing after confirming is ignored
+	if err := nl.subscribe("reader@them.example"); err != nil {
+		t.Fatal(err)
+	}
+	expectNoMail(t, mails)
+
+	if ok, err := nl.unsubscribe(token); err != nil || !ok {
+		t.Fatalf("unsubscribing gave %v, %v", ok, err)
+	}
+	nl.broadcast("New post", func(links Links) string { return "Read it" })
+	expectNoMail(t, mails)
+
+	// It all got saved
+	again, err := LoadNewsletter(nl.ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.subscribers) != 0 {
+		t.Errorf("still subscribed after loading again: %v", again.subscribers)
+	}
+}
+
+func TestNewsletterResendsConfirmationLater(t *testing.T) {
+	nl, mails := testNewsletter(t, BlogConfig{Title: "My Blog", MailFrom: "news@blog.example"})
+
+	if err := nl.subscribe("reader@them.example"); err != nil {
+		t.Fatal(err)
+	}
+	receiveMail(t, mails)
+
+	// Like the email got sent a while ago
+	nl.subscribers[0].Sent = time.Now().Add(-confirmResendWait)
+	if err := nl.subscribe("reader@them.example"); err != nil {
+		t.Fatal(err)
+	}
+	receiveMail(t, mails)
+}
+
+func TestUnsubscribeLink(t *testing.T) {
+	addr, _ := fakeSMTP(t)
+	ps := testBlog(t, map[PostID]string{})
+	ps.Cfg.SMTPAddr = addr
+	ps.Cfg.BaseURL = "https://blog.example"
+	nl, err := LoadNewsletter(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nl.subscribers = append(nl.subscribers, Subscriber{Email: "reader@them.example", Token: "secret", Confirmed: true})
+	if err := nl.save(); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir("..")
+	mux := testMux(t)
+	HandleNewsletter(ps)
+
+	// Opening the link only asks
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/unsubscribe?token=secret", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="token" value="secret"`) {
+		t.Errorf("opening the link gave %d:\n%s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/unsubscribe?token=other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("opening a link with a made up token gave %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/unsubscribe", strings.NewReader("token=secret"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("unsubscribing gave %d", w.Code)
+	}
+	if again, err := LoadNewsletter(ps); err != nil || len(again.subscribers) != 0 {
+		t.Errorf("still subscribed after unsubscribing: %v, %v", again.subscribers, err)
+	}
+}
+
+func TestSubscribeLinksUseBaseURL(t *testing.T) {
+	addr, mails := fakeSMTP(t)
+	ps := testBlog(t, map[PostID]string{})
+	ps.Cfg.SMTPAddr = addr
+	ps.Cfg.MailFrom = "news@blog.example"
+	t.Chdir("..")
+
+	// Without a base url there's nothing to make links with
+	mux := testMux(t)
+	HandleNewsletter(ps)
+	if _, pattern := mux.Handler(httptest.NewRequest("POST", "/subscribe", nil)); pattern != "" {
+		t.Fatalf("the newsletter is on without a base url")
+	}
+
+	ps.Cfg.BaseURL = "https://blog.example"
+	mux = testMux(t)
+	HandleNewsletter(ps)
+
+	// Whatever host the request says it's for
+	r := httptest.NewRequest("POST", "http://evil.example/subscribe", strings.NewReader("Email=reader@them.example"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mux.ServeHTTP(httptest.NewRecorder(), r)
+	m := receiveMail(t, mails)
+	if !strings.Contains(m.Data, "https://blog.example/subscribe/confirm?token=") || strings.Contains(m.Data, "evil.example") {
+		t.Errorf("confirmation email doesn't link to the blog:\n%s", m.Data)
+	}
+}
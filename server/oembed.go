@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/jpeg"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// An oEmbed rich response, see https://oembed.com
+type OEmbed struct {
+	XMLName         xml.Name `json:"-" xml:"oembed"`
+	Type            string   `json:"type" xml:"type"`
+	Version         string   `json:"version" xml:"version"`
+	Title           string   `json:"title" xml:"title"`
+	AuthorName      string   `json:"author_name" xml:"author_name"`
+	AuthorURL       string   `json:"author_url,omitempty" xml:"author_url,omitempty"`
+	ProviderName    string   `json:"provider_name" xml:"provider_name"`
+	ProviderURL     string   `json:"provider_url" xml:"provider_url"`
+	HTML            string   `json:"html" xml:"html"`
+	Width           int      `json:"width" xml:"width"`
+	Height          int      `json:"height" xml:"height"`
+	ThumbnailURL    string   `json:"thumbnail_url,omitempty" xml:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int      `json:"thumbnail_width,omitempty" xml:"thumbnail_width,omitempty"`
+	ThumbnailHeight int      `json:"thumbnail_height,omitempty" xml:"thumbnail_height,omitempty"`
+}
+
+// Size of an image attached to the post, images from other sites aren't known
+func attachedImageSize(dir string, post *Post, url string) (int, int, bool) {
+	for file := range post.Attachments {
+		if attachmentPath(post.Id, file) != url {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, file))
+		if err != nil {
+			return 0, 0, false
+		}
+		defer f.Close()
+		if cfg, _, err := image.DecodeConfig(f); err == nil {
+			return cfg.Width, cfg.Height, true
+		}
+		return 0, 0, false
+	}
+	return 0, 0, false
+}
+
+func HandleOEmbed(ps *PostStats) {
+	http.HandleFunc("GET /oembed", func(w http.ResponseWriter, r *http.Request) {
+		links := ps.Links(r)
+		query := r.URL.Query()
+
+		target, err := url.Parse(query.Get("url"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id, ok := ps.targetPost(r, target)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dir := filepath.Join(ps.Cfg.PostDir, string(id))
+		post, err := LoadPost(dir)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Fit the card into whatever the consumer has room for
+		width, height := 560, 320
+		if max, err := strconv.Atoi(query.Get("maxwidth")); err == nil && max > 0 {
+			width = min(width, max)
+		}
+		if max, err := strconv.Atoi(query.Get("maxheight")); err == nil && max > 0 {
+			height = min(height, max)
+		}
+
+		embed := OEmbed{
+			Type:         "rich",
+			Version:      "1.0",
+			Title:        post.Info.Title,
+			AuthorName:   ps.Cfg.Author,
+			ProviderName: ps.Cfg.Title,
+			ProviderURL:  links.Home(),
+			HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" scrolling="no" title="%s"></iframe>`,
+				template.HTMLEscapeString(links.Abs("/embed/post/"+string(id))),
+				width,
+				height,
+				template.HTMLEscapeString(post.Info.Title)),
+			Width:  width,
+			Height: height,
+		}
+		if slug := ps.Cfg.AboutPage; slug != "" {
+			if _, ok := ps.Page(slug); ok {
+				embed.AuthorURL = links.Page(slug)
+			}
+		}
+		// oEmbed wants the size with the thumbnail, so leave it out when that isn't known
+		if len(post.Images) > 0 {
+			if w, h, ok := attachedImageSize(dir, &post, post.Images[0]); ok {
+				embed.ThumbnailURL = links.Abs(post.Images[0])
+				embed.ThumbnailWidth, embed.ThumbnailHeight = w, h
+			}
+		}
+
+		switch query.Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(embed); err != nil {
+				log.Println(err)
+			}
+		case "xml":
+			w.Header().Set("Content-Type", "text/xml")
+			fmt.Fprint(w, xml.Header)
+			if err := xml.NewEncoder(w).Encode(embed); err != nil {
+				log.Println(err)
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+
+	// A small card of the post that is safe to put in an iframe anywhere
+	http.HandleFunc("GET /embed/post/{postid}", func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := template.New("embed").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/embed.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, r.PathValue("postid")))
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		image := ""
+		if len(post.Images) > 0 {
+			image = post.Images[0]
+		}
+
+		w.Header().Set("Content-Security-Policy", "frame-ancestors *")
+		if err := tmpl.ExecuteTemplate(w, "embed", struct {
+			Post     Post
+			Image    string
+			Provider string
+		}{
+			Post:     post,
+			Image:    image,
+			Provider: ps.Cfg.Title,
+		}); err != nil {
+			log.Println(err)
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testOEmbed(t *testing.T) (*PostStats, *http.ServeMux) {
+	t.Helper()
+	ps := testBlog(t, map[PostID]string{
+		"abc":  `Title = "Cats & dogs"` + "\n" + `Tags = ["pets"]`,
+		"text": `Title = "Only text"`,
+		"me":   `Title = "About me"` + "\n" + `Page = "about"`,
+	})
+	ps.Cfg.Title = "My Blog"
+	ps.Cfg.Author = "Jo"
+	ps.Cfg.AboutPage = "about"
+	post := "Pictures of **my** cats.\n\n![A cat](cat.png)\n"
+	if err := os.WriteFile(filepath.Join(ps.Cfg.PostDir, "abc", "post.md"), []byte(post), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(ps.Cfg.PostDir, "abc", "cat.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, image.NewRGBA(image.Rect(0, 0, 40, 30))); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := testMux(t)
+	HandleOEmbed(ps)
+	return ps, mux
+}
+
+func getOEmbed(mux *http.ServeMux, query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://blog.example/oembed?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestOEmbed(t *testing.T) {
+	_, mux := testOEmbed(t)
+
+	w := getOEmbed(mux, url.Values{"url": {"http://blog.example/post/abc"}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var embed OEmbed
+	if err := json.NewDecoder(w.Body).Decode(&embed); err != nil {
+		t.Fatal(err)
+	}
+	want := OEmbed{
+		Type:            "rich",
+		Version:         "1.0",
+		Title:           "Cats & dogs",
+		AuthorName:      "Jo",
+		AuthorURL:       "http://blog.example/about",
+		ProviderName:    "My Blog",
+		ProviderURL:     "http://blog.example/",
+		HTML:            `<iframe src="http://blog.example/embed/post/abc" width="560" height="320" frameborder="0" scrolling="no" title="Cats &amp; dogs"></iframe>`,
+		Width:           560,
+		Height:          320,
+		ThumbnailURL:    "http://blog.example/attachments/abc/cat.png",
+		ThumbnailWidth:  40,
+		ThumbnailHeight: 30,
+	}
+	if embed != want {
+		t.Errorf("got  %+v\nwant %+v", embed, want)
+	}
+
+	// Posts without images don't have a thumbnail
+	w = getOEmbed(mux, url.Values{"url": {"http://blog.example/post/text"}})
+	if strings.Contains(w.Body.String(), "thumbnail") {
+		t.Errorf("got a thumbnail without any images: %s", w.Body)
+	}
+}
+
+func TestOEmbedWithoutAboutPage(t *testing.T) {
+	ps, mux := testOEmbed(t)
+
+	// No author link when the about page isn't set or isn't there
+	for _, slug := range []string{"", "missing"} {
+		ps.Cfg.AboutPage = slug
+		w := getOEmbed(mux, url.Values{"url": {"http://blog.example/post/abc"}})
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "author_url") {
+			t.Errorf("%q: got %d with an author url: %s", slug, w.Code, w.Body)
+		}
+	}
+}
+
+func TestOEmbedThumbnailSizeUnknown(t *testing.T) {
+	ps, mux := testOEmbed(t)
+	post := "A cat from somewhere else.\n\n![A cat](https://pics.example/cat.png)\n"
+	if err := os.WriteFile(filepath.Join(ps.Cfg.PostDir, "text", "post.md"), []byte(post), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The size of an image on another site isn't known, so there's no thumbnail
+	w := getOEmbed(mux, url.Values{"url": {"http://blog.example/post/text"}})
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "thumbnail") {
+		t.Errorf("got %d with a thumbnail of unknown size: %s", w.Code, w.Body)
+	}
+}
+
+func TestOEmbedSize(t *testing.T) {
+	_, mux := testOEmbed(t)
+
+	tests := []struct {
+		maxwidth, maxheight string
+		width, height       int
+	}{
+		{"", "", 560, 320},
+		{"400", "", 400, 320},
+		{"", "200", 560, 200},
+		{"1000", "1000", 560, 320},
+		{"0", "-5", 560, 320},
+		{"wide", "", 560, 320},
+	}
+
+	for _, test := range tests {
+		t.Run(test.maxwidth+"x"+test.maxheight, func(t *testing.T) {
+			w := getOEmbed(mux, url.Values{
+				"url":       {"http://blog.example/post/abc"},
+				"maxwidth":  {test.maxwidth},
+				"maxheight": {test.maxheight},
+			})
+			var embed OEmbed
+			if err := json.NewDecoder(w.Body).Decode(&embed); err != nil {
+				t.Fatal(err)
+			}
+			if embed.Width != test.width || embed.Height != test.height {
+				t.Errorf("got %dx%d, want %dx%d", embed.Width, embed.Height, test.width, test.height)
+			}
+		})
+	}
+}
+
+func TestOEmbedFormats(t *testing.T) {
+	_, mux := testOEmbed(t)
+
+	w := getOEmbed(mux, url.Values{"url": {"http://blog.example/post/abc"}, "format": {"xml"}})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/xml" {
+		t.Fatalf("got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var embed OEmbed
+	if err := xml.NewDecoder(w.Body).Decode(&embed); err != nil {
+		t.Fatal(err)
+	}
+	if embed.Type != "rich" || embed.Title != "Cats & dogs" || embed.Width != 560 {
+		t.Errorf("got %+v", embed)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		format string
+		code   int
+	}{
+		{"unknown format", "http://blog.example/post/abc", "yaml", http.StatusNotImplemented},
+		{"post that doesn't exist", "http://blog.example/post/xyz", "", http.StatusNotFound},
+		{"not a post", "http://blog.example/about", "", http.StatusNotFound},
+		{"other site", "http://other.example/post/abc", "", http.StatusNotFound},
+		{"no url", "", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := getOEmbed(mux, url.Values{"url": {test.url}, "format": {test.format}})
+			if w.Code != test.code {
+				t.Errorf("got %d, want %d", w.Code, test.code)
+			}
+		})
+	}
+}
+
+func TestEmbedCard(t *testing.T) {
+	_, mux := testOEmbed(t)
+	t.Chdir("..")
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.example/embed/post/abc", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "frame-ancestors *" {
+		t.Errorf("Content-Security-Policy is %q", csp)
+	}
+	for _, want := range []string{
+		"<title>Cats &amp; dogs</title>",
+		`<img src="/attachments/abc/cat.png"`,
+		"<p>Pictures of my cats.</p>",
+		"#pets",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("card doesn't have %s:\n%s", want, w.Body)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.example/embed/post/xyz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("card of a post that doesn't exist got %d", w.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"cmp"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Left in the post directory once the old About tag has been turned into a page
+const aboutMigratedFile = "about-page-migrated"
+
+// A post that gets served at its own address instead of showing up in the feed
+type NavPage struct {
+	Id    PostID
+	Slug  string
+	Title string
+	URL   string
+}
+
+// Slugs are cleaned the same way as tags, so "Contact Me" ends up at /contact-me
+func PageSlug(name string) string {
+	return string(TagSlug(name))
+}
+
+// Gets the post served at a slug
+func (ps *PostStats) Page(slug string) (PostID, bool) {
+	ps.Lock.RLock()
+	defer ps.Lock.RUnlock()
+	id, ok := ps.Pages[slug]
+	return id, ok
+}
+
+// Every page in the order they go in the navigation bar. Pages in the config
+// come first, the rest get sorted by title
+func (ps *PostStats) NavPages(links Links) []NavPage {
+	ps.Lock.RLock()
+	defer ps.Lock.RUnlock()
+
+	pages := make([]NavPage, 0, len(ps.Pages))
+	for slug, id := range ps.Pages {
+		pages = append(pages, NavPage{Id: id, Slug: slug, Title: ps.Posts[id].Title, URL: links.Page(slug)})
+	}
+
+	order := func(slug string) int {
+		if i := slices.Index(ps.Cfg.Pages, slug); i != -1 {
+			return i
+		}
+		return len(ps.Cfg.Pages)
+	}
+	slices.SortFunc(pages, func(a, b NavPage) int {
+		if c := cmp.Compare(order(a.Slug), order(b.Slug)); c != 0 {
+			return c
+		}
+		return cmp.Or(cmp.Compare(a.Title, b.Title), cmp.Compare(a.Slug, b.Slug))
+	})
+	return pages
+}
+
+// Whether something else on the site is already served where a page would go.
+// Every method gets checked, a page at /webmention would show up but whatever
+// gets posted to it would go somewhere else
+func pageHidden(slug string) bool {
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		r, err := http.NewRequest(method, "/"+slug, nil)
+		if err != nil {
+			return true
+		}
+		_, pattern := http.DefaultServeMux.Handler(r)
+		if pattern != "" && !strings.HasSuffix(pattern, " /{page}") {
+			return true
+		}
+	}
+	return false
+}
+
+// The about page used to be the first post tagged About, those blogs get it
+// turned into a real page. This only happens once, after that the about page
+// is whatever the admin makes it. Expects the lock to already be held
+func (ps *PostStats) migrateAbout() {
+	marker := filepath.Join(ps.Cfg.PostDir, aboutMigratedFile)
+	if _, err := os.Stat(marker); err == nil {
+		return
+	}
+	// Errors get tried again on the next start
+	failed := false
+	defer func() {
+		if failed {
+			return
+		} else if err := os.WriteFile(marker, nil, 0664); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if _, ok := ps.Pages["about"]; ok {
+		return
+	}
+	abouts := ps.ByTag[ps.TagDB.Canonical("About")]
+	if len(abouts) == 0 {
+		return
+	}
+
+	id := abouts[0]
+	dir := filepath.Join(ps.Cfg.PostDir, string(id))
+	info, err := LoadPostInfo(dir)
+	if err != nil {
+		log.Println(err)
+		failed = true
+		return
+	}
+	info.Page = "about"
+	if err := SavePostInfo(dir, info); err != nil {
+		log.Println(err)
+		failed = true
+		return
+	}
+
+	ps.remove(id)
+	ps.list(id, info)
+	log.Printf("Post %s is now the about page", id)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNavPages(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"a":    `Title = "About me"` + "\n" + `Page = "about"`,
+		"b":    `Title = "Contact"` + "\n" + `Page = "Contact Me"`,
+		"c":    `Title = "Uses"` + "\n" + `Page = "uses"`,
+		"d":    `Title = "Now"` + "\n" + `Page = "now"`,
+		"post": `Title = "Hello"` + "\n" + `Tags = ["go"]`,
+	})
+
+	// Pages stay out of the feed, tags and search
+	if !slices.Equal(ps.ByDate, []PostID{"post"}) || len(ps.ByTag) != 1 {
+		t.Errorf("posts are %v with the tags %v", ps.ByDate, ps.ByTag)
+	}
+	if got, _ := ps.SearchAndRank("text"); !slices.Equal(got, []PostID{"post"}) {
+		t.Errorf("searching found %v", got)
+	}
+
+	tests := []struct {
+		name  string
+		order []string
+		want  []string
+	}{
+		{"sorted by title", nil, []string{"about", "contact-me", "now", "uses"}},
+		{"in the order of the config", []string{"uses", "about"}, []string{"uses", "about", "contact-me", "now"}},
+		{"slugs that aren't pages", []string{"nope", "now"}, []string{"now", "about", "contact-me", "uses"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps.Cfg.Pages = test.order
+			slugs := make([]string, 0)
+			for _, page := range ps.NavPages(Links{Base: "https://blog.example"}) {
+				slugs = append(slugs, page.Slug)
+				if page.URL != "https://blog.example/"+page.Slug {
+					t.Errorf("url of %s is %s", page.Slug, page.URL)
+				}
+			}
+			if !slices.Equal(slugs, test.want) {
+				t.Errorf("got %v, want %v", slugs, test.want)
+			}
+		})
+	}
+}
+
+func TestMigrateAbout(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"a": `Title = "About me"` + "\n" + `Tags = ["About"]`,
+		"b": `Title = "Hello"` + "\n" + `Tags = ["go"]`,
+	})
+	if id, ok := ps.Page("about"); !ok || id != "a" {
+		t.Errorf("about page is %q", id)
+	}
+	if _, ok := ps.ByTag["About"]; ok {
+		t.Error("about page is still tagged")
+	}
+
+	// It stays a page once the blog starts again
+	again, err := NewPostStats(ps.Cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := again.Page("about"); !ok || id != "a" {
+		t.Errorf("about page is %q after starting again", id)
+	}
+
+	// Only once, a post tagged About later on is just a post
+	if _, err := again.Remove("a", true); err != nil {
+		t.Fatal(err)
+	}
+	writePostInfo(t, ps.Cfg.PostDir, "c", `Title = "About this blog"`+"\n"+`Tags = ["About"]`)
+	if err := os.WriteFile(filepath.Join(ps.Cfg.PostDir, "c", "post.md"), []byte("Some text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	again, err = NewPostStats(ps.Cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := again.Page("about"); ok {
+		t.Errorf("%s became the about page", id)
+	}
+}
+
+func TestValidatePage(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"a": `Title = "About me"` + "\n" + `Page = "about"`,
+	})
+	mux := testMux(t)
+	mux.HandleFunc("GET /{page}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /home", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name string
+		id   PostID // Post the directory is going to become
+		page string
+		ok   bool
+	}{
+		{"new page", "b", "uses", true},
+		{"updating the page", "a", "about", true},
+		{"another post's page", "b", "about", false},
+		{"somewhere else on the site", "b", "home", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writePostInfo(t, dir, "new", `Title = "Page"`+"\n"+`Page = "`+test.page+`"`)
+			if err := os.WriteFile(filepath.Join(dir, "new", "post.md"), []byte("Some text"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ok, _, err := ValidatePost(ps, filepath.Join(dir, "new"), test.id)
+			if test.ok && (!ok || err != nil) {
+				t.Errorf("got %v, %v", ok, err)
+			} else if _, isperr := err.(*PostError); !test.ok && (ok || !isperr) {
+				t.Errorf("got %v, %v, want a *PostError", ok, err)
+			}
+		})
+	}
+}
+
+func TestServePages(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"a":    `Title = "About me"` + "\n" + `Page = "about"`,
+		"b":    `Title = "Uses"` + "\n" + `Page = "uses"`,
+		"post": `Title = "Hello"` + "\n" + `Tags = ["go"]`,
+	})
+	ps.Cfg.Pages = []string{"uses", "about"}
+	writePostText(t, ps, "a", "I write about Go.")
+	mux := testMux(t)
+	HandlePosts(ps)
+	t.Chdir("..")
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+target, nil))
+		return w
+	}
+
+	w := get("/about")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "I write about Go.") {
+		t.Errorf("got %d:\n%s", w.Code, w.Body)
+	}
+	nav := w.Body.String()[strings.Index(w.Body.String(), "<nav>"):]
+	if uses, about := strings.Index(nav, `href="http://localhost/uses"`), strings.Index(nav, `href="http://localhost/about"`); uses == -1 || about == -1 || uses > about {
+		t.Errorf("nav isn't in the configured order:\n%s", nav)
+	}
+
+	if w := get("/post/a"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "http://localhost/about" {
+		t.Errorf("post of a page got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := get("/nope"); w.Code != http.StatusNotFound {
+		t.Errorf("page that doesn't exist got %d", w.Code)
+	}
+	if home := get("/").Body.String(); strings.Contains(home, "I write about Go.") || !strings.Contains(home, "Hello") {
+		t.Errorf("home page is:\n%s", home)
+	}
+}
+
+func TestPageHidden(t *testing.T) {
+	mux := testMux(t)
+	mux.HandleFunc("GET /{page}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /home", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /{page}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /feed.xml", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("POST /webmention", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("DELETE /admin/delete/{postid}", func(w http.ResponseWriter, r *http.Request) {})
+
+	for slug, want := range map[string]bool{
+		"about":      false,
+		"home":       true,
+		"feed.xml":   true,
+		"webmention": true,
+		"admin":      false,
+	} {
+		if got := pageHidden(slug); got != want {
+			t.Errorf("%s hidden = %v, want %v", slug, got, want)
+		}
+	}
+}
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"html/template"
 	"image"
 	_ "image/gif"
 	_ "image/png"
 	"io"
-	"io/fs"
 	"log"
 	"net/http"
 	"net/url"
@@ -35,9 +32,11 @@ type PostID string
 
 // Post metadata
 type PostInfo struct {
-	Title string
-	Date  time.Time
-	Tags  []string
+	Title   string
+	Date    time.Time
+	Updated time.Time `toml:",omitempty"` // Optional, falls back to Date
+	Tags    []string
+	Page    string `toml:",omitempty"` // Optional, serves the post at /{Page} instead of in the feed
 }
 
 // Actual post data
@@ -46,97 +45,27 @@ type Post struct {
 	Id          PostID
 	Document    template.HTML
 	Attachments map[string]struct{}
+	Images      []string // URLs of images in the order they appear
+	Links       []string // External links to other sites
+	Summary     string   // Text of the first paragraph
+	Text        string   // Readable text of the whole post, used for searching
 }
 
-type TagDB map[string]TagID
-
 type PostStats struct {
-	Posts  map[PostID]PostInfo
-	ByDate []PostID
-	ByTag  map[string][]PostID
-	TagDB  TagDB
-	Cfg    *BlogConfig
-	Lock   sync.RWMutex // Mutex for thread safe access
-}
-
-func LoadTagDB(dir string) (TagDB, error) {
-	var db TagDB
-
-	// See if the database exists, if so open it
-	if data, err := os.ReadFile(filepath.Join(dir, "tags.toml")); err != nil &&
-		!os.IsNotExist(err) {
-		// Some error in opening the file, it does exist it seems
-		log.Println(err)
-		return nil, err
-	} else if os.IsNotExist(err) {
-		db = make(map[string]TagID)
-	} else if err := toml.Unmarshal(data, &db); err == nil {
-		return db, nil
-	}
-
-	// Okay so either the database is corrupted or there is no tagdb so lets just create one
-	var entries []os.DirEntry
-	var err error
-	if entries, err = os.ReadDir(dir); err != nil {
-		log.Println(err)
-		return nil, err
-	}
-
-	for _, ent := range entries {
-		// Get the post info, and then register the tag
-		if ent.Type() != fs.ModeDir {
-			continue
-		}
-		if info, err := LoadPostInfo(filepath.Join(dir, ent.Name())); err != nil {
-			log.Println(err)
-			return nil, err
-		} else {
-			for _, tag := range info.Tags {
-				db.GetTagID(tag)
-			}
-		}
-	}
-
-	if err := db.Save(dir); err != nil {
-		log.Println(err)
-		return nil, err
-	} else {
-		return db, nil
-	}
-}
-
-func (db *TagDB) GetTagID(name string) TagID {
-	if id, ok := (*db)[name]; ok {
-		return id
-	}
-
-	// Okay create a new id
-	for {
-		var buf [6]byte
-		rand.Read(buf[:])
-		newid := TagID(base64.RawURLEncoding.EncodeToString(buf[:]))
-
-		unique := true
-		for _, id := range *db {
-			if id == newid {
-				unique = false
-				break
-			}
-		}
-
-		if unique {
-			(*db)[name] = newid
-			return newid
-		}
-	}
-}
-
-func (db *TagDB) Save(dir string) error {
-	if data, err := toml.Marshal(db); err != nil {
-		return err
-	} else {
-		return os.WriteFile(filepath.Join(dir, "tags.toml"), data, 0664)
-	}
+	Posts    map[PostID]PostInfo
+	ByDate   []PostID
+	ByTag    map[string][]PostID
+	Pages    map[string]PostID // Posts served at their own address by slug
+	TagDB    TagDB
+	Mentions *WebmentionDB
+	Sent     *DeliveryDB
+	Index    *SearchIndex
+	Searches *SearchLog
+	Related  *RelatedPosts
+	Cfg      *BlogConfig
+	Lock     sync.RWMutex // Mutex for thread safe access
+
+	listeners []PostListener
 }
 
 // Formats time for everything across the site
@@ -145,54 +74,43 @@ func FormatDate(t time.Time) string {
 }
 
 // Returns an ordered list of post UUID's
-func (ps *PostStats) SearchAndRank(term string) []PostID {
-	type result struct {
-		info PostInfo
-		id   PostID
-		rank int
-	}
+// Posts are ranked by how well the words match their text, title and tags.
+// A *QueryError is returned if the search has bad syntax
+func (ps *PostStats) SearchAndRank(term string) ([]PostID, error) {
+	ids, _, err := ps.SearchAndScore(term)
+	return ids, err
+}
 
-	results := make([]result, 0)
-	ps.Lock.RLock()
-	for id, post := range ps.Posts {
-		rank := fuzzy.RankMatchNormalizedFold(term, post.Title)
-		if rank == -1 {
-			continue
-		}
-		results = append(results, result{
-			info: post,
-			id:   id,
-			rank: rank,
-		})
+// Same as SearchAndRank but also gives back how well each post scored
+func (ps *PostStats) SearchAndScore(term string) ([]PostID, map[PostID]float64, error) {
+	query, err := ParseQuery(term, ps.Index.Analyzer)
+	if err != nil {
+		return nil, nil, err
 	}
-	ps.Lock.RUnlock()
 
-	slices.SortFunc(results, func(a, b result) int {
-		if a.rank > b.rank {
-			return -1
-		} else if a.rank < b.rank {
-			return 1
-		} else {
-			if a.info.Date.After(b.info.Date) {
-				return -1
-			} else if a.info.Date.Before(b.info.Date) {
-				return 1
-			} else {
-				return 0
+	ps.Lock.RLock()
+	defer ps.Lock.RUnlock()
+	scores := ps.evaluate(query)
+
+	// Titles that only fuzzy match plain searches still show up, just further down
+	if query.Simple() {
+		for id, post := range ps.Posts {
+			if post.Page != "" {
+				continue
+			}
+			if rank := fuzzy.RankMatchNormalizedFold(term, post.Title); rank != -1 {
+				scores[id] += 1 / float64(rank+2)
 			}
 		}
-	})
-
-	posts := make([]PostID, len(results))
-	for i, res := range results {
-		posts[i] = res.id
 	}
-
-	return posts
+	return ps.rankResults(scores), scores, nil
 }
 
 // Read all directories from a post directory and create a new post stats
 func NewPostStats(cfg *BlogConfig) (*PostStats, error) {
+	if err := cleanStagingDirs(cfg.PostDir); err != nil {
+		return nil, err
+	}
 	entries, err := os.ReadDir(cfg.PostDir)
 	if err != nil {
 		return nil, err
@@ -202,37 +120,125 @@ func NewPostStats(cfg *BlogConfig) (*PostStats, error) {
 		Posts:  make(map[PostID]PostInfo, 0),
 		ByDate: make([]PostID, 0),
 		ByTag:  make(map[string][]PostID),
-		TagDB:  nil,
+		Pages:  make(map[string]PostID),
+		Index:  nil,
 		Cfg:    cfg,
 	}
 	if ps.TagDB, err = LoadTagDB(cfg.PostDir); err != nil {
 		return ps, err
 	}
+	if analyzer, err := NewAnalyzer(cfg.SearchLanguage, cfg.StopWords); err != nil {
+		return ps, err
+	} else {
+		ps.Index = NewSearchIndex(analyzer)
+	}
+	if ps.Mentions, err = LoadWebmentionDB(cfg.PostDir); err != nil {
+		return ps, err
+	}
+	if ps.Sent, err = LoadDeliveryDB(cfg.PostDir); err != nil {
+		return ps, err
+	}
+	if ps.Searches, err = LoadSearchLog(cfg.PostDir, cfg.SearchRetention); err != nil {
+		return ps, err
+	}
+
+	// Posts that haven't changed since the index was saved don't need to be parsed
+	indexpath := filepath.Join(cfg.PostDir, searchIndexFile)
+	cached, err := ps.Index.Load(indexpath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+		log.Println("Rebuilding the search index")
+	}
+
+	stale := len(cached) == 0
 	for _, entry := range entries {
-		if entry.Type() != fs.ModeDir {
+		if !isPostDir(entry) {
 			continue
 		}
-		if err := ps.Add(PostID(entry.Name())); err != nil {
+		id := PostID(entry.Name())
+		modtime, err := PostModTime(filepath.Join(cfg.PostDir, entry.Name()))
+		if err != nil {
+			return ps, err
+		}
+
+		if doc, ok := cached[id]; ok && doc.ModTime.Equal(modtime) {
+			ps.list(id, doc.Info)
+			ps.Index.put(id, doc)
+		} else if info, _, err := ps.add(id); err != nil {
 			return ps, err
+		} else if info.Page == "" {
+			stale = true
 		}
 	}
+	ps.migrateAbout()
+	ps.TagDB.prune(ps.ByTag)
+	if err := ps.TagDB.Save(cfg.PostDir); err != nil {
+		return ps, err
+	}
+
+	// Save the index if posts changed or got deleted while the server was off
+	if stale || len(cached) != len(ps.ByDate) {
+		if err := ps.Index.Save(indexpath); err != nil {
+			log.Println(err)
+		}
+	}
+	ps.Related = NewRelatedPosts(ps)
+
+	go func() {
+		for range time.Tick(searchIndexSaveFrequency) {
+			ps.SaveIndex()
+		}
+	}()
 	return ps, nil
 }
 
-// Remove a post
-// This removes the directory (if remdir is set), and the listing
-// If the post doesn't exist it will return false
-func (ps *PostStats) Remove(id PostID, remdir bool) (bool, error) {
+// Saves the search index if posts changed since it was last saved
+func (ps *PostStats) SaveIndex() {
+	if err := ps.Index.SaveChanged(filepath.Join(ps.Cfg.PostDir, searchIndexFile)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Things that can happen to a post while the server is running
+type PostEvent int
+
+const (
+	PostCreated PostEvent = iota
+	PostUpdated
+	PostDeleted
+)
+
+// Listeners get called after the lock is released, so they shouldn't block
+type PostListener func(event PostEvent, id PostID, info PostInfo)
+
+// Registers a listener for posts being added, updated or removed
+func (ps *PostStats) Listen(fn PostListener) {
 	ps.Lock.Lock()
 	defer ps.Lock.Unlock()
+	ps.listeners = append(ps.listeners, fn)
+}
 
+func (ps *PostStats) notify(event PostEvent, id PostID, info PostInfo) {
+	ps.Lock.RLock()
+	listeners := slices.Clone(ps.listeners)
+	ps.Lock.RUnlock()
+
+	for _, fn := range listeners {
+		fn(event, id, info)
+	}
+}
+
+// Removes the listing of a post, expects the lock to already be held
+func (ps *PostStats) remove(id PostID) {
 	// Remove it from the date ordering and posts map
-	if _, ok := ps.Posts[id]; !ok {
-		return false, nil
+	if page := ps.Posts[id].Page; page != "" && ps.Pages[page] == id {
+		delete(ps.Pages, page)
 	}
 	delete(ps.Posts, id)
-	i := slices.Index(ps.ByDate, id)
-	ps.ByDate = slices.Delete(ps.ByDate, i, i+1)
+	ps.Index.Remove(id)
+	if i := slices.Index(ps.ByDate, id); i != -1 {
+		ps.ByDate = slices.Delete(ps.ByDate, i, i+1)
+	}
 
 	// Remove tag refrences
 	deadtags := make([]string, 0)
@@ -246,9 +252,30 @@ func (ps *PostStats) Remove(id PostID, remdir bool) (bool, error) {
 	}
 	for _, tag := range deadtags {
 		delete(ps.ByTag, tag)
-		delete(ps.TagDB, tag)
+		ps.TagDB.retire(tag)
 	}
 	ps.TagDB.Save(ps.Cfg.PostDir)
+}
+
+// Remove a post
+// This removes the directory (if remdir is set), and the listing
+// If the post doesn't exist it will return false
+func (ps *PostStats) Remove(id PostID, remdir bool) (bool, error) {
+	ps.Lock.Lock()
+	info, ok := ps.Posts[id]
+	if ok {
+		ps.remove(id)
+	}
+	ps.Lock.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	// Pages aren't in the feed so nobody needs to hear about them
+	if info.Page == "" {
+		ps.notify(PostDeleted, id, info)
+	}
 
 	// Remove it from the posts directory
 	if !remdir {
@@ -261,19 +288,69 @@ func (ps *PostStats) Remove(id PostID, remdir bool) (bool, error) {
 }
 
 // Adds information from a uuid in the posts directory
+// If the post was already listed it's entry gets replaced
 func (ps *PostStats) Add(id PostID) error {
+	info, updated, err := ps.add(id)
+	if err != nil {
+		return err
+	}
+
+	if info.Page != "" {
+		return nil
+	} else if updated {
+		ps.notify(PostUpdated, id, info)
+	} else {
+		ps.notify(PostCreated, id, info)
+	}
+	return nil
+}
+
+// Loads a post and lists it, returning whether an older version was replaced
+func (ps *PostStats) add(id PostID) (PostInfo, bool, error) {
+	// Try to get the newly added post, the whole thing is needed for searching
+	dir := filepath.Join(ps.Cfg.PostDir, string(id))
+	post, err := LoadPost(dir)
+	if err != nil {
+		return post.Info, false, err
+	}
+	modtime, err := PostModTime(dir)
+	if err != nil {
+		return post.Info, false, err
+	}
+
 	ps.Lock.Lock()
 	defer ps.Lock.Unlock()
 
-	// Delete previous entry if its there
-	if _, ok := ps.Posts[id]; ok {
-		ps.Remove(id, false)
+	updated := ps.relist(&post, modtime)
+	ps.TagDB.Save(ps.Cfg.PostDir)
+	return post.Info, updated, nil
+}
+
+// Lists and indexes a loaded post, replacing the previous entry if its there.
+// Expects the lock to already be held
+func (ps *PostStats) relist(post *Post, modtime time.Time) bool {
+	_, updated := ps.Posts[post.Id]
+	if updated {
+		ps.remove(post.Id)
 	}
 
-	// Try to get the info of the newly added post
-	info, err := LoadPostInfo(filepath.Join(ps.Cfg.PostDir, string(id)))
-	if err != nil {
-		return err
+	ps.list(post.Id, post.Info)
+	if post.Info.Page == "" {
+		ps.Index.Add(post, modtime)
+	}
+	return updated
+}
+
+// Adds a post to the date ordering and tags, expects the lock to already be held
+func (ps *PostStats) list(id PostID, info PostInfo) {
+	// Pages stay out of the feed and tags
+	if info.Page != "" {
+		if other, ok := ps.Pages[info.Page]; ok && other != id {
+			log.Printf("Posts %s and %s are both the page /%s, only %s is shown\n", other, id, info.Page, id)
+		}
+		ps.Posts[id] = info
+		ps.Pages[info.Page] = id
+		return
 	}
 
 	// Add ordered date info
@@ -285,15 +362,21 @@ func (ps *PostStats) Add(id PostID) error {
 	}
 	ps.ByDate = slices.Insert(ps.ByDate, i, id)
 
+	// Tags are listed by the name they're known by, the post keeps its own spelling
+	tags := make([]string, 0, len(info.Tags))
+	for _, tag := range info.Tags {
+		if tag = ps.TagDB.Canonical(tag); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	info.Tags = tags
+
 	// Add the tags, hashes and normal info
 	ps.Posts[id] = info
-	for _, tag := range info.Tags {
+	for _, tag := range WithParentTags(info.Tags) {
 		ps.ByTag[tag] = append(ps.ByTag[tag], id)
 		ps.TagDB.GetTagID(tag)
 	}
-	ps.TagDB.Save(ps.Cfg.PostDir)
-
-	return nil
 }
 
 // Converts path to point to URL of the attachment and adds it to the post's attachemnt list
@@ -303,7 +386,7 @@ func convertPath(postdir string, post *Post, path string) string {
 		post.Attachments[path] = struct{}{}
 
 		// Make sure the destination points to the url of the attachment
-		path = filepath.Join("/attachments", string(post.Id), path)
+		path = attachmentPath(post.Id, path)
 	}
 
 	return path
@@ -326,10 +409,80 @@ func LoadPostInfo(dir string) (PostInfo, error) {
 		log.Println(err)
 		return info, err
 	} else {
+		for i, tag := range info.Tags {
+			info.Tags[i] = CleanTag(tag)
+		}
+		if info.Page != "" {
+			info.Page = PageSlug(info.Page)
+		}
 		return info, nil
 	}
 }
 
+// Gets the readable text out of a markdown node, without images or markup
+func plainText(node ast.Node) string {
+	var sb strings.Builder
+	ast.WalkFunc(node, func(node ast.Node, entering bool) ast.WalkStatus {
+		switch n := node.(type) {
+		case *ast.Image:
+			return ast.SkipChildren
+		case *ast.Text, *ast.Code:
+			sb.Write(n.AsLeaf().Literal)
+		case *ast.CodeBlock:
+			sb.WriteByte(' ')
+			sb.Write(n.Literal)
+			sb.WriteByte(' ')
+		case *ast.Softbreak, *ast.Hardbreak:
+			sb.WriteByte(' ')
+		case *ast.Paragraph, *ast.Heading, *ast.TableCell:
+			// Keep words in different blocks apart
+			if !entering {
+				sb.WriteByte(' ')
+			}
+		}
+		return ast.GoToNext
+	})
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// Writes a file by writing to a temporary file first and renaming it over the
+// old one, so readers never see a half written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	// Every write gets its own temporary file so writes at the same time can't
+	// mix together
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// Writes out the metadata file of a post
+func SavePostInfo(dir string, info PostInfo) error {
+	if data, err := toml.Marshal(info); err != nil {
+		return err
+	} else {
+		return WriteFileAtomic(filepath.Join(dir, "post.toml"), data, 0664)
+	}
+}
+
 // Load a post from a directory, if it can't it will return an error
 func LoadPost(dir string) (post Post, err error) {
 	// Get the UUID from the name of the dir
@@ -359,6 +512,9 @@ func LoadPost(dir string) (post Post, err error) {
 				oldpath := string(img.Destination)
 				newpath := convertPath(dir, &post, oldpath)
 				img.Destination = []byte(newpath)
+				if entering {
+					post.Images = append(post.Images, newpath)
+				}
 
 				if file, err := os.Open(filepath.Join(dir, oldpath)); err == nil {
 					pixelFormats := map[string]bool{
@@ -381,6 +537,23 @@ func LoadPost(dir string) (post Post, err error) {
 				}
 			}
 
+			// Use the first paragraph with text in it as the summary
+			if para, ok := node.(*ast.Paragraph); ok && entering && post.Summary == "" {
+				post.Summary = plainText(para)
+				if runes := []rune(post.Summary); len(runes) > 280 {
+					post.Summary = strings.TrimSpace(string(runes[:280])) + "…"
+				}
+			}
+
+			// Keep track of links to other sites
+			if link, ok := node.(*ast.Link); ok && entering {
+				dest := string(link.Destination)
+				external := strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://")
+				if external && !slices.Contains(post.Links, dest) {
+					post.Links = append(post.Links, dest)
+				}
+			}
+
 			// Put metadata in headings
 			if hdr, ok := node.(*ast.Heading); ok {
 				hdr.Attribute = &ast.Attribute{
@@ -397,6 +570,8 @@ func LoadPost(dir string) (post Post, err error) {
 		})
 	}
 
+	post.Text = plainText(md)
+
 	// Render out the HTML
 	r := html.NewRenderer(html.RendererOptions{
 		Flags: html.CommonFlags | html.HrefTargetBlank,
@@ -447,35 +622,38 @@ func HandlePosts(ps *PostStats) {
 		Post
 		Expand     bool
 		ShowButton bool
+		Snippets   []template.HTML // Where a search matched the post
+		Searched   string          // Search that found the post, to know when results get opened
 	}
 
 	// Called with empty search term on the page
 	defaultposts := func(r *http.Request, loadfrom, maxposts int) ([]ServedPost, error) {
 		switch r.URL.Path {
-		case "/about":
-			if abouts, ok := ps.ByTag["About"]; !ok && len(abouts) == 0 {
-				return nil, fmt.Errorf("About page not found!")
-			} else if post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(abouts[0]))); err != nil {
-				return nil, fmt.Errorf("About page not found!")
-			} else if loadfrom > 0 {
-				return []ServedPost{}, nil
-			} else {
-				return []ServedPost{ServedPost{Post: post, Expand: true}}, nil
-			}
-
 		case "/home", "/":
+			ps.Lock.RLock()
+			ids := slices.Clone(ps.ByDate[min(loadfrom, len(ps.ByDate)):min(loadfrom+maxposts, len(ps.ByDate))])
+			ps.Lock.RUnlock()
+
+			// Only the posts on this page need to be parsed
 			posts := make([]ServedPost, 0)
-			for _, id := range ps.ByDate {
+			for _, id := range ids {
 				if post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id))); err != nil {
 					return nil, err
 				} else {
 					posts = append(posts, ServedPost{Post: post, Expand: true, ShowButton: true})
 				}
 			}
-			return posts[min(loadfrom, len(posts)):min(loadfrom+maxposts, len(posts))], nil
+			return posts, nil
 
 		default:
-			if post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, r.PathValue("postid"))); err != nil {
+			id := PostID(r.PathValue("postid"))
+			if slug := r.PathValue("page"); slug != "" {
+				var ok bool
+				if id, ok = ps.Page(slug); !ok {
+					return nil, fmt.Errorf("Page %s not found", slug)
+				}
+			}
+			if post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id))); err != nil {
 				return nil, err
 			} else if loadfrom > 0 {
 				return []ServedPost{}, nil
@@ -486,26 +664,37 @@ func HandlePosts(ps *PostStats) {
 	}
 
 	// Called when the search term on the page is not empty
-	// Search through all posts and fuzzy search the title and rank them
-	searchposts := func(term string, loadfrom, maxposts int) ([]ServedPost, error) {
+	// Search through all posts and rank them, only loading the ones on this page.
+	// Only searches someone finished typing get recorded
+	searchposts := func(term string, loadfrom, maxposts int, record bool) ([]ServedPost, error) {
+		ids, err := ps.SearchAndRank(term)
+		if loadfrom == 0 && record {
+			ps.Searches.Record(term, len(ids))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		terms := ps.HighlightTerms(term)
 		posts := make([]ServedPost, 0)
-		for _, id := range ps.SearchAndRank(term) {
+		for _, id := range ids[min(loadfrom, len(ids)):min(loadfrom+maxposts, len(ids))] {
 			if post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id))); err != nil {
 				return nil, err
 			} else {
-				posts = append(posts, ServedPost{Post: post, Expand: false, ShowButton: true})
+				posts = append(posts, ServedPost{
+					Post:       post,
+					Expand:     false,
+					ShowButton: true,
+					Snippets:   terms.Snippets(post.Text, 2),
+					Searched:   NormalizeSearch(term),
+				})
 			}
 		}
-		return posts[min(loadfrom, len(posts)):min(loadfrom+maxposts, len(posts))], nil
+		return posts, nil
 	}
 
 	handler := func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.New("base").Funcs(map[string]any{
-			"formatTime": FormatDate,
-			"getID": func(name string) string {
-				return string(ps.TagDB.GetTagID(name))
-			},
-		}).ParseFiles("views/base.html", "views/nav.html", "views/posts.html", "views/post.html")
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/base.html", "views/nav.html", "views/posts.html", "views/post.html")
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -520,6 +709,31 @@ func HandlePosts(ps *PostStats) {
 			return
 		}
 
+		// Someone opened a post from the search results
+		if id := r.PathValue("postid"); id != "" && r.Form.Has("searched") && !r.Form.Has("Search") {
+			ps.Searches.Click(r.Form.Get("searched"), PostID(id))
+		}
+
+		// Addresses that aren't anything are common, bots look for things like
+		// /wp-login.php all the time, so they aren't worth logging
+		if slug := r.PathValue("page"); slug != "" {
+			if _, ok := ps.Page(slug); !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		// Pages live at their own address
+		if id := r.PathValue("postid"); id != "" && !r.Form.Has("Expand") && !r.Form.Has("Close") {
+			ps.Lock.RLock()
+			page := ps.Posts[PostID(id)].Page
+			ps.Lock.RUnlock()
+			if page != "" {
+				http.Redirect(w, r, ps.Links(r).Page(page), http.StatusMovedPermanently)
+				return
+			}
+		}
+
 		// Shortcut to only load a single post from htmx expand/close thing
 		if r.Form.Has("Expand") || r.Form.Has("Close") {
 			var post ServedPost
@@ -551,16 +765,36 @@ func HandlePosts(ps *PostStats) {
 		// Try to do the posts search first
 		var posts []ServedPost
 		term := ""
+		searcherr := ""
 		if r.Form.Has("Search") {
 			term = strings.TrimSpace(r.Form.Get("Search"))
 
+			// The search box searches while typing, only pressing enter or
+			// coming from outside of htmx means the search is done
+			htmx := r.Header.Get("HX-Request") == "true"
 			if term != "" {
-				posts, err = searchposts(term, loadfrom, maxposts)
+				posts, err = searchposts(term, loadfrom, maxposts, !htmx || r.Form.Get("Submitted") == "true")
 			} else {
 				posts, err = nil, nil
 			}
 
-			if loadfrom == 0 && posts != nil && len(posts) == 0 {
+			// Let people know what was wrong with their search
+			if qerr, ok := err.(*QueryError); ok {
+				searcherr = qerr.Error()
+				posts = []ServedPost{}
+			} else if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			// Searches coming from outside of htmx (like the SearchAction) get the full page
+			if loadfrom == 0 && !htmx {
+				exec = "base"
+			} else if loadfrom == 0 && searcherr != "" {
+				fmt.Fprintf(w, "<h3 class=\"search-error\"><em>%s</em></h3>", template.HTMLEscapeString(searcherr))
+				return
+			} else if loadfrom == 0 && posts != nil && len(posts) == 0 {
 				fmt.Fprint(w, "<h3><em>No posts found...</em></h3>")
 				return
 			}
@@ -584,6 +818,30 @@ func HandlePosts(ps *PostStats) {
 			return
 		}
 
+		// Structured data for search engines and oEmbed discovery, only needed on full page loads
+		var jsonld any
+		posturl := ""
+		if exec == "base" {
+			switch r.URL.Path {
+			case "/home", "/":
+				jsonld = BlogJSONLD(ps.Cfg, ps.Links(r))
+			default:
+				// Searching from a post shows other posts, the data is still about the one in the address
+				if id := PostID(r.PathValue("postid")); id != "" {
+					var post *Post
+					if len(posts) > 0 && posts[0].Post.Id == id {
+						post = &posts[0].Post
+					} else if p, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id))); err == nil {
+						post = &p
+					}
+					if post != nil {
+						jsonld = PostJSONLD(ps.Cfg, ps.Links(r), post)
+						posturl = ps.Links(r).Post(id)
+					}
+				}
+			}
+		}
+
 		// Construct url for next access
 		nexturl := r.URL
 		nexturl.RawQuery = fmt.Sprintf("LoadFrom=%d", loadfrom+maxposts)
@@ -600,18 +858,28 @@ func HandlePosts(ps *PostStats) {
 			SearchTarget string
 			Posts        []ServedPost
 			LoadPostsURL string
+			JSONLD       any
+			PostURL      string
+			SearchError  string
 		}{
 			Title:        title,
 			SearchTarget: "main",
 			Posts:        posts,
 			LoadPostsURL: nexturl.String(),
+			JSONLD:       jsonld,
+			PostURL:      posturl,
+			SearchError:  searcherr,
 		}); err != nil {
 			log.Println(err)
 			return
 		}
 	}
 	http.HandleFunc("/post/{postid}", handler)
-	http.HandleFunc("/about", handler)
-	http.HandleFunc("/home", handler)
+	http.HandleFunc("GET /home", handler)
+	http.HandleFunc("POST /home", handler)
+
+	// Pages can be searched from too
+	http.HandleFunc("GET /{page}", handler)
+	http.HandleFunc("POST /{page}", handler)
 	http.HandleFunc("/{$}", handler)
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A search like `tag:go after:2024-01 "garbage collector" -rust OR tag:zig`
+// Groups are separated by OR, and a post has to match everything in a group
+type Query struct {
+	Groups []QueryGroup
+}
+
+type QueryGroup struct {
+	Words      []string
+	Phrases    [][]token
+	Tags       []string
+	NotWords   []string
+	NotPhrases [][]token
+	NotTags    []string
+	After      time.Time // Inclusive
+	Before     time.Time // Exclusive
+}
+
+// Bad syntax in a search, shown to the person searching
+type QueryError struct {
+	Msg string
+	Pos int // Which character the problem is at
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s (at character %d)", e.Msg, e.Pos+1)
+}
+
+// Whether the query is just words, with no operators
+func (q *Query) Simple() bool {
+	if len(q.Groups) != 1 {
+		return false
+	}
+	g := q.Groups[0]
+	return len(g.Phrases) == 0 && len(g.Tags) == 0 && len(g.NotWords) == 0 &&
+		len(g.NotPhrases) == 0 && len(g.NotTags) == 0 && g.After.IsZero() && g.Before.IsZero()
+}
+
+// Whether the group doesn't ask for anything, like a search for just punctuation
+func (g *QueryGroup) Empty() bool {
+	return len(g.Words) == 0 && len(g.Phrases) == 0 && len(g.Tags) == 0 && len(g.NotWords) == 0 &&
+		len(g.NotPhrases) == 0 && len(g.NotTags) == 0 && g.After.IsZero() && g.Before.IsZero()
+}
+
+// Reads a date like 2024, 2024-03 or 2024-03-15 as the start of that period
+func parseQueryDate(s string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+type queryParser struct {
+	src []rune
+	pos int
+}
+
+func (p *queryParser) errorf(pos int, format string, args ...any) error {
+	return &QueryError{Msg: fmt.Sprintf(format, args...), Pos: pos}
+}
+
+// Reads either a quoted string or everything up to the next space
+func (p *queryParser) value() (string, bool, error) {
+	start := p.pos
+	if p.pos < len(p.src) && p.src[p.pos] == '"' {
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			end++
+		}
+		if end == len(p.src) {
+			return "", true, p.errorf(start, "Missing a closing quote")
+		}
+		p.pos = end + 1
+		return string(p.src[start+1 : end]), true, nil
+	}
+
+	for p.pos < len(p.src) && !unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos]), false, nil
+}
+
+// Words and phrases go through the analyzer so that they match the index
+func ParseQuery(s string, analyzer *Analyzer) (*Query, error) {
+	p := &queryParser{src: []rune(s)}
+	query := &Query{Groups: []QueryGroup{{}}}
+	group := &query.Groups[0]
+	empty := true // Whether the current group has anything in it yet
+
+	for {
+		for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+			p.pos++
+		}
+		if p.pos == len(p.src) {
+			break
+		}
+		start := p.pos
+
+		negate := false
+		if p.src[p.pos] == '-' {
+			negate = true
+			p.pos++
+			if p.pos == len(p.src) || unicode.IsSpace(p.src[p.pos]) {
+				return nil, p.errorf(start, "Nothing to exclude after -")
+			}
+		}
+
+		// Operators look like name:value, anything else with a colon in it
+		// like 10:30 or a url is just searched for
+		op := ""
+		if p.src[p.pos] != '"' {
+			for end := p.pos; end < len(p.src) && !unicode.IsSpace(p.src[end]); end++ {
+				if p.src[end] == ':' {
+					switch name := strings.ToLower(string(p.src[p.pos:end])); name {
+					case "tag", "before", "after":
+						op = name
+						p.pos = end + 1
+					}
+					break
+				}
+			}
+		}
+
+		val, quoted, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "":
+			if val == "OR" && !quoted && !negate {
+				if empty {
+					return nil, p.errorf(start, "OR needs something on both sides of it")
+				}
+				query.Groups = append(query.Groups, QueryGroup{})
+				group = &query.Groups[len(query.Groups)-1]
+				empty = true
+				continue
+			}
+
+			// Words with punctuation in them like foo-bar are searched as a phrase
+			tokens := analyzer.Tokens(val)
+			if len(tokens) == 0 {
+				continue
+			} else if quoted || len(tokens) > 1 {
+				if negate {
+					group.NotPhrases = append(group.NotPhrases, tokens)
+				} else {
+					group.Phrases = append(group.Phrases, tokens)
+				}
+			} else if negate {
+				group.NotWords = append(group.NotWords, tokens[0].Term)
+			} else {
+				group.Words = append(group.Words, tokens[0].Term)
+			}
+		case "tag":
+			if val == "" {
+				return nil, p.errorf(start, "tag: needs the name of a tag, like tag:go")
+			}
+			if negate {
+				group.NotTags = append(group.NotTags, val)
+			} else {
+				group.Tags = append(group.Tags, val)
+			}
+		case "before", "after":
+			if negate {
+				return nil, p.errorf(start, "%s: can't be excluded, try using %s: instead", op, map[string]string{"before": "after", "after": "before"}[op])
+			}
+			date, ok := parseQueryDate(val)
+			if !ok {
+				return nil, p.errorf(start, "%s: needs a date like 2024, 2024-03 or 2024-03-15", op)
+			}
+			if op == "before" {
+				group.Before = date
+			} else {
+				group.After = date
+			}
+		}
+		empty = false
+	}
+
+	if empty && len(query.Groups) > 1 {
+		return nil, p.errorf(len(p.src), "OR needs something on both sides of it")
+	}
+	return query, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	analyzer, err := NewAnalyzer("english", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := func(word string) string {
+		term, ok := analyzer.Term(word)
+		if !ok {
+			t.Fatalf("%s is a stop word", word)
+		}
+		return term
+	}
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		query string
+		want  []QueryGroup
+	}{
+		{"", []QueryGroup{{}}},
+		{"!!!", []QueryGroup{{}}},
+		{"garbage collectors", []QueryGroup{{Words: []string{term("garbage"), term("collectors")}}}},
+		{"the Go", []QueryGroup{{Words: []string{"go"}}}},
+		{"Café", []QueryGroup{{Words: []string{"cafe"}}}},
+		{`"garbage collector"`, []QueryGroup{{Phrases: [][]token{{{term("garbage"), 0}, {term("collector"), 1}}}}}},
+		{`"the garbage"`, []QueryGroup{{Phrases: [][]token{{{term("garbage"), 1}}}}}},
+		{"foo-bar", []QueryGroup{{Phrases: [][]token{{{"foo", 0}, {"bar", 1}}}}}},
+		{"-rust", []QueryGroup{{NotWords: []string{"rust"}}}},
+		{`-"memory leak"`, []QueryGroup{{NotPhrases: [][]token{{{term("memory"), 0}, {term("leak"), 1}}}}}},
+		{"tag:go -tag:rust", []QueryGroup{{Tags: []string{"go"}, NotTags: []string{"rust"}}}},
+		{`TAG:"Go Generics"`, []QueryGroup{{Tags: []string{"Go Generics"}}}},
+		{"after:2024-03 before:2025", []QueryGroup{{After: date("2024-03-01"), Before: date("2025-01-01")}}},
+		{"after:2024-03-15", []QueryGroup{{After: date("2024-03-15")}}},
+		{"10:30", []QueryGroup{{Phrases: [][]token{{{"10", 0}, {"30", 1}}}}}},
+		{"color:red", []QueryGroup{{Phrases: [][]token{{{"color", 0}, {"red", 1}}}}}},
+		{"-https://go.dev", []QueryGroup{{NotPhrases: [][]token{{{"https", 0}, {"go", 1}, {"dev", 2}}}}}},
+		{"go OR rust", []QueryGroup{{Words: []string{"go"}}, {Words: []string{"rust"}}}},
+		{"go or rust", []QueryGroup{{Words: []string{"go", "rust"}}}},
+		{`go "OR" rust`, []QueryGroup{{Words: []string{"go", "rust"}}}},
+		{
+			`tag:go after:2024 "garbage collector" -rust OR tag:zig`,
+			[]QueryGroup{
+				{
+					Phrases:  [][]token{{{term("garbage"), 0}, {term("collector"), 1}}},
+					Tags:     []string{"go"},
+					NotWords: []string{"rust"},
+					After:    date("2024-01-01"),
+				},
+				{Tags: []string{"zig"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := ParseQuery(test.query, analyzer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(query.Groups, test.want) {
+				t.Errorf("got %+v, want %+v", query.Groups, test.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	analyzer, err := NewAnalyzer("english", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{`"unclosed`, 0},
+		{`go "unclosed`, 3},
+		{"go -", 3},
+		{"OR go", 0},
+		{"go OR", 5},
+		{"go OR OR rust", 6},
+		{"tag:", 0},
+		{"go -tag:", 3},
+		{"-after:2024", 0},
+		{"after:March", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			_, err := ParseQuery(test.query, analyzer)
+			qerr, ok := err.(*QueryError)
+			if !ok {
+				t.Fatalf("got %v, want a *QueryError", err)
+			}
+			if qerr.Pos != test.pos {
+				t.Errorf("error %q is at %d, want %d", qerr.Msg, qerr.Pos, test.pos)
+			}
+		})
+	}
+}
+
+func TestQuerySimple(t *testing.T) {
+	analyzer, err := NewAnalyzer("english", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		simple bool
+	}{
+		{"garbage collector", true},
+		{"go", true},
+		{`"garbage collector"`, false},
+		{"go -rust", false},
+		{"go tag:go", false},
+		{"go after:2024", false},
+		{"go OR rust", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := ParseQuery(test.query, analyzer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query.Simple() != test.simple {
+				t.Errorf("Simple() = %v, want %v", query.Simple(), test.simple)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// A job gets told which attempt it is on (starting at 1). Returning an error
+// means the job should be tried again later.
+type Job func(attempt int) error
+
+type queuedJob struct {
+	run     Job
+	attempt int
+}
+
+// Runs jobs one at a time in the background and retries the ones that fail with
+// an exponential backoff
+type RetryQueue struct {
+	name     string
+	attempts int
+	backoff  time.Duration
+	jobs     chan queuedJob
+}
+
+func NewRetryQueue(name string, attempts int, backoff time.Duration) *RetryQueue {
+	q := &RetryQueue{
+		name:     name,
+		attempts: attempts,
+		backoff:  backoff,
+		jobs:     make(chan queuedJob, 256),
+	}
+	go q.work()
+	return q
+}
+
+func (q *RetryQueue) work() {
+	for job := range q.jobs {
+		err := job.run(job.attempt)
+		if err == nil {
+			continue
+		}
+
+		log.Printf("%s: attempt %d failed: %s\n", q.name, job.attempt, err)
+		if job.attempt >= q.attempts {
+			continue
+		}
+
+		// Try again later without blocking the rest of the queue
+		delay := q.backoff << (job.attempt - 1)
+		job.attempt++
+		time.AfterFunc(delay, func() { q.jobs <- job })
+	}
+}
+
+// Queues up a job, this never blocks
+func (q *RetryQueue) Push(run Job) {
+	go func() { q.jobs <- queuedJob{run: run, attempt: 1} }()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+const (
+	relatedCount     = 5   // How many related posts to show under a post
+	relatedTagWeight = 0.4 // How much shared tags count compared to the text
+)
+
+// A post that is related to another one
+type RelatedPost struct {
+	Id   PostID
+	Info PostInfo
+}
+
+// Works out which posts are similar to each other. Results are cached until a
+// post changes, then they get worked out again the next time they're asked for
+type RelatedPosts struct {
+	ps      *PostStats
+	related map[PostID][]PostID
+	norms   map[PostID]float64 // Length of each post's TF-IDF vector
+	lock    sync.Mutex
+}
+
+func NewRelatedPosts(ps *PostStats) *RelatedPosts {
+	rp := &RelatedPosts{ps: ps, related: make(map[PostID][]PostID)}
+	ps.Listen(rp.postListener)
+	return rp
+}
+
+// Any change can make any post more or less related to the others
+func (rp *RelatedPosts) postListener(event PostEvent, id PostID, info PostInfo) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	rp.related = make(map[PostID][]PostID)
+	rp.norms = nil
+}
+
+// The posts most related to a post, best first
+func (rp *RelatedPosts) Get(id PostID) []RelatedPost {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+
+	rp.ps.Lock.RLock()
+	defer rp.ps.Lock.RUnlock()
+
+	ids, ok := rp.related[id]
+	if !ok {
+		ids = rp.compute(id)
+		rp.related[id] = ids
+	}
+
+	posts := make([]RelatedPost, 0, len(ids))
+	for _, other := range ids {
+		if info, ok := rp.ps.Posts[other]; ok && info.Page == "" {
+			posts = append(posts, RelatedPost{Id: other, Info: info})
+		}
+	}
+	return posts
+}
+
+// Weight of a term in a post, expects the index lock to already be held
+func tfidf(idx *SearchIndex, term string, tf int) float64 {
+	df := max(idx.DocFreq[term], 1)
+	return (1 + math.Log(float64(tf))) * math.Log(1+float64(len(idx.Docs))/float64(df))
+}
+
+// Scores every other post by the tags they share and the cosine similarity of
+// their bodies. Expects the post stats lock to already be held
+func (rp *RelatedPosts) compute(id PostID) []PostID {
+	ps, idx := rp.ps, rp.ps.Index
+	info, ok := ps.Posts[id]
+	if !ok {
+		return nil
+	}
+	scores := make(map[PostID]float64)
+
+	// Jaccard similarity of the tags, sharing a parent tag counts for something too
+	tags := WithParentTags(info.Tags)
+	shared := make(map[PostID]int)
+	for _, tag := range tags {
+		for _, other := range ps.ByTag[tag] {
+			if other != id {
+				shared[other]++
+			}
+		}
+	}
+	for other, count := range shared {
+		union := len(tags) + len(WithParentTags(ps.Posts[other].Tags)) - count
+		scores[other] += relatedTagWeight * float64(count) / float64(max(union, 1))
+	}
+
+	idx.Lock.RLock()
+	defer idx.Lock.RUnlock()
+
+	if rp.norms == nil {
+		rp.norms = make(map[PostID]float64, len(idx.Docs))
+		for other, doc := range idx.Docs {
+			sum := 0.0
+			for term, positions := range doc.Positions {
+				w := tfidf(idx, term, len(positions))
+				sum += w * w
+			}
+			rp.norms[other] = math.Sqrt(sum)
+		}
+	}
+
+	// Cosine similarity of the bodies, only posts sharing a term can score
+	doc := idx.Docs[id]
+	dots := make(map[PostID]float64)
+	for term, positions := range doc.Positions {
+		w := tfidf(idx, term, len(positions))
+		for other, theirs := range idx.Postings[term] {
+			if other != id {
+				dots[other] += w * tfidf(idx, term, len(theirs))
+			}
+		}
+	}
+	for other, dot := range dots {
+		if norm := rp.norms[id] * rp.norms[other]; norm > 0 {
+			scores[other] += (1 - relatedTagWeight) * dot / norm
+		}
+	}
+
+	related := make([]PostID, 0, len(scores))
+	for other, score := range scores {
+		if _, ok := ps.Posts[other]; ok && score > 0 {
+			related = append(related, other)
+		}
+	}
+	slices.SortFunc(related, func(a, b PostID) int {
+		if scores[a] > scores[b] {
+			return -1
+		} else if scores[a] < scores[b] {
+			return 1
+		}
+		return ps.Posts[b].Date.Compare(ps.Posts[a].Date)
+	})
+	return related[:min(relatedCount, len(related))]
+}
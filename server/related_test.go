@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func relatedIDs(rp *RelatedPosts, id PostID) []PostID {
+	ids := make([]PostID, 0)
+	for _, post := range rp.Get(id) {
+		ids = append(ids, post.Id)
+	}
+	return ids
+}
+
+func TestRelatedPosts(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc":      `Title = "Garbage collection in Go"` + "\n" + `Date = 2024-03-01T00:00:00Z` + "\n" + `Tags = ["go"]`,
+		"escape":  `Title = "Escape analysis"` + "\n" + `Date = 2024-04-01T00:00:00Z` + "\n" + `Tags = ["go", "compilers"]`,
+		"rust":    `Title = "Ownership in Rust"` + "\n" + `Date = 2024-05-01T00:00:00Z` + "\n" + `Tags = ["rust"]`,
+		"paris":   `Title = "A trip to Paris"` + "\n" + `Date = 2023-07-01T00:00:00Z` + "\n" + `Tags = ["travel"]`,
+		"goroute": `Title = "Goroutines"` + "\n" + `Date = 2023-01-01T00:00:00Z` + "\n" + `Tags = ["go", "concurrency"]`,
+	})
+	writePostText(t, ps, "gc", "The garbage collector frees memory on the heap that is no longer used.")
+	writePostText(t, ps, "escape", "Escape analysis decides what goes on the heap for the garbage collector.")
+	writePostText(t, ps, "rust", "Rust has no garbage collector, memory is freed by ownership instead.")
+	writePostText(t, ps, "paris", "We sat in a café by the river.")
+	writePostText(t, ps, "goroute", "Channels pass values between goroutines.")
+	rp := NewRelatedPosts(ps)
+
+	// Sharing a tag and words beats just one of them, posts with neither are left out
+	got := relatedIDs(rp, "gc")
+	if len(got) != 3 || got[0] != "escape" || !slices.Contains(got, "rust") || !slices.Contains(got, "goroute") {
+		t.Errorf("related to gc are %v, want escape first then rust and goroute", got)
+	}
+	if got := relatedIDs(rp, "paris"); len(got) != 0 {
+		t.Errorf("related to paris are %v, want none", got)
+	}
+	if got := relatedIDs(rp, "missing"); len(got) != 0 {
+		t.Errorf("related to a post that doesn't exist are %v", got)
+	}
+
+	// Changing a post makes everything get worked out again
+	writePostText(t, ps, "paris", "The garbage collector of Paris frees the river of memory on the heap.")
+	if got := relatedIDs(rp, "gc"); !slices.Contains(got, "paris") {
+		t.Errorf("related to gc are %v after paris changed", got)
+	}
+	if _, err := ps.Remove("escape", true); err != nil {
+		t.Fatal(err)
+	}
+	if got := relatedIDs(rp, "gc"); slices.Contains(got, "escape") {
+		t.Errorf("related to gc are %v after escape was removed", got)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BM25 tuning, see https://en.wikipedia.org/wiki/Okapi_BM25
+const (
+	bm25K1     = 1.2
+	bm25B      = 0.75
+	titleBoost = 3.0
+	tagBoost   = 2.0
+)
+
+// What the index knows about a single post
+type indexedDoc struct {
+	Info      PostInfo
+	ModTime   time.Time        // When the post's files last changed
+	Length    int              // Number of terms in the body
+	Title     []string         // Terms in the title
+	Tags      []string         // Terms in the tag names
+	Positions map[string][]int // Where each term shows up in the body
+}
+
+// Inverted index over the text of every post
+type SearchIndex struct {
+	Postings map[string]map[PostID][]int // Term to the positions it appears at in each post's body
+	Docs     map[PostID]indexedDoc
+	DocFreq  map[string]int // Number of posts a term appears in, in any field
+	TotalLen int
+	Analyzer *Analyzer
+	Lock     sync.RWMutex
+
+	changed atomic.Bool // Whether posts changed since the index was saved
+	saving  sync.Mutex
+}
+
+func NewSearchIndex(analyzer *Analyzer) *SearchIndex {
+	return &SearchIndex{
+		Postings: make(map[string]map[PostID][]int),
+		Docs:     make(map[PostID]indexedDoc),
+		DocFreq:  make(map[string]int),
+		Analyzer: analyzer,
+	}
+}
+
+// Indexes a post, replacing it if it was already indexed. The time is when the
+// post's files were last changed
+func (idx *SearchIndex) Add(post *Post, modtime time.Time) {
+	body := idx.Analyzer.Tokens(post.Text)
+	doc := indexedDoc{
+		Info:      post.Info,
+		ModTime:   modtime,
+		Length:    len(body),
+		Title:     idx.Analyzer.Terms(post.Info.Title),
+		Tags:      idx.Analyzer.Terms(strings.Join(post.Info.Tags, " ")),
+		Positions: make(map[string][]int),
+	}
+	for _, t := range body {
+		doc.Positions[t.Term] = append(doc.Positions[t.Term], t.Pos)
+	}
+
+	idx.Lock.Lock()
+	defer idx.Lock.Unlock()
+	idx.put(post.Id, doc)
+	idx.changed.Store(true)
+}
+
+// Indexes an already analyzed post, expects the lock to already be held
+func (idx *SearchIndex) put(id PostID, doc indexedDoc) {
+	idx.remove(id)
+	idx.Docs[id] = doc
+	idx.TotalLen += doc.Length
+
+	seen := make(map[string]struct{})
+	for term, positions := range doc.Positions {
+		if idx.Postings[term] == nil {
+			idx.Postings[term] = make(map[PostID][]int)
+		}
+		idx.Postings[term][id] = positions
+		seen[term] = struct{}{}
+	}
+	for _, term := range doc.Title {
+		seen[term] = struct{}{}
+	}
+	for _, term := range doc.Tags {
+		seen[term] = struct{}{}
+	}
+	for term := range seen {
+		idx.DocFreq[term]++
+	}
+}
+
+func (idx *SearchIndex) Remove(id PostID) {
+	idx.Lock.Lock()
+	defer idx.Lock.Unlock()
+	idx.remove(id)
+	idx.changed.Store(true)
+}
+
+// Removes a post from the index, expects the lock to already be held
+func (idx *SearchIndex) remove(id PostID) {
+	doc, ok := idx.Docs[id]
+	if !ok {
+		return
+	}
+
+	seen := make(map[string]struct{})
+	for term := range doc.Positions {
+		delete(idx.Postings[term], id)
+		if len(idx.Postings[term]) == 0 {
+			delete(idx.Postings, term)
+		}
+		seen[term] = struct{}{}
+	}
+	for _, term := range doc.Title {
+		seen[term] = struct{}{}
+	}
+	for _, term := range doc.Tags {
+		seen[term] = struct{}{}
+	}
+	for term := range seen {
+		if idx.DocFreq[term]--; idx.DocFreq[term] <= 0 {
+			delete(idx.DocFreq, term)
+		}
+	}
+
+	idx.TotalLen -= doc.Length
+	delete(idx.Docs, id)
+}
+
+// Terms in the index that a query term should match. Words that aren't in the
+// index are treated as a prefix so that results show up while typing
+func (idx *SearchIndex) expand(term string) []string {
+	if _, ok := idx.DocFreq[term]; ok {
+		return []string{term}
+	}
+	terms := make([]string, 0)
+	for t := range idx.DocFreq {
+		if strings.HasPrefix(t, term) {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// Whether a post has any of the terms a query term expands to, in any field.
+// Expects the lock to already be held
+func (idx *SearchIndex) matches(id PostID, terms []string) bool {
+	doc := idx.Docs[id]
+	for _, term := range terms {
+		if _, ok := idx.Postings[term][id]; ok || slices.Contains(doc.Title, term) || slices.Contains(doc.Tags, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the words show up one after another in the body or title of a post.
+// Expects the lock to already be held
+func (idx *SearchIndex) hasPhrase(id PostID, phrase []token) bool {
+	for _, start := range idx.Postings[phrase[0].Term][id] {
+		found := true
+		for _, t := range phrase[1:] {
+			if !slices.Contains(idx.Postings[t.Term][id], start+t.Pos-phrase[0].Pos) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+
+	// Titles don't keep track of where stop words were
+	title := idx.Docs[id].Title
+	terms := make([]string, len(phrase))
+	for i, t := range phrase {
+		terms[i] = t.Term
+	}
+	for i := range title {
+		if len(title)-i >= len(terms) && slices.Equal(title[i:i+len(terms)], terms) {
+			return true
+		}
+	}
+	return false
+}
+
+// BM25 score of a post for some terms, with boosts for the title and tags.
+// Expects the lock to already be held
+func (idx *SearchIndex) score(id PostID, terms []string) float64 {
+	n := float64(len(idx.Docs))
+	avglen := max(float64(idx.TotalLen)/n, 1)
+	doc := idx.Docs[id]
+
+	score := 0.0
+	for _, term := range terms {
+		df := float64(idx.DocFreq[term])
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		if tf := float64(len(idx.Postings[term][id])); tf > 0 {
+			norm := 1 - bm25B + bm25B*float64(doc.Length)/avglen
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+		if slices.Contains(doc.Title, term) {
+			score += titleBoost * idf
+		}
+		if slices.Contains(doc.Tags, term) {
+			score += tagBoost * idf
+		}
+	}
+	return score
+}
+
+// Whether a post has a tag or one nested under it, ignoring case
+func hasTag(info PostInfo, tag string) bool {
+	return slices.ContainsFunc(info.Tags, func(t string) bool { return IsTagUnder(t, tag) })
+}
+
+// Finds every post that matches the query and scores it. Plain words only
+// need one of them to match, posts with more of them just score higher. Once
+// there are operators every word has to match. Expects the post stats lock to
+// already be held
+func (ps *PostStats) evaluate(query *Query) map[PostID]float64 {
+	idx := ps.Index
+	idx.Lock.RLock()
+	defer idx.Lock.RUnlock()
+	simple := query.Simple()
+
+	scores := make(map[PostID]float64)
+	for _, group := range query.Groups {
+		if group.Empty() {
+			continue
+		}
+		words := make([][]string, len(group.Words))
+		for i, word := range group.Words {
+			words[i] = idx.expand(word)
+		}
+		notwords := make([][]string, len(group.NotWords))
+		for i, word := range group.NotWords {
+			notwords[i] = []string{word}
+		}
+
+		// Tags can be searched for by any of their names
+		tags := make([]string, len(group.Tags))
+		for i, tag := range group.Tags {
+			tags[i] = ps.TagDB.Canonical(tag)
+		}
+		nottags := make([]string, len(group.NotTags))
+		for i, tag := range group.NotTags {
+			nottags[i] = ps.TagDB.Canonical(tag)
+		}
+
+		// Narrow things down with the tags first
+		candidates := ps.ByDate
+		if len(tags) > 0 {
+			candidates = make([]PostID, 0)
+			for tag, ids := range ps.ByTag {
+				if strings.EqualFold(tag, tags[0]) {
+					candidates = append(candidates, ids...)
+				}
+			}
+		}
+
+	posts:
+		for _, id := range candidates {
+			info := ps.Posts[id]
+			if !group.After.IsZero() && info.Date.Before(group.After) {
+				continue
+			}
+			if !group.Before.IsZero() && !info.Date.Before(group.Before) {
+				continue
+			}
+			for _, tag := range tags {
+				if !hasTag(info, tag) {
+					continue posts
+				}
+			}
+			for _, tag := range nottags {
+				if hasTag(info, tag) {
+					continue posts
+				}
+			}
+			matched := 0
+			for _, terms := range words {
+				if idx.matches(id, terms) {
+					matched++
+				} else if !simple {
+					continue posts
+				}
+			}
+			if len(words) > 0 && matched == 0 {
+				continue posts
+			}
+			for _, terms := range notwords {
+				if idx.matches(id, terms) {
+					continue posts
+				}
+			}
+			for _, phrase := range group.Phrases {
+				if !idx.hasPhrase(id, phrase) {
+					continue posts
+				}
+			}
+			for _, phrase := range group.NotPhrases {
+				if idx.hasPhrase(id, phrase) {
+					continue posts
+				}
+			}
+
+			score := 0.0
+			for _, terms := range words {
+				score += idx.score(id, terms)
+			}
+			for _, phrase := range group.Phrases {
+				for _, t := range phrase {
+					score += idx.score(id, []string{t.Term})
+				}
+			}
+			scores[id] = max(scores[id], score)
+		}
+	}
+	return scores
+}
+
+// Sorts search results by score, newest first for ties. Expects the lock to
+// already be held
+func (ps *PostStats) rankResults(scores map[PostID]float64) []PostID {
+	posts := make([]PostID, 0, len(scores))
+	for id := range scores {
+		if _, ok := ps.Posts[id]; ok {
+			posts = append(posts, id)
+		}
+	}
+	slices.SortFunc(posts, func(a, b PostID) int {
+		if scores[a] > scores[b] {
+			return -1
+		} else if scores[a] < scores[b] {
+			return 1
+		}
+		return ps.Posts[b].Date.Compare(ps.Posts[a].Date)
+	})
+	return posts
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Lists and indexes some posts without anything on disk
+func testSearchStats(t *testing.T, posts ...Post) *PostStats {
+	t.Helper()
+	analyzer, err := NewAnalyzer("english", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := &PostStats{
+		Posts:  make(map[PostID]PostInfo),
+		ByDate: make([]PostID, 0),
+		ByTag:  make(map[string][]PostID),
+		TagDB:  TagDB{Tags: make(map[string]TagID), Redirects: make(map[TagID]TagID)},
+		Index:  NewSearchIndex(analyzer),
+		Cfg:    &BlogConfig{PostDir: t.TempDir()},
+	}
+	for i := range posts {
+		ps.list(posts[i].Id, posts[i].Info)
+		ps.Index.Add(&posts[i], time.Now())
+	}
+	return ps
+}
+
+func testPost(id PostID, title, date, text string, tags ...string) Post {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		panic(err)
+	}
+	return Post{Id: id, Info: PostInfo{Title: title, Date: d, Tags: tags}, Text: text}
+}
+
+var searchTestPosts = []Post{
+	testPost("gc", "Garbage collection in Go", "2024-03-01",
+		"The garbage collector frees memory that is no longer used.", "go"),
+	testPost("rust", "Ownership in Rust", "2024-05-01",
+		"Rust has no garbage collector, memory is freed by ownership instead.", "rust"),
+	testPost("paris", "A trip to Paris", "2023-07-01",
+		"We sat in a café and talked about how bad our memory is.", "travel"),
+}
+
+func TestSearchIndex(t *testing.T) {
+	analyzer, err := NewAnalyzer("english", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := NewSearchIndex(analyzer)
+	posts := slices.Clone(searchTestPosts)
+	for i := range posts {
+		idx.Add(&posts[i], time.Now())
+	}
+
+	if got := idx.DocFreq["garbag"]; got != 2 {
+		t.Errorf("garbage is in %d posts, want 2", got)
+	}
+	// Words only in the title or tags count too
+	if got := idx.DocFreq["travel"]; got != 1 {
+		t.Errorf("travel is in %d posts, want 1", got)
+	}
+	// Stop words still count towards the position
+	if got := idx.Postings["memori"]["rust"]; !slices.Equal(got, []int{5}) {
+		t.Errorf("memory is at %v in rust, want [5]", got)
+	}
+
+	// Adding a post again replaces it
+	posts[0].Text = "Nothing about memory"
+	idx.Add(&posts[0], time.Now())
+	if _, ok := idx.Postings["collector"]["gc"]; ok {
+		t.Error("old text of gc is still indexed")
+	}
+	if got := idx.DocFreq["memori"]; got != 3 {
+		t.Errorf("memory is in %d posts, want 3", got)
+	}
+
+	// Everything is gone after removing every post
+	for _, post := range posts {
+		idx.Remove(post.Id)
+	}
+	if len(idx.Docs) != 0 || len(idx.Postings) != 0 || len(idx.DocFreq) != 0 || idx.TotalLen != 0 {
+		t.Errorf("left over after removing everything: %+v", idx)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	ps := testSearchStats(t, searchTestPosts...)
+
+	tests := []struct {
+		query string
+		want  []PostID
+	}{
+		{"garbage", []PostID{"gc", "rust"}},
+		{"garb", []PostID{"gc", "rust"}},
+		{"café", []PostID{"paris"}},
+		{"cafe", []PostID{"paris"}},
+		{"collectors", []PostID{"gc", "rust"}},
+		{"Go", []PostID{"gc"}},
+		{"zig", []PostID{}},
+
+		// Plain words only need one of them to match
+		{"garbage ownership", []PostID{"gc", "rust"}},
+		{"ownership paris", []PostID{"paris", "rust"}},
+		{"ownership zig", []PostID{"rust"}},
+
+		// With operators every word has to match
+		{"garbage ownership after:2024", []PostID{"rust"}},
+		{"garbage paris tag:go", []PostID{}},
+		{"memory -rust", []PostID{"gc", "paris"}},
+		{"memory -tag:rust", []PostID{"gc", "paris"}},
+		{"garbage tag:go", []PostID{"gc"}},
+		{"garbage tag:GO", []PostID{"gc"}},
+		{"tag:go OR tag:travel", []PostID{"gc", "paris"}},
+		{"before:2024", []PostID{"paris"}},
+		{"memory after:2024-04", []PostID{"rust"}},
+		{"after:2024-03-01 before:2024-03-02", []PostID{"gc"}},
+		{`"garbage collector"`, []PostID{"gc", "rust"}},
+		{`"collector garbage"`, []PostID{}},
+		{`"trip to paris"`, []PostID{"paris"}},
+		{`memory -"garbage collector"`, []PostID{"paris"}},
+		{"!!!", []PostID{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := ParseQuery(test.query, ps.Index.Analyzer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := slices.Sorted(maps.Keys(ps.evaluate(query)))
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	ps := testSearchStats(t, searchTestPosts...)
+
+	tests := []struct {
+		query string
+		want  []PostID
+	}{
+		// Posts with more of the words come first
+		{"garbage ownership", []PostID{"rust", "gc"}},
+		// Titles count for more than the body
+		{"garbage", []PostID{"gc", "rust"}},
+		{"ownership", []PostID{"rust"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			got, err := ps.SearchAndRank(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchRankingTies(t *testing.T) {
+	ps := testSearchStats(t,
+		testPost("older", "Notes", "2023-01-01", "Some words about memory."),
+		testPost("newest", "Notes", "2024-01-01", "Some words about memory."),
+		testPost("newer", "Notes", "2023-06-01", "Some words about memory."),
+	)
+	if got, _ := ps.SearchAndRank("memory"); !slices.Equal(got, []PostID{"newest", "newer", "older"}) {
+		t.Errorf("got %v, want the newest first", got)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/text/cases"
+)
+
+const (
+	searchLogFile       = "searches.toml"
+	maxSearchRecords    = 50000 // Oldest records get dropped past this, even inside the retention time
+	maxSearchLength     = 200
+	searchSaveFrequency = time.Minute
+)
+
+// A search someone did. Only the day is kept and nothing about who searched
+type SearchRecord struct {
+	Query   string
+	Results int
+	Day     time.Time
+}
+
+// Someone opening a post from the results of a search
+type SearchClick struct {
+	Query string
+	Post  PostID
+	Day   time.Time
+}
+
+// Rolling log of what readers search for, anything older than the retention
+// time gets thrown out
+type SearchLog struct {
+	Searches  []SearchRecord
+	Clicks    []SearchClick
+	Lock      sync.Mutex
+	dir       string
+	retention time.Duration
+	dirty     bool
+}
+
+// Makes searches that only differ by case or spacing count as the same one
+func NormalizeSearch(term string) string {
+	term = strings.Join(strings.Fields(cases.Fold().String(term)), " ")
+	if len(term) > maxSearchLength {
+		term = strings.ToValidUTF8(term[:maxSearchLength], "")
+	}
+	return term
+}
+
+func LoadSearchLog(dir string, retention time.Duration) (*SearchLog, error) {
+	sl := &SearchLog{dir: dir, retention: retention}
+	if data, err := os.ReadFile(filepath.Join(dir, searchLogFile)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := toml.Unmarshal(data, sl); err != nil {
+			// Losing some statistics isn't worth refusing to start over
+			log.Println(err)
+			sl.Searches, sl.Clicks = nil, nil
+		}
+	}
+	sl.prune()
+	return sl, nil
+}
+
+// Drops records that are too old or past the limit, expects the lock to already be held
+func (sl *SearchLog) prune() {
+	cutoff := time.Now().Add(-sl.retention)
+
+	// Records get appended as they happen, so the old ones are at the front
+	drop := func(n, limit int, old func(i int) bool) int {
+		i := 0
+		for i < n && old(i) {
+			i++
+		}
+		return max(i, n-limit)
+	}
+	if i := drop(len(sl.Searches), maxSearchRecords, func(i int) bool { return sl.Searches[i].Day.Before(cutoff) }); i > 0 {
+		sl.Searches = slices.Delete(sl.Searches, 0, i)
+		sl.dirty = true
+	}
+	if i := drop(len(sl.Clicks), maxSearchRecords, func(i int) bool { return sl.Clicks[i].Day.Before(cutoff) }); i > 0 {
+		sl.Clicks = slices.Delete(sl.Clicks, 0, i)
+		sl.dirty = true
+	}
+}
+
+func today() time.Time {
+	return time.Now().UTC().Truncate(24 * time.Hour)
+}
+
+// Records a search and how many posts it found
+func (sl *SearchLog) Record(term string, results int) {
+	if term = NormalizeSearch(term); term == "" {
+		return
+	}
+	sl.Lock.Lock()
+	defer sl.Lock.Unlock()
+	sl.Searches = append(sl.Searches, SearchRecord{Query: term, Results: results, Day: today()})
+	sl.dirty = true
+}
+
+// Records someone opening a post they found by searching. Each result only
+// counts once per search, so expanding a result and then opening it is one click.
+// Searches that got clicked without pressing enter didn't get recorded, the
+// click means they were done so they get recorded here
+func (sl *SearchLog) Click(term string, id PostID) {
+	if term = NormalizeSearch(term); term == "" {
+		return
+	}
+	sl.Lock.Lock()
+	defer sl.Lock.Unlock()
+
+	searches, clicks := 0, 0
+	for _, s := range sl.Searches {
+		if s.Query == term {
+			searches++
+		}
+	}
+	for _, c := range sl.Clicks {
+		if c.Query == term && c.Post == id {
+			clicks++
+		}
+	}
+	if searches == 0 {
+		// At least the post that got opened was found
+		sl.Searches = append(sl.Searches, SearchRecord{Query: term, Results: 1, Day: today()})
+	} else if clicks >= searches {
+		return
+	}
+	sl.Clicks = append(sl.Clicks, SearchClick{Query: term, Post: id, Day: today()})
+	sl.dirty = true
+}
+
+// Saves the log if anything changed, searches happen too often to save every time
+func (sl *SearchLog) Save() error {
+	sl.Lock.Lock()
+	defer sl.Lock.Unlock()
+	sl.prune()
+	if !sl.dirty {
+		return nil
+	}
+
+	data, err := toml.Marshal(struct {
+		Searches []SearchRecord
+		Clicks   []SearchClick
+	}{sl.Searches, sl.Clicks})
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(filepath.Join(sl.dir, searchLogFile), data, 0600); err != nil {
+		return err
+	}
+	sl.dirty = false
+	return nil
+}
+
+// How a single search has been doing
+type QueryStats struct {
+	Query    string
+	Searches int
+	Empty    int // Searches that found nothing
+	Clicks   int
+	LastSeen time.Time
+}
+
+// Percent of searches where someone opened a result
+func (q QueryStats) ClickRate() int {
+	if q.Searches == 0 {
+		return 0
+	}
+	return min(100, q.Clicks*100/q.Searches)
+}
+
+// How often a post got opened from searches
+type PostClicks struct {
+	ID     PostID
+	Clicks int
+}
+
+// Adds up the log into statistics for every search, optionally only the ones
+// containing some text
+func (sl *SearchLog) Stats(filter string) ([]QueryStats, []PostClicks) {
+	sl.Lock.Lock()
+	defer sl.Lock.Unlock()
+
+	filter = NormalizeSearch(filter)
+	queries := make(map[string]*QueryStats)
+	for _, s := range sl.Searches {
+		if !strings.Contains(s.Query, filter) {
+			continue
+		}
+		q, ok := queries[s.Query]
+		if !ok {
+			q = &QueryStats{Query: s.Query}
+			queries[s.Query] = q
+		}
+		q.Searches++
+		if s.Results == 0 {
+			q.Empty++
+		}
+		if s.Day.After(q.LastSeen) {
+			q.LastSeen = s.Day
+		}
+	}
+
+	posts := make(map[PostID]int)
+	for _, c := range sl.Clicks {
+		if !strings.Contains(c.Query, filter) {
+			continue
+		}
+		if q, ok := queries[c.Query]; ok {
+			q.Clicks++
+		}
+		posts[c.Post]++
+	}
+
+	stats := make([]QueryStats, 0, len(queries))
+	for _, q := range queries {
+		stats = append(stats, *q)
+	}
+	clicks := make([]PostClicks, 0, len(posts))
+	for id, n := range posts {
+		clicks = append(clicks, PostClicks{ID: id, Clicks: n})
+	}
+	slices.SortFunc(clicks, func(a, b PostClicks) int {
+		if a.Clicks != b.Clicks {
+			return b.Clicks - a.Clicks
+		}
+		return strings.Compare(string(a.ID), string(b.ID))
+	})
+	return stats, clicks
+}
+
+func HandleSearchLog(ps *PostStats, session *Session) {
+	type ClickedPost struct {
+		PostClicks
+		Title string
+	}
+
+	// Save every so often instead of on every search
+	go func() {
+		for range time.Tick(searchSaveFrequency) {
+			if err := ps.Searches.Save(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	http.HandleFunc("/admin/searches", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			http.ServeFile(w, r, "views/admin-pass.html")
+			return
+		}
+
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/admin-searches.html", "views/nav.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		stats, postclicks := ps.Searches.Stats(strings.TrimSpace(r.Form.Get("Search")))
+
+		// Most searched first
+		top := slices.Clone(stats)
+		slices.SortFunc(top, func(a, b QueryStats) int {
+			if a.Searches != b.Searches {
+				return b.Searches - a.Searches
+			}
+			return strings.Compare(a.Query, b.Query)
+		})
+
+		// Searches that keep finding nothing, most often first
+		empty := make([]QueryStats, 0)
+		for _, q := range stats {
+			if q.Empty > 0 {
+				empty = append(empty, q)
+			}
+		}
+		slices.SortFunc(empty, func(a, b QueryStats) int {
+			if a.Empty != b.Empty {
+				return b.Empty - a.Empty
+			}
+			return b.LastSeen.Compare(a.LastSeen)
+		})
+
+		clicked := make([]ClickedPost, 0)
+		ps.Lock.RLock()
+		for _, c := range postclicks {
+			if info, ok := ps.Posts[c.ID]; ok {
+				clicked = append(clicked, ClickedPost{PostClicks: c, Title: info.Title})
+			}
+		}
+		ps.Lock.RUnlock()
+
+		exec := "base"
+		if r.Form.Has("Search") {
+			exec = "stats"
+		}
+		if err := tmpl.ExecuteTemplate(w, exec, struct {
+			Title         string
+			SearchTarget  string
+			RetentionDays int
+			Top           []QueryStats
+			Empty         []QueryStats
+			Clicked       []ClickedPost
+		}{
+			Title:         "Searches",
+			SearchTarget:  "#search-stats",
+			RetentionDays: int(ps.Searches.retention / (24 * time.Hour)),
+			Top:           top[:min(50, len(top))],
+			Empty:         empty[:min(50, len(empty))],
+			Clicked:       clicked[:min(20, len(clicked))],
+		}); err != nil {
+			log.Println(err)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSearch(t *testing.T) {
+	tests := map[string]string{
+		"  Garbage   Collector ": "garbage collector",
+		"CAFÉ":                   "café",
+		"":                       "",
+		strings.Repeat("é", 150): strings.Repeat("é", 100),
+	}
+	for term, want := range tests {
+		if got := NormalizeSearch(term); got != want {
+			t.Errorf("%q normalized to %q, want %q", term, got, want)
+		}
+	}
+}
+
+func TestSearchLogStats(t *testing.T) {
+	sl, err := LoadSearchLog(t.TempDir(), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.Record("Garbage", 2)
+	sl.Record("garbage ", 2)
+	sl.Record("zig", 0)
+	sl.Record("  ", 0)
+	sl.Click("garbage", "gc")
+	sl.Click("Garbage", "rust")
+	sl.Click("zig", "gc")
+
+	stats, clicks := sl.Stats("")
+	slices.SortFunc(stats, func(a, b QueryStats) int { return strings.Compare(a.Query, b.Query) })
+	want := []QueryStats{
+		{Query: "garbage", Searches: 2, Clicks: 2, LastSeen: today()},
+		{Query: "zig", Searches: 1, Empty: 1, Clicks: 1, LastSeen: today()},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("stats are %+v, want %+v", stats, want)
+	}
+	if want := []PostClicks{{"gc", 2}, {"rust", 1}}; !slices.Equal(clicks, want) {
+		t.Errorf("clicks are %+v, want %+v", clicks, want)
+	}
+	if stats[0].ClickRate() != 100 || stats[1].ClickRate() != 100 {
+		t.Errorf("click rates are %d and %d", stats[0].ClickRate(), stats[1].ClickRate())
+	}
+
+	stats, clicks = sl.Stats("ZI")
+	if len(stats) != 1 || stats[0].Query != "zig" || !slices.Equal(clicks, []PostClicks{{"gc", 1}}) {
+		t.Errorf("filtered stats are %+v and %+v", stats, clicks)
+	}
+}
+
+func TestSearchLogSave(t *testing.T) {
+	dir := t.TempDir()
+	sl, err := LoadSearchLog(dir, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing gets written until there is something to write
+	if err := sl.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, searchLogFile)); !os.IsNotExist(err) {
+		t.Errorf("saved an empty log: %v", err)
+	}
+
+	// Old records get thrown out
+	old := today().Add(-8 * 24 * time.Hour)
+	sl.Searches = append(sl.Searches, SearchRecord{Query: "old", Results: 1, Day: old})
+	sl.Clicks = append(sl.Clicks, SearchClick{Query: "old", Post: "gc", Day: old})
+	sl.Record("new", 1)
+	sl.Click("new", "gc")
+	if err := sl.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadSearchLog(dir, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Searches) != 1 || loaded.Searches[0].Query != "new" || !loaded.Searches[0].Day.Equal(today()) ||
+		len(loaded.Clicks) != 1 || loaded.Clicks[0].Post != "gc" {
+		t.Errorf("loaded %+v and %+v", loaded.Searches, loaded.Clicks)
+	}
+
+	// A broken file just starts over
+	if err := os.WriteFile(filepath.Join(dir, searchLogFile), []byte("nonsense ["), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadSearchLog(dir, 7*24*time.Hour); err != nil || len(loaded.Searches) != 0 {
+		t.Errorf("got %v and %+v from a broken file", err, loaded)
+	}
+}
+
+func TestSearchLogClicks(t *testing.T) {
+	sl, err := LoadSearchLog(t.TempDir(), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expanding a result and then opening it is still one click
+	sl.Record("garbage", 2)
+	sl.Click("garbage", "gc")
+	sl.Click("garbage", "gc")
+	sl.Click("garbage", "rust")
+
+	// Clicking a result while still typing means the search was done
+	sl.Click("ownership", "rust")
+
+	stats, clicks := sl.Stats("")
+	slices.SortFunc(stats, func(a, b QueryStats) int { return strings.Compare(a.Query, b.Query) })
+	want := []QueryStats{
+		{Query: "garbage", Searches: 1, Clicks: 2, LastSeen: today()},
+		{Query: "ownership", Searches: 1, Clicks: 1, LastSeen: today()},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("stats are %+v, want %+v", stats, want)
+	}
+	if want := []PostClicks{{"rust", 2}, {"gc", 1}}; !slices.Equal(clicks, want) {
+		t.Errorf("clicks are %+v, want %+v", clicks, want)
+	}
+}
+
+func TestRecordSearches(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc": `Title = "Garbage collection"`,
+	})
+	mux := testMux(t)
+	HandlePosts(ps)
+	t.Chdir("..")
+
+	search := func(form url.Values, htmx bool) {
+		r := httptest.NewRequest("POST", "http://localhost/home", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if htmx {
+			r.Header.Set("HX-Request", "true")
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	search(url.Values{"Search": {"garb"}}, true)
+	search(url.Values{"Search": {"garbage"}}, true)
+	search(url.Values{"Search": {"garbage"}, "Submitted": {"true"}}, true)
+	search(url.Values{"Search": {"garbage"}, "LoadFrom": {"10"}, "Submitted": {"true"}}, true)
+	search(url.Values{"Search": {"zig"}}, false)
+
+	queries := make([]string, 0)
+	for _, s := range ps.Searches.Searches {
+		queries = append(queries, s.Query)
+	}
+	if want := []string{"garbage", "zig"}; !slices.Equal(queries, want) {
+		t.Errorf("recorded %v, want %v", queries, want)
+	}
+
+	// Opening a result counts as a click
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://localhost/post/gc?searched=Garbage", nil))
+	if len(ps.Searches.Clicks) != 1 || ps.Searches.Clicks[0].Post != "gc" || ps.Searches.Clicks[0].Query != "garbage" {
+		t.Errorf("clicks are %+v", ps.Searches.Clicks)
+	}
+}
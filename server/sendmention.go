@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/net/html"
+)
+
+// Status of sending a webmention to one of the links in a post
+type Delivery struct {
+	Source   string // Url of our post, so pending ones can be sent after a restart
+	Target   string
+	Endpoint string
+	Status   string // One of pending, sent, failed or unsupported
+	Code     int    // Last HTTP status code from the endpoint
+	Attempts int
+	Updated  time.Time
+}
+
+// Keeps track of which sites we've notified about our posts
+type DeliveryDB struct {
+	Deliveries map[PostID][]Delivery
+	Lock       sync.RWMutex
+	dir        string
+	client     *http.Client
+	queue      *RetryQueue
+}
+
+func LoadDeliveryDB(dir string) (*DeliveryDB, error) {
+	db := &DeliveryDB{
+		Deliveries: make(map[PostID][]Delivery),
+		dir:        dir,
+		client:     newPublicClient(), // Endpoints come from other sites' pages
+		queue:      NewRetryQueue("webmention", 5, time.Minute),
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "webmentions-sent.toml")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := toml.Unmarshal(data, &db.Deliveries); err != nil {
+			log.Println(err)
+			db.Deliveries = make(map[PostID][]Delivery)
+		}
+	}
+
+	// Deliveries that were still waiting when the server stopped
+	for id, deliveries := range db.Deliveries {
+		for _, d := range deliveries {
+			if d.Status == "pending" && d.Source != "" {
+				db.queue.Push(func(attempt int) error {
+					return db.send(id, d.Source, d.Target, attempt)
+				})
+			}
+		}
+	}
+	return db, nil
+}
+
+// Saves the database, expects the lock to already be held
+func (db *DeliveryDB) save() error {
+	if data, err := toml.Marshal(db.Deliveries); err != nil {
+		return err
+	} else {
+		return WriteFileAtomic(filepath.Join(db.dir, "webmentions-sent.toml"), data, 0664)
+	}
+}
+
+func (db *DeliveryDB) Get(id PostID) []Delivery {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return slices.Clone(db.Deliveries[id])
+}
+
+// Updates the delivery for a target in place
+func (db *DeliveryDB) update(id PostID, target string, fn func(d *Delivery)) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	i := slices.IndexFunc(db.Deliveries[id], func(d Delivery) bool { return d.Target == target })
+	if i == -1 {
+		return
+	}
+	fn(&db.Deliveries[id][i])
+	db.Deliveries[id][i].Updated = time.Now()
+	if err := db.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+func (db *DeliveryDB) RemovePost(id PostID) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	if _, ok := db.Deliveries[id]; !ok {
+		return nil
+	}
+	delete(db.Deliveries, id)
+	return db.save()
+}
+
+// Finds the webmention endpoint in a Link header
+func linkHeaderEndpoint(base *url.URL, headers []string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			href := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(href, "<") || !strings.HasSuffix(href, ">") {
+				continue
+			}
+
+			for _, param := range parts[1:] {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(key, "rel") {
+					continue
+				}
+				if !slices.Contains(strings.Fields(strings.Trim(val, "\"")), "webmention") {
+					continue
+				}
+				if u, err := base.Parse(href[1 : len(href)-1]); err == nil {
+					return u.String()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Finds the webmention endpoint of a page, returns an empty string if the page
+// doesn't support webmentions
+func (db *DeliveryDB) discover(target string) (string, error) {
+	resp, err := db.client.Get(target)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+
+	// Redirects change what relative links are relative to
+	base := resp.Request.URL
+	if endpoint := linkHeaderEndpoint(base, resp.Header.Values("Link")); endpoint != "" {
+		return endpoint, nil
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return "", nil
+	}
+
+	doc, err := html.Parse(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	node := findNode(doc, func(n *html.Node) bool {
+		if n.Type != html.ElementNode || (n.Data != "link" && n.Data != "a") {
+			return false
+		}
+		return slices.Contains(strings.Fields(getAttr(n, "rel")), "webmention")
+	})
+	if node == nil {
+		return "", nil
+	}
+
+	// An empty href means the page itself is the endpoint
+	for _, attr := range node.Attr {
+		if attr.Key == "href" {
+			if u, err := base.Parse(attr.Val); err == nil {
+				return u.String(), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// Discovers the endpoint of target and notifies it that source links to it
+func (db *DeliveryDB) send(id PostID, source, target string, attempt int) error {
+	db.update(id, target, func(d *Delivery) { d.Attempts = attempt })
+
+	endpoint, err := db.discover(target)
+	if err != nil {
+		db.update(id, target, func(d *Delivery) { d.Status = "failed" })
+		return err
+	} else if endpoint == "" {
+		db.update(id, target, func(d *Delivery) { d.Status = "unsupported" })
+		return nil
+	}
+
+	resp, err := db.client.PostForm(endpoint, url.Values{
+		"source": {source},
+		"target": {target},
+	})
+	if err != nil {
+		db.update(id, target, func(d *Delivery) {
+			d.Endpoint = endpoint
+			d.Status = "failed"
+		})
+		return err
+	}
+	resp.Body.Close()
+
+	db.update(id, target, func(d *Delivery) {
+		d.Endpoint = endpoint
+		d.Code = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			d.Status = "sent"
+		} else {
+			d.Status = "failed"
+		}
+	})
+
+	// Only server errors are worth trying again
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Queues webmentions for every external link in a post. Sites that were
+// notified before but are no longer linked get notified too so that they can
+// remove their mention.
+func (db *DeliveryDB) Notify(id PostID, source string, links []string) {
+	db.Lock.Lock()
+	targets := slices.Clone(links)
+	for _, d := range db.Deliveries[id] {
+		if !slices.Contains(targets, d.Target) {
+			targets = append(targets, d.Target)
+		}
+	}
+
+	deliveries := make([]Delivery, len(targets))
+	for i, target := range targets {
+		deliveries[i] = Delivery{
+			Source:  source,
+			Target:  target,
+			Status:  "pending",
+			Updated: time.Now(),
+		}
+	}
+	db.Deliveries[id] = deliveries
+	if err := db.save(); err != nil {
+		log.Println(err)
+	}
+	db.Lock.Unlock()
+
+	for _, target := range targets {
+		db.queue.Push(func(attempt int) error {
+			return db.send(id, source, target, attempt)
+		})
+	}
+}
+
+// Sends webmentions for all the links in a post that was just published
+func SendWebmentions(ps *PostStats, links Links, id PostID) {
+	post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// Don't bother mentioning ourselves
+	targets := make([]string, 0, len(post.Links))
+	for _, link := range post.Links {
+		if !strings.HasPrefix(link, links.Base+"/") {
+			targets = append(targets, link)
+		}
+	}
+
+	ps.Sent.Notify(id, links.Post(id), targets)
+}
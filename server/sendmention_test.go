@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinkHeaderEndpoint(t *testing.T) {
+	base, _ := url.Parse("https://them.example/notes/1")
+	tests := []struct {
+		name    string
+		headers []string
+		want    string
+	}{
+		{"none", nil, ""},
+		{"absolute", []string{`<https://them.example/webmention>; rel="webmention"`}, "https://them.example/webmention"},
+		{"relative", []string{`</webmention>; rel=webmention`}, "https://them.example/webmention"},
+		{"relative to the page", []string{`<endpoint>; rel="webmention"`}, "https://them.example/notes/endpoint"},
+		{"more than one rel", []string{`</webmention>; rel="other webmention"`}, "https://them.example/webmention"},
+		{"other links first", []string{`</style.css>; rel="stylesheet", </webmention>; rel="webmention"`}, "https://them.example/webmention"},
+		{"in a later header", []string{`</style.css>; rel="stylesheet"`, `</webmention>; REL="webmention"`}, "https://them.example/webmention"},
+		{"something similar", []string{`</webmention>; rel="webmention.org"`}, ""},
+		{"not in brackets", []string{`/webmention; rel="webmention"`}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := linkHeaderEndpoint(base, test.headers); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverEndpoint(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</from-header>; rel="webmention"`)
+		w.Write([]byte(`<link rel="webmention" href="/from-html">`))
+	})
+	mux.HandleFunc("/link", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head><link rel="webmention" href="/from-link"></head></html>`))
+	})
+	mux.HandleFunc("/anchor", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<p><a rel="webmention" href="from-anchor">endpoint</a></p>`))
+	})
+	mux.HandleFunc("/itself", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><link rel="webmention" href=""></html>`))
+	})
+	mux.HandleFunc("/none", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<p>Nothing here</p>`))
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(`<link rel="webmention" href="/from-text">`))
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere/page", http.StatusFound)
+	})
+	mux.HandleFunc("/elsewhere/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><link rel="webmention" href="endpoint"></html>`))
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	db, err := LoadDeliveryDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.client = srv.Client()
+
+	tests := []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{"/header", "/from-header", false},
+		{"/link", "/from-link", false},
+		{"/anchor", "/from-anchor", false},
+		{"/itself", "/itself", false},
+		{"/none", "", false},
+		{"/text", "", false},
+		{"/moved", "/elsewhere/endpoint", false},
+		{"/broken", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			endpoint, err := db.discover(srv.URL + test.path)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+			want := test.want
+			if want != "" {
+				want = srv.URL + want
+			}
+			if endpoint != want {
+				t.Errorf("got %q, want %q", endpoint, want)
+			}
+		})
+	}
+}
+
+func TestDiscoverRefusesLocalTargets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</webmention>; rel="webmention"`)
+	}))
+	defer srv.Close()
+
+	db, err := LoadDeliveryDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint, err := db.discover(srv.URL + "/post"); err == nil {
+		t.Errorf("found %s on %s", endpoint, srv.URL)
+	}
+}
+
+// Waits for every delivery of a post to be done
+func waitForDeliveries(t *testing.T, db *DeliveryDB, id PostID) []Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := db.Get(id)
+		pending := slices.ContainsFunc(deliveries, func(d Delivery) bool { return d.Status == "pending" })
+		if !pending {
+			return deliveries
+		} else if time.Now().After(deadline) {
+			t.Fatalf("still sending: %+v", deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var lock sync.Mutex
+	received := make(map[string]string) // Target to source
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</webmention>; rel="webmention"`)
+	})
+	mux.HandleFunc("/old", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</webmention>; rel="webmention"`)
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/refused", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</refuse>; rel="webmention"`)
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<p>No webmentions here</p>`))
+	})
+	mux.HandleFunc("POST /webmention", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		received[r.FormValue("target")] = r.FormValue("source")
+		lock.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("POST /refuse", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	db, err := LoadDeliveryDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.client = srv.Client()
+
+	const source = "https://blog.example/post/abc"
+	db.Notify("abc", source, []string{srv.URL + "/page", srv.URL + "/old"})
+	waitForDeliveries(t, db, "abc")
+
+	// Taking a link out still notifies the old target
+	lock.Lock()
+	received = make(map[string]string)
+	lock.Unlock()
+	db.Notify("abc", source, []string{srv.URL + "/page", srv.URL + "/refused", srv.URL + "/plain"})
+	deliveries := waitForDeliveries(t, db, "abc")
+
+	want := map[string]string{
+		"/page":    "sent",
+		"/refused": "failed",
+		"/plain":   "unsupported",
+		"/old":     "sent",
+	}
+	if len(deliveries) != len(want) {
+		t.Fatalf("got %+v", deliveries)
+	}
+	for _, d := range deliveries {
+		path := d.Target[len(srv.URL):]
+		if d.Status != want[path] {
+			t.Errorf("%s is %s, want %s", path, d.Status, want[path])
+		}
+		if d.Attempts != 1 {
+			t.Errorf("%s took %d attempts", path, d.Attempts)
+		}
+	}
+
+	lock.Lock()
+	for _, path := range []string{"/page", "/old"} {
+		if received[srv.URL+path] != source {
+			t.Errorf("%s wasn't notified: %v", path, received)
+		}
+	}
+	lock.Unlock()
+
+	// It all got saved
+	again, err := LoadDeliveryDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved := again.Get("abc"); len(saved) != len(want) {
+		t.Errorf("saved %+v", saved)
+	}
+}
+
+func TestPendingDeliveriesAfterRestart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", `</webmention>; rel="webmention"`)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	saved := `[[abc]]
+Source = "https://blog.example/post/abc"
+Target = "` + srv.URL + `/page"
+Status = "pending"
+
+[[abc]]
+Target = "` + srv.URL + `/sent"
+Status = "sent"
+`
+	if err := os.WriteFile(filepath.Join(dir, "webmentions-sent.toml"), []byte(saved), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the pending one gets tried again, which the local address stops
+	db, err := LoadDeliveryDB(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveries := waitForDeliveries(t, db, "abc")
+	if len(deliveries) != 2 || deliveries[0].Status != "failed" || deliveries[0].Attempts != 1 || deliveries[1].Status != "sent" || deliveries[1].Attempts != 0 {
+		t.Errorf("got %+v", deliveries)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+// How many words of context go on each side of a match
+const snippetContext = 12
+
+// Terms from a search that should be highlighted in the results
+type Highlight struct {
+	terms    map[string]struct{}
+	analyzer *Analyzer
+}
+
+// Works out what to highlight for a search. Searches with bad syntax don't
+// highlight anything
+func (ps *PostStats) HighlightTerms(term string) Highlight {
+	terms := make(map[string]struct{})
+	hl := Highlight{terms: terms, analyzer: ps.Index.Analyzer}
+	query, err := ParseQuery(term, ps.Index.Analyzer)
+	if err != nil {
+		return hl
+	}
+
+	ps.Index.Lock.RLock()
+	defer ps.Index.Lock.RUnlock()
+	for _, group := range query.Groups {
+		for _, word := range group.Words {
+			for _, t := range ps.Index.expand(word) {
+				terms[t] = struct{}{}
+			}
+		}
+		for _, phrase := range group.Phrases {
+			for _, t := range phrase {
+				terms[t.Term] = struct{}{}
+			}
+		}
+	}
+	return hl
+}
+
+// Pulls up to count bits of text around the words that matched a search, with
+// the matches wrapped in <mark>
+func (hl Highlight) Snippets(text string, count int) []template.HTML {
+	snippets := make([]template.HTML, 0, count)
+	if len(hl.terms) == 0 {
+		return snippets
+	}
+
+	spans := wordSpans(text)
+	matched := func(i int) bool {
+		term, ok := hl.analyzer.Term(text[spans[i].start:spans[i].end])
+		if !ok {
+			return false
+		}
+		_, ok = hl.terms[term]
+		return ok
+	}
+
+	covered := -1 // Last word that is already in a snippet
+	for i := range spans {
+		if len(snippets) == count {
+			break
+		}
+		if i <= covered || !matched(i) {
+			continue
+		}
+
+		first := max(i-snippetContext, covered+1)
+		last := min(i+snippetContext, len(spans)-1)
+		covered = last
+
+		var sb strings.Builder
+		if first > 0 {
+			sb.WriteString("…")
+		}
+		pos := spans[first].start
+		for w := first; w <= last; w++ {
+			sb.WriteString(template.HTMLEscapeString(text[pos:spans[w].start]))
+			word := template.HTMLEscapeString(text[spans[w].start:spans[w].end])
+			if matched(w) {
+				sb.WriteString("<mark>" + word + "</mark>")
+			} else {
+				sb.WriteString(word)
+			}
+			pos = spans[w].end
+		}
+		if last < len(spans)-1 {
+			sb.WriteString("…")
+		} else {
+			// Keep the punctuation at the very end
+			sb.WriteString(template.HTMLEscapeString(strings.TrimSpace(text[pos:])))
+		}
+		snippets = append(snippets, template.HTML(sb.String()))
+	}
+	return snippets
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Some filler words with a few words put in at certain places
+func fillerText(n int, words map[int]string) string {
+	all := make([]string, n)
+	for i := range all {
+		if word, ok := words[i]; ok {
+			all[i] = word
+		} else {
+			all[i] = fmt.Sprintf("filler%d", i)
+		}
+	}
+	return strings.Join(all, " ")
+}
+
+func TestSnippets(t *testing.T) {
+	ps := testSearchStats(t, searchTestPosts...)
+
+	long := fillerText(60, map[int]string{20: "garbage", 50: "garbage"})
+	context := func(from, to int, marks ...int) string {
+		words := make([]string, 0)
+		for i := from; i <= to; i++ {
+			if slices.Contains(marks, i) {
+				words = append(words, "<mark>garbage</mark>")
+			} else {
+				words = append(words, fmt.Sprintf("filler%d", i))
+			}
+		}
+		return strings.Join(words, " ")
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		text  string
+		count int
+		want  []template.HTML
+	}{
+		{
+			name:  "word",
+			query: "garbage",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{"The <mark>garbage</mark> collector frees memory."},
+		},
+		{
+			name:  "every match in the snippet",
+			query: "garbage memory",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{"The <mark>garbage</mark> collector frees <mark>memory</mark>."},
+		},
+		{
+			name:  "other forms of the word",
+			query: "collectors",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{"The garbage <mark>collector</mark> frees memory."},
+		},
+		{
+			name:  "start of a word while typing",
+			query: "garb",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{"The <mark>garbage</mark> collector frees memory."},
+		},
+		{
+			name:  "accents",
+			query: "cafe",
+			text:  "We sat in a café.",
+			count: 1,
+			want:  []template.HTML{"We sat in a <mark>café</mark>."},
+		},
+		{
+			name:  "phrases",
+			query: `"garbage collector"`,
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{"The <mark>garbage</mark> <mark>collector</mark> frees memory."},
+		},
+		{
+			name:  "html gets escaped",
+			query: "garbage",
+			text:  "garbage <script> & more",
+			count: 1,
+			want:  []template.HTML{"<mark>garbage</mark> &lt;script&gt; &amp; more"},
+		},
+		{
+			name:  "excluded words aren't marked",
+			query: "memory -garbage",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{"The garbage collector frees <mark>memory</mark>."},
+		},
+		{
+			name:  "context around the match",
+			query: "garbage",
+			text:  long,
+			count: 1,
+			want:  []template.HTML{template.HTML("…" + context(8, 32, 20) + "…")},
+		},
+		{
+			name:  "more than one snippet",
+			query: "garbage",
+			text:  long,
+			count: 3,
+			want: []template.HTML{
+				template.HTML("…" + context(8, 32, 20) + "…"),
+				template.HTML("…" + context(38, 59, 50)),
+			},
+		},
+		{
+			name:  "matches close together share a snippet",
+			query: "garbage",
+			text:  fillerText(30, map[int]string{10: "garbage", 15: "garbage"}),
+			count: 3,
+			want:  []template.HTML{template.HTML(context(0, 22, 10, 15) + "…")},
+		},
+		{
+			name:  "no match",
+			query: "ownership",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{},
+		},
+		{
+			name:  "stop words",
+			query: "the",
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{},
+		},
+		{
+			name:  "bad syntax",
+			query: `"garbage`,
+			text:  "The garbage collector frees memory.",
+			count: 1,
+			want:  []template.HTML{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ps.HighlightTerms(test.query).Snippets(test.text, test.count)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
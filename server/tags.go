@@ -4,15 +4,690 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"maps"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/BurntSushi/toml"
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
 	"github.com/lithammer/fuzzysearch/fuzzy"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
-// Handle tags page
-func HandleTags(ps *PostStats) {
+// How many posts a tag's page shows at a time
+const tagPageSize = 10
+
+// Slugs of every tag, and the ids tags used to have so that old links keep working.
+// Aliases get changed from the admin tags page
+type TagDB struct {
+	Tags      map[string]TagID
+	Redirects map[TagID]TagID   // Old random ids to the tag's slug
+	Retired   map[TagID]string  // Slugs of tags no post uses anymore, so they don't go to some other tag
+	Aliases   map[string]string // Other names for tags, like golang to Go
+	Meta      map[string]TagMeta
+}
+
+// Extra things about a tag that can be set from the admin page
+type TagMeta struct {
+	Description string `toml:",omitempty"` // Markdown
+	Color       string `toml:",omitempty"` // Like #3b82f6
+	Icon        string `toml:",omitempty"` // Either some text like an emoji, or a link to an image
+}
+
+var tagColorRegex = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Whether the icon is an image instead of some text
+func (m TagMeta) IconImage() bool {
+	return strings.HasPrefix(m.Icon, "/") || strings.HasPrefix(m.Icon, "https://") || strings.HasPrefix(m.Icon, "http://")
+}
+
+// The icon to put in front of the tag's name
+func (m TagMeta) IconHTML() template.HTML {
+	if m.Icon == "" {
+		return "#️⃣"
+	} else if m.IconImage() {
+		return template.HTML(`<img class="tag-icon" src="` + template.HTMLEscapeString(m.Icon) + `" alt="" />`)
+	}
+	return template.HTML(template.HTMLEscapeString(m.Icon))
+}
+
+// The description rendered like a post
+func (m TagMeta) HTML() template.HTML {
+	p := parser.NewWithExtensions(parser.CommonExtensions)
+	r := html.NewRenderer(html.RendererOptions{Flags: html.CommonFlags | html.HrefTargetBlank})
+	return template.HTML(markdown.ToHTML([]byte(m.Description), p, r))
+}
+
+// Cleans up metadata from a form, returning an error for anything that can't be used
+func (m TagMeta) Validate() (TagMeta, error) {
+	m.Description = strings.TrimSpace(m.Description)
+	m.Color = strings.TrimSpace(m.Color)
+	m.Icon = strings.TrimSpace(m.Icon)
+	if m.Color != "" && !tagColorRegex.MatchString(m.Color) {
+		return m, fmt.Errorf("Colors have to look like #3b82f6")
+	}
+	if !m.IconImage() && utf8.RuneCountInString(m.Icon) > 8 {
+		return m, fmt.Errorf("Icons have to be a few characters, or a link to an image")
+	}
+	return m, nil
+}
+
+func newTagDB() TagDB {
+	return TagDB{
+		Tags:      make(map[string]TagID),
+		Redirects: make(map[TagID]TagID),
+		Retired:   make(map[TagID]string),
+		Aliases:   make(map[string]string),
+		Meta:      make(map[string]TagMeta),
+	}
+}
+
+// The spelling of a tag that is already known, ignoring case. When there are a
+// few the one that came first wins, it's the one without a number on its slug
+func (db *TagDB) existing(name string) string {
+	best := ""
+	for tag := range db.Tags {
+		if !strings.EqualFold(tag, name) {
+			continue
+		}
+		if best == "" || len(db.Tags[tag]) < len(db.Tags[best]) ||
+			(len(db.Tags[tag]) == len(db.Tags[best]) && tag < best) {
+			best = tag
+		}
+	}
+	if best == "" {
+		return name
+	}
+	return best
+}
+
+// The name a tag is listed under, so that "go", "Go" and an alias like "golang"
+// all end up as the same tag. Nested tags get worked out one level at a time
+func (db *TagDB) Canonical(name string) string {
+	canon := ""
+	for _, part := range strings.Split(CleanTag(name), "/") {
+		if part == "" {
+			return ""
+		} else if canon != "" {
+			part = canon + "/" + part
+		}
+
+		canon = db.existing(part)
+		for alias, tag := range db.Aliases {
+			if strings.EqualFold(CleanTag(alias), part) {
+				canon = db.existing(CleanTag(tag))
+				break
+			}
+		}
+	}
+	return canon
+}
+
+// Metadata of a tag, by any of its names
+func (db *TagDB) MetaFor(name string) TagMeta {
+	return db.Meta[db.Canonical(name)]
+}
+
+// Drops tags no post uses anymore, like spellings that got unified after an
+// update. Links to them go to the tag they were unified into
+func (db *TagDB) prune(used map[string][]PostID) {
+	for name, id := range db.Tags {
+		if _, ok := used[name]; ok {
+			continue
+		}
+		db.retire(name)
+		if canon := db.Canonical(name); canon != name {
+			if _, ok := used[canon]; ok {
+				if newid := db.GetTagID(canon); newid != id {
+					db.Redirects[id] = newid
+				}
+			}
+		}
+	}
+}
+
+// Warnings for new tags that are probably meant to be a tag that already
+// exists, like "tests" when there is "test"
+func (db *TagDB) NearDuplicates(tags []string) []string {
+	warnings := make([]string, 0)
+	for _, tag := range tags {
+		canon := db.Canonical(tag)
+		if _, ok := db.Tags[canon]; ok || canon == "" {
+			continue
+		}
+
+		folded := strings.ToLower(canon)
+		for existing := range db.Tags {
+			other := strings.ToLower(existing)
+			limit := 2
+			if min(len(folded), len(other)) <= 5 {
+				limit = 1
+			}
+			if TagSlug(canon) == TagSlug(existing) || fuzzy.LevenshteinDistance(folded, other) <= limit {
+				warnings = append(warnings, fmt.Sprintf("The new tag %q looks a lot like the tag %q", tag, existing))
+			}
+		}
+	}
+	slices.Sort(warnings)
+	return warnings
+}
+
+// Tags can be nested like lang/go, this tidies up the spacing and slashes
+func CleanTag(name string) string {
+	parts := make([]string, 0)
+	for _, part := range strings.Split(name, "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// The tag a nested tag is under, lang/go is under lang
+func ParentTag(name string) (string, bool) {
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		return name[:i], true
+	}
+	return "", false
+}
+
+// Whether a tag is the same as another or nested somewhere under it, ignoring case
+func IsTagUnder(name, parent string) bool {
+	return strings.EqualFold(name, parent) ||
+		(len(name) > len(parent) && name[len(parent)] == '/' && strings.EqualFold(name[:len(parent)], parent))
+}
+
+// Adds every parent of the tags, since posts count towards the tags they're under
+func WithParentTags(tags []string) []string {
+	all := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		for ok := true; ok; tag, ok = ParentTag(tag) {
+			if !slices.Contains(all, tag) {
+				all = append(all, tag)
+			}
+		}
+	}
+	return all
+}
+
+// Turns a tag name into something readable for urls, like "Go Generics" into
+// "go-generics"
+func TagSlug(name string) TagID {
+	if folded, _, err := transform.String(transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn))), name); err == nil {
+		name = folded
+	}
+
+	var sb strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if sb.Len() == 0 {
+		return "tag"
+	}
+	return TagID(sb.String())
+}
+
+func LoadTagDB(dir string) (TagDB, error) {
+	db := newTagDB()
+
+	// See if the database exists, if so open it
+	data, err := os.ReadFile(filepath.Join(dir, "tags.toml"))
+	if err != nil && !os.IsNotExist(err) {
+		// Some error in opening the file, it does exist it seems
+		log.Println(err)
+		return db, err
+	} else if err == nil {
+		var old map[string]TagID
+		if md, err := toml.Decode(string(data), &db); err == nil && (md.IsDefined("Tags") || md.IsDefined("Redirects")) {
+			if db.Tags == nil {
+				db.Tags = make(map[string]TagID)
+			}
+			if db.Redirects == nil {
+				db.Redirects = make(map[TagID]TagID)
+			}
+			if db.Retired == nil {
+				db.Retired = make(map[TagID]string)
+			}
+			if db.Meta == nil {
+				db.Meta = make(map[string]TagMeta)
+			}
+			if db.Aliases == nil {
+				db.Aliases = make(map[string]string)
+			}
+			return db, nil
+		} else if err := toml.Unmarshal(data, &old); err == nil && len(old) > 0 {
+			// Tags used to get random ids, those now point to the slugs. Go in
+			// order so that colliding slugs get numbered the same way every time
+			db = newTagDB()
+			for _, name := range slices.Sorted(maps.Keys(old)) {
+				db.Redirects[old[name]] = db.GetTagID(name)
+			}
+			log.Println("Switched tags over to readable slugs")
+			return db, db.Save(dir)
+		}
+	}
+
+	// Okay so either the database is corrupted or there is no tagdb so lets just create one
+	var entries []os.DirEntry
+	if entries, err = os.ReadDir(dir); err != nil {
+		log.Println(err)
+		return db, err
+	}
+
+	names := make(map[string]struct{})
+	for _, ent := range entries {
+		// Get the post info, and then register the tag
+		if !isPostDir(ent) {
+			continue
+		}
+		if info, err := LoadPostInfo(filepath.Join(dir, ent.Name())); err != nil {
+			log.Println(err)
+			return db, err
+		} else if info.Page == "" {
+			for _, tag := range WithParentTags(info.Tags) {
+				names[tag] = struct{}{}
+			}
+		}
+	}
+
+	// In order so that colliding slugs get numbered the same way every time
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		db.GetTagID(name)
+	}
+
+	if err := db.Save(dir); err != nil {
+		log.Println(err)
+		return db, err
+	} else {
+		return db, nil
+	}
+}
+
+// Gets the slug of a tag by any of its names, making one if the tag is new.
+// Tags whose slugs would be the same get a number on the end
+func (db *TagDB) GetTagID(name string) TagID {
+	if id, ok := db.Tags[name]; ok {
+		return id
+	}
+	name = db.Canonical(name)
+	if id, ok := db.Tags[name]; ok {
+		return id
+	}
+
+	slug := TagSlug(name)
+	newid := slug
+	for n := 2; ; n++ {
+		_, used := db.Name(newid)
+		if retired, ok := db.Retired[newid]; ok && !strings.EqualFold(retired, name) {
+			used = true
+		}
+		if !used {
+			break
+		}
+		newid = TagID(string(slug) + "-" + strconv.Itoa(n))
+	}
+	db.Tags[name] = newid
+	delete(db.Redirects, newid) // The slug belongs to a tag again
+	delete(db.Retired, newid)
+	return newid
+}
+
+// Gets the slug of a tag without adding it, so only the read lock is needed.
+// Tags that aren't known yet get the slug they would most likely end up with
+func (db *TagDB) FindTagID(name string) TagID {
+	if id, ok := db.Tags[name]; ok {
+		return id
+	}
+	name = db.Canonical(name)
+	if id, ok := db.Tags[name]; ok {
+		return id
+	}
+	return TagSlug(name)
+}
+
+// Drops a tag that no post uses anymore. Its slug stays taken so old links
+// don't end up at some new tag that happens to have the same slug
+func (db *TagDB) retire(name string) {
+	if id, ok := db.Tags[name]; ok {
+		delete(db.Tags, name)
+		db.Retired[id] = name
+	}
+}
+
+// Finds the tag with some slug
+func (db *TagDB) Name(id TagID) (string, bool) {
+	for name, other := range db.Tags {
+		if other == id {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (db *TagDB) Save(dir string) error {
+	if data, err := toml.Marshal(db); err != nil {
+		return err
+	} else {
+		return os.WriteFile(filepath.Join(dir, "tags.toml"), data, 0664)
+	}
+}
+
+// A rename or merge that doesn't make sense, like merging into a tag that
+// doesn't exist
+type RetagError struct {
+	Msg string
+}
+
+func (e *RetagError) Error() string {
+	return e.Msg
+}
+
+// Renames a tag on every post, along with the tags nested under it. Renaming
+// to an empty name removes the tag, merging puts the posts into a tag that
+// already exists. Returns the posts that changed
+func (ps *PostStats) Retag(from, to string, merge bool) ([]PostID, error) {
+	ps.Lock.Lock()
+	changed := make([]PostID, 0)
+	defer func() {
+		infos := make([]PostInfo, len(changed))
+		for i, id := range changed {
+			infos[i] = ps.Posts[id]
+		}
+		ps.Lock.Unlock()
+		for i, id := range changed {
+			ps.notify(PostUpdated, id, infos[i])
+		}
+	}()
+
+	// Checked while holding the lock so nothing can change in between
+	to = CleanTag(to)
+	if _, ok := ps.ByTag[from]; !ok {
+		return changed, &RetagError{from + " doesn't exist anymore"}
+	}
+	if to != "" {
+		_, exists := ps.ByTag[ps.TagDB.Canonical(to)]
+		exists = exists && !strings.EqualFold(ps.TagDB.Canonical(to), from)
+		switch {
+		case to == from:
+			return changed, &RetagError{"The tag is already called " + to}
+		case IsTagUnder(to, from) && !strings.EqualFold(to, from):
+			return changed, &RetagError{"A tag can't go under itself"}
+		case !merge && exists:
+			return changed, &RetagError{to + " already exists, merge into it instead"}
+		case merge && !exists:
+			return changed, &RetagError{to + " doesn't exist, rename to it instead"}
+		}
+	}
+
+	// What the tag and everything under it become
+	under := func(tag string) bool {
+		return tag == from || strings.HasPrefix(tag, from+"/")
+	}
+	renamed := make(map[string]string)
+	for tag := range ps.ByTag {
+		if under(tag) && to != "" {
+			renamed[tag] = to + tag[len(from):]
+		}
+	}
+	oldids := make(map[string]TagID)
+	for tag := range ps.ByTag {
+		if under(tag) {
+			oldids[tag] = ps.TagDB.Tags[tag]
+		}
+	}
+
+	// Work out the new tags of every post first, the file has the post's own
+	// spelling of the tags and only the ones being changed get touched
+	type retagged struct {
+		id   PostID
+		dir  string
+		info PostInfo
+		tags []string
+	}
+	posts := make([]retagged, 0)
+	for _, id := range ps.ByTag[from] {
+		dir := filepath.Join(ps.Cfg.PostDir, string(id))
+		info, err := LoadPostInfo(dir)
+		if err != nil {
+			return changed, err
+		}
+		tags := make([]string, 0, len(info.Tags))
+		for _, tag := range info.Tags {
+			if canon := ps.TagDB.Canonical(tag); under(canon) {
+				tag = renamed[canon]
+			}
+			if tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if !slices.Equal(tags, info.Tags) {
+			posts = append(posts, retagged{id, dir, info, tags})
+		}
+	}
+
+	// Aliases follow the tag, ones that are now the tag's own name aren't needed
+	for alias, tag := range ps.TagDB.Aliases {
+		if canon := ps.TagDB.Canonical(tag); under(canon) || under(tag) {
+			if newtag, ok := renamed[canon]; ok && !strings.EqualFold(CleanTag(alias), newtag) {
+				ps.TagDB.Aliases[alias] = newtag
+			} else {
+				delete(ps.TagDB.Aliases, alias)
+			}
+		}
+	}
+
+	// Tags that only change case keep their slug. The database has to know the
+	// new spelling before the posts get listed again, otherwise it would get
+	// folded back into the old one
+	for tag, newtag := range renamed {
+		if !strings.EqualFold(tag, newtag) {
+			continue
+		}
+		if id, ok := ps.TagDB.Tags[tag]; ok {
+			delete(ps.TagDB.Tags, tag)
+			ps.TagDB.Tags[newtag] = id
+		}
+		if meta, ok := ps.TagDB.Meta[tag]; ok {
+			delete(ps.TagDB.Meta, tag)
+			ps.TagDB.Meta[newtag] = meta
+		}
+	}
+
+	for _, p := range posts {
+		before := p.info.Tags
+		p.info.Tags = p.tags
+		if err := SavePostInfo(p.dir, p.info); err != nil {
+			return changed, err
+		}
+		post, err := LoadPost(p.dir)
+		if err != nil {
+			return changed, err
+		}
+		modtime, err := PostModTime(p.dir)
+		if err != nil {
+			return changed, err
+		}
+		ps.relist(&post, modtime)
+		changed = append(changed, p.id)
+		log.Printf("Changed the tags of %s from %v to %v\n", p.id, before, p.tags)
+	}
+
+	// Old links go to where the tags went, and the metadata goes with them
+	for tag, oldid := range oldids {
+		if _, alive := ps.ByTag[tag]; alive {
+			continue
+		}
+		if newtag, ok := renamed[tag]; ok {
+			newid := ps.TagDB.GetTagID(newtag)
+			if newid != oldid {
+				ps.TagDB.Redirects[oldid] = newid
+			}
+			for old, target := range ps.TagDB.Redirects {
+				if target == oldid {
+					ps.TagDB.Redirects[old] = newid
+				}
+			}
+			if _, ok := ps.TagDB.Meta[newtag]; !ok {
+				if meta, ok := ps.TagDB.Meta[tag]; ok {
+					ps.TagDB.Meta[newtag] = meta
+				}
+			}
+		} else {
+			// Nowhere to send links to a deleted tag
+			for old, target := range ps.TagDB.Redirects {
+				if target == oldid {
+					delete(ps.TagDB.Redirects, old)
+				}
+			}
+		}
+		delete(ps.TagDB.Meta, tag)
+	}
+
+	if err := ps.TagDB.Save(ps.Cfg.PostDir); err != nil {
+		return changed, err
+	}
+	return changed, nil
+}
+
+// Other names of a tag, sorted
+func (db *TagDB) AliasesOf(name string) []string {
+	aliases := make([]string, 0)
+	for alias, tag := range db.Aliases {
+		if db.Canonical(tag) == name {
+			aliases = append(aliases, alias)
+		}
+	}
+	slices.Sort(aliases)
+	return aliases
+}
+
+// Replaces the other names of a tag. Posts using one of the names that was
+// added or taken away get listed again, returns the posts that changed
+func (ps *PostStats) SetAliases(name string, aliases []string) ([]PostID, error) {
+	ps.Lock.Lock()
+	changed := make([]PostID, 0)
+	defer func() {
+		infos := make([]PostInfo, len(changed))
+		for i, id := range changed {
+			infos[i] = ps.Posts[id]
+		}
+		ps.Lock.Unlock()
+		for i, id := range changed {
+			ps.notify(PostUpdated, id, infos[i])
+		}
+	}()
+
+	if _, ok := ps.TagDB.Tags[name]; !ok {
+		return changed, &RetagError{name + " doesn't exist anymore"}
+	}
+	cleaned := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		alias = CleanTag(alias)
+		switch {
+		case alias == "" || strings.EqualFold(alias, name):
+			continue
+		case IsTagUnder(alias, name) || IsTagUnder(name, alias):
+			return changed, &RetagError{"A tag can't be called " + alias + ", it would go under itself"}
+		}
+		cleaned = append(cleaned, alias)
+	}
+
+	// The posts that could be listed somewhere else afterwards
+	candidates := slices.Clone(ps.ByTag[name])
+	for _, alias := range cleaned {
+		for _, id := range ps.ByTag[ps.TagDB.Canonical(alias)] {
+			if !slices.Contains(candidates, id) {
+				candidates = append(candidates, id)
+			}
+		}
+	}
+	oldids := make(map[string]TagID)
+	for tag, id := range ps.TagDB.Tags {
+		oldids[tag] = id
+	}
+
+	for alias, tag := range ps.TagDB.Aliases {
+		if ps.TagDB.Canonical(tag) == name || slices.ContainsFunc(cleaned, func(a string) bool {
+			return strings.EqualFold(CleanTag(alias), a)
+		}) {
+			delete(ps.TagDB.Aliases, alias)
+		}
+	}
+	for _, alias := range cleaned {
+		ps.TagDB.Aliases[alias] = name
+	}
+
+	// Listed posts only have the folded tags, the file has what they were written as
+	for _, id := range candidates {
+		dir := filepath.Join(ps.Cfg.PostDir, string(id))
+		info, err := LoadPostInfo(dir)
+		if err != nil {
+			return changed, err
+		}
+		tags := make([]string, 0, len(info.Tags))
+		for _, tag := range info.Tags {
+			if tag = ps.TagDB.Canonical(tag); tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		if slices.Equal(tags, ps.Posts[id].Tags) {
+			continue
+		}
+
+		post, err := LoadPost(dir)
+		if err != nil {
+			return changed, err
+		}
+		modtime, err := PostModTime(dir)
+		if err != nil {
+			return changed, err
+		}
+		ps.relist(&post, modtime)
+		changed = append(changed, id)
+	}
+
+	// Links to tags that are now another name go to the tag they ended up in
+	for tag, oldid := range oldids {
+		if _, alive := ps.ByTag[tag]; alive {
+			continue
+		}
+		if canon := ps.TagDB.Canonical(tag); canon != tag {
+			if _, ok := ps.ByTag[canon]; ok {
+				if newid := ps.TagDB.GetTagID(canon); newid != oldid {
+					ps.TagDB.Redirects[oldid] = newid
+				}
+			}
+		}
+	}
+
+	if err := ps.TagDB.Save(ps.Cfg.PostDir); err != nil {
+		return changed, err
+	}
+	return changed, nil
+}
+
+// Handle tags page and editing tags from the admin page
+func HandleTags(ps *PostStats, session *Session) {
 	type Info struct {
 		Title string
 		Date  string
@@ -20,10 +695,54 @@ func HandleTags(ps *PostStats) {
 	}
 
 	type Tag struct {
-		Tag   string
-		ID    string
-		Num   int
-		Posts []Info
+		Tag      string
+		ID       string
+		Num      int // Includes the posts of nested tags
+		Meta     TagMeta
+		Posts    []Info
+		Children []Tag
+		Open     bool // Whether a nested tag is expanded
+	}
+
+	// Most used tags first
+	sorttags := func(tags []Tag) {
+		slices.SortFunc(tags, func(a Tag, b Tag) int {
+			if a.Num > b.Num {
+				return -1
+			} else if a.Num < b.Num {
+				return 1
+			} else {
+				return strings.Compare(a.Tag, b.Tag)
+			}
+		})
+	}
+
+	// Function to put nested tags under their parents, keeping the order
+	tagtree := func(tags []Tag, expand TagID) []Tag {
+		children := make(map[string][]Tag)
+		roots := make([]Tag, 0)
+		for _, tag := range tags {
+			parent, ok := ParentTag(tag.Tag)
+			if ok && slices.ContainsFunc(tags, func(t Tag) bool { return t.Tag == parent }) {
+				children[parent] = append(children[parent], tag)
+			} else {
+				roots = append(roots, tag)
+			}
+		}
+
+		var attach func(tag Tag) Tag
+		attach = func(tag Tag) Tag {
+			for _, child := range children[tag.Tag] {
+				child = attach(child)
+				tag.Open = tag.Open || child.Open || TagID(child.ID) == expand
+				tag.Children = append(tag.Children, child)
+			}
+			return tag
+		}
+		for i := range roots {
+			roots[i] = attach(roots[i])
+		}
+		return roots
 	}
 
 	// Function to write the data for a tag
@@ -40,6 +759,7 @@ func HandleTags(ps *PostStats) {
 			Tag:   name,
 			ID:    string(ps.TagDB.GetTagID(name)),
 			Num:   len(postids),
+			Meta:  ps.TagDB.Meta[name],
 			Posts: nil,
 		}
 
@@ -55,42 +775,126 @@ func HandleTags(ps *PostStats) {
 		return tag, nil
 	}
 
-	// Get html for specific tag
-	http.HandleFunc("GET /tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		tmpl, err := template.ParseFiles("views/tag.html")
-		if err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	// A tag that can be clicked to change which tags are picked
+	type Chip struct {
+		Tag string
+		Num int
+		URL string
+	}
+
+	// Posts that have all or any of several tags
+	type Combined struct {
+		Mode    string // Either all or any
+		Tags    []Chip // Picked tags, each links to the page without it
+		Unknown []string
+		Posts   []Info
+		Refine  []Chip // Other tags the posts have, each links to the page with it added
+		Switch  string // Same tags with the other mode
+	}
+
+	// Function to combine the posts of several tags. Tags can be given by name,
+	// ignoring case, or by id
+	combine := func(links Links, mode string, names []string) Combined {
+		ps.Lock.RLock()
+		defer ps.Lock.RUnlock()
+
+		combined := Combined{Mode: mode}
+		picked := make([]string, 0, len(names))
+		for _, name := range names {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			found := ""
+			if _, ok := ps.ByTag[ps.TagDB.Canonical(name)]; ok {
+				found = ps.TagDB.Canonical(name)
+			} else if tag, ok := ps.TagDB.Name(TagID(name)); ok {
+				found = tag
+			}
+			if found == "" {
+				combined.Unknown = append(combined.Unknown, name)
+			} else if !slices.Contains(picked, found) {
+				picked = append(picked, found)
+			}
+		}
+
+		for i, tag := range picked {
+			rest := slices.Delete(slices.Clone(picked), i, i+1)
+			combined.Tags = append(combined.Tags, Chip{
+				Tag: tag,
+				Num: len(ps.ByTag[tag]),
+				URL: links.TagSet(mode, rest),
+			})
+		}
+		other := "any"
+		if mode == "any" {
+			other = "all"
 		}
-		
-		var tag Tag
-		for name, id := range ps.TagDB {
-			if string(id) != r.PathValue("tag") {
+		combined.Switch = links.TagSet(other, picked)
+
+		// Count how many of the tags each post has
+		counts := make(map[PostID]int)
+		for _, tag := range picked {
+			for _, id := range ps.ByTag[tag] {
+				counts[id]++
+			}
+		}
+		need := 1
+		if mode == "all" {
+			need = len(picked)
+			if len(combined.Unknown) > 0 {
+				need = len(picked) + 1 // Nothing has a tag that doesn't exist
+			}
+		}
+
+		cooccur := make(map[string]int)
+		for _, id := range ps.ByDate {
+			if counts[id] < need || counts[id] == 0 {
 				continue
 			}
-			
-			tag, err = gettag(name)
-			if err != nil {
-				log.Println(err)
-				w.WriteHeader(http.StatusBadRequest)
-				return
+			info := ps.Posts[id]
+			combined.Posts = append(combined.Posts, Info{
+				Title: info.Title,
+				Date:  FormatDate(info.Date),
+				ID:    string(id),
+			})
+			for _, tag := range info.Tags {
+				if !slices.Contains(picked, tag) {
+					cooccur[tag]++
+				}
 			}
-			break
 		}
-		if !r.Form.Has("showPosts") {
-			tag.Posts = nil
+
+		for tag, num := range cooccur {
+			combined.Refine = append(combined.Refine, Chip{
+				Tag: tag,
+				Num: num,
+				URL: links.TagSet(mode, append(slices.Clone(picked), tag)),
+			})
 		}
+		slices.SortFunc(combined.Refine, func(a, b Chip) int {
+			if a.Num != b.Num {
+				return b.Num - a.Num
+			}
+			return strings.Compare(a.Tag, b.Tag)
+		})
+		return combined
+	}
 
-		if err := tmpl.ExecuteTemplate(w, "tag", tag); err != nil {
-			log.Println(err)
+	// Sends links with the old random tag ids to the tag's slug for good
+	redirect := func(w http.ResponseWriter, r *http.Request, id TagID) bool {
+		ps.Lock.RLock()
+		slug, ok := ps.TagDB.Redirects[id]
+		ps.Lock.RUnlock()
+		if ok {
+			http.Redirect(w, r, ps.Links(r).Tag(slug), http.StatusMovedPermanently)
 		}
-	})
+		return ok
+	}
 
-	// Get the tags page
-	http.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.ParseFiles(
+	// Write the tags page, with one of the tags expanded
+	tagspage := func(w http.ResponseWriter, r *http.Request, expand TagID) {
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles(
 			"views/base.html",
 			"views/nav.html",
 			"views/tags.html",
@@ -102,20 +906,31 @@ func HandleTags(ps *PostStats) {
 			return
 		}
 
-		r.ParseForm()
 		tags := make([]Tag, 0)
-		expand := r.Form.Get("expand")
 		search := strings.TrimSpace(r.Form.Get("Search"))
 
+		// Posts with several tags at once, searching goes back to the tag list
+		var combined *Combined
+		if !r.Form.Has("Search") {
+			for _, mode := range []string{"all", "any"} {
+				if r.Form.Has(mode) {
+					c := combine(ps.Links(r), mode, strings.Split(r.Form.Get(mode), ","))
+					combined = &c
+					break
+				}
+			}
+		}
+
 		ps.Lock.RLock()
-		for name, id := range ps.TagDB {
+		for name, id := range ps.TagDB.Tags {
 			tag, err := gettag(name)
 			if err != nil {
+				ps.Lock.RUnlock()
 				log.Println(err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			if string(id) != expand {
+			if id != expand {
 				tag.Posts = nil
 			}
 			if search == "" || fuzzy.RankMatchNormalizedFold(search, tag.Tag) != -1 {
@@ -124,15 +939,12 @@ func HandleTags(ps *PostStats) {
 		}
 		ps.Lock.RUnlock()
 
-		slices.SortFunc(tags, func(a Tag, b Tag) int {
-			if a.Num > b.Num {
-				return -1
-			} else if a.Num < b.Num {
-				return 1
-			} else {
-				return strings.Compare(a.Tag, b.Tag)
-			}
-		})
+		sorttags(tags)
+
+		// Searching shows every match on its own, otherwise nested tags go under their parents
+		if search == "" {
+			tags = tagtree(tags, expand)
+		}
 
 		var exec string
 		if r.Form.Has("Search") {
@@ -149,12 +961,400 @@ func HandleTags(ps *PostStats) {
 			Title        string
 			SearchTarget string
 			Tags         []Tag
+			Combined     *Combined
 		}{
 			Title:        "Sort by Tags",
 			SearchTarget: "main",
 			Tags:         tags,
+			Combined:     combined,
 		}); err != nil {
 			log.Println(err)
 		}
+	}
+
+	// Rename, merge or delete a tag on every post
+	http.HandleFunc("POST /admin/tags/{tag}/retag", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		htmx := r.Header.Get("HX-Request") == "true"
+		fail := func(msg string) {
+			if htmx {
+				fmt.Fprintf(w, "<em class=\"search-error\">%s</em>", template.HTMLEscapeString(msg))
+			} else {
+				http.Error(w, msg, http.StatusBadRequest)
+			}
+		}
+
+		ps.Lock.RLock()
+		from, ok := ps.TagDB.Name(TagID(r.PathValue("tag")))
+		ps.Lock.RUnlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// The rest gets checked by Retag
+		to := CleanTag(r.PostForm.Get("To"))
+		action := r.PostForm.Get("Action")
+		switch {
+		case action == "delete":
+			to = ""
+		case action != "rename" && action != "merge":
+			fail("Pick whether to rename, merge or delete the tag")
+			return
+		case to == "":
+			fail("Type the name of the tag to " + action + " into")
+			return
+		}
+
+		changed, err := ps.Retag(from, to, action == "merge")
+		if rerr, ok := err.(*RetagError); ok {
+			fail(rerr.Msg)
+			return
+		} else if err != nil {
+			log.Println(err)
+			fail(fmt.Sprintf("Changed %d posts before running into an error: %s", len(changed), err))
+			return
+		}
+		if to == "" {
+			log.Printf("Deleted the tag %s, changed %d posts\n", from, len(changed))
+		} else {
+			log.Printf("Used %s to %s the tag %s, changed %d posts\n", to, action, from, len(changed))
+		}
+
+		// The list of tags is different now, so show it again
+		if htmx {
+			w.Header().Set("HX-Refresh", "true")
+			fmt.Fprintf(w, "<em>Changed %d posts</em>", len(changed))
+		} else {
+			http.Redirect(w, r, "/admin/tags", http.StatusSeeOther)
+		}
 	})
+
+	// A post on a tag's page
+	type Summary struct {
+		ID      PostID
+		Title   string
+		Date    string
+		Summary string
+		Tags    []string
+	}
+
+	// Write the page of a tag, htmx only wants the next posts when scrolling
+	landing := func(w http.ResponseWriter, r *http.Request, name string, htmx bool) {
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles(
+			"views/base.html",
+			"views/nav.html",
+			"views/tag-page.html",
+		)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		loadfrom := 0
+		if i, err := strconv.Atoi(r.Form.Get("LoadFrom")); err == nil && i > 0 {
+			loadfrom = i
+		}
+
+		// Newest first, with nested tags under this one as chips
+		links := ps.Links(r)
+		ps.Lock.RLock()
+		tag := Tag{
+			Tag:  name,
+			ID:   string(ps.TagDB.Tags[name]),
+			Num:  len(ps.ByTag[name]),
+			Meta: ps.TagDB.Meta[name],
+		}
+		tagged := make(map[PostID]struct{}, tag.Num)
+		for _, id := range ps.ByTag[name] {
+			tagged[id] = struct{}{}
+		}
+		ids := make([]PostID, 0, tag.Num)
+		for _, id := range ps.ByDate {
+			if _, ok := tagged[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		children := make([]Chip, 0)
+		for child, posts := range ps.ByTag {
+			if parent, ok := ParentTag(child); ok && parent == name {
+				children = append(children, Chip{Tag: child, Num: len(posts), URL: links.Tag(ps.TagDB.GetTagID(child))})
+			}
+		}
+		parent := Chip{}
+		if p, ok := ParentTag(name); ok {
+			parent = Chip{Tag: p, Num: len(ps.ByTag[p]), URL: links.Tag(ps.TagDB.GetTagID(p))}
+		}
+		ps.Lock.RUnlock()
+		slices.SortFunc(children, func(a, b Chip) int { return strings.Compare(a.Tag, b.Tag) })
+
+		posts := make([]Summary, 0, tagPageSize)
+		for _, id := range ids[min(loadfrom, len(ids)):min(loadfrom+tagPageSize, len(ids))] {
+			post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id)))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			posts = append(posts, Summary{
+				ID:      id,
+				Title:   post.Info.Title,
+				Date:    FormatDate(post.Info.Date),
+				Summary: post.Summary,
+				Tags:    post.Info.Tags,
+			})
+		}
+
+		// Scrolling past the end doesn't return anything
+		if htmx && len(posts) == 0 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		page := func(from int) string {
+			if from <= 0 {
+				return links.Tag(TagID(tag.ID))
+			}
+			return fmt.Sprintf("%s?LoadFrom=%d", links.Tag(TagID(tag.ID)), from)
+		}
+		next, prev := "", ""
+		if loadfrom+tagPageSize < len(ids) {
+			next = page(loadfrom + tagPageSize)
+		}
+		if loadfrom > 0 {
+			prev = page(loadfrom - tagPageSize)
+		}
+
+		exec := "base"
+		if htmx {
+			exec = "tagposts"
+		}
+		if err := tmpl.ExecuteTemplate(w, exec, struct {
+			Title        string
+			SearchTarget string
+			Tag          Tag
+			Parent       Chip
+			Children     []Chip
+			Posts        []Summary
+			NextURL      string
+			PrevURL      string
+		}{
+			Title:        "Posts tagged " + name,
+			SearchTarget: "main",
+			Tag:          tag,
+			Parent:       parent,
+			Children:     children,
+			Posts:        posts,
+			NextURL:      next,
+			PrevURL:      prev,
+		}); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Get a specific tag, htmx only wants the html for the tag itself
+	http.HandleFunc("/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id := TagID(r.PathValue("tag"))
+		if redirect(w, r, id) {
+			return
+		}
+
+		ps.Lock.RLock()
+		name, ok := ps.TagDB.Name(id)
+		_, retired := ps.TagDB.Retired[id]
+		ps.Lock.RUnlock()
+		if retired && !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		htmx := r.Header.Get("HX-Request") == "true"
+		if r.Form.Has("Search") {
+			tagspage(w, r, id)
+			return
+		} else if !htmx || r.Form.Has("LoadFrom") {
+			landing(w, r, name, htmx)
+			return
+		}
+
+		tmpl, err := template.New("tag").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/tag.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		tag, err := gettag(name)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !r.Form.Has("showPosts") {
+			tag.Posts = nil
+		}
+
+		if err := tmpl.ExecuteTemplate(w, "tag", tag); err != nil {
+			log.Println(err)
+		}
+	})
+
+	// Everything the admin page needs to edit a tag
+	type AdminTag struct {
+		Tag
+		Aliases string // Comma separated
+		Error   string
+	}
+
+	admintag := func(name string) AdminTag {
+		ps.Lock.RLock()
+		defer ps.Lock.RUnlock()
+		return AdminTag{Tag: Tag{
+			Tag:  name,
+			ID:   string(ps.TagDB.Tags[name]),
+			Num:  len(ps.ByTag[name]),
+			Meta: ps.TagDB.Meta[name],
+		}, Aliases: strings.Join(ps.TagDB.AliasesOf(name), ", ")}
+	}
+
+	http.HandleFunc("/admin/tags", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			http.ServeFile(w, r, "views/admin-pass.html")
+			return
+		}
+
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/admin-tags.html", "views/nav.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		search := strings.TrimSpace(r.Form.Get("Search"))
+		ps.Lock.RLock()
+		names := slices.Sorted(maps.Keys(ps.TagDB.Tags))
+		ps.Lock.RUnlock()
+
+		tags := make([]AdminTag, 0, len(names))
+		for _, name := range names {
+			if search == "" || fuzzy.RankMatchNormalizedFold(search, name) != -1 {
+				tags = append(tags, admintag(name))
+			}
+		}
+
+		exec := "base"
+		if r.Form.Has("Search") {
+			exec = "tags"
+		}
+		if err := tmpl.ExecuteTemplate(w, exec, struct {
+			Title        string
+			SearchTarget string
+			Tags         []AdminTag
+		}{
+			Title:        "Tags",
+			SearchTarget: "#admin-tags",
+			Tags:         tags,
+		}); err != nil {
+			log.Println(err)
+		}
+	})
+
+	http.HandleFunc("POST /admin/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		tmpl, err := template.New("tag").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/admin-tags.html", "views/nav.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		ps.Lock.RLock()
+		name, ok := ps.TagDB.Name(TagID(r.PathValue("tag")))
+		ps.Lock.RUnlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Posts using the other names get listed under the tag right away
+		aliases := r.PostForm.Get("Aliases")
+		changed, err := ps.SetAliases(name, strings.Split(aliases, ","))
+		if _, ok := err.(*RetagError); !ok && err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if len(changed) > 0 {
+			log.Printf("Changed the other names of %s, moved %d posts\n", name, len(changed))
+		}
+
+		meta, merr := TagMeta{
+			Description: r.PostForm.Get("Description"),
+			Color:       r.PostForm.Get("Color"),
+			Icon:        r.PostForm.Get("Icon"),
+		}.Validate()
+		if err == nil {
+			err = merr
+		}
+		ps.Lock.Lock()
+		if merr == nil {
+			if meta == (TagMeta{}) {
+				delete(ps.TagDB.Meta, name)
+			} else {
+				ps.TagDB.Meta[name] = meta
+			}
+			if err := ps.TagDB.Save(ps.Cfg.PostDir); err != nil {
+				log.Println(err)
+				ps.Lock.Unlock()
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		ps.Lock.Unlock()
+
+		// Without htmx go back to the page
+		if r.Header.Get("HX-Request") != "true" {
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				http.Redirect(w, r, "/admin/tags#admin-tag-"+r.PathValue("tag"), http.StatusSeeOther)
+			}
+			return
+		}
+
+		// Other tags might be gone now, so show the list again
+		if len(changed) > 0 {
+			w.Header().Set("HX-Refresh", "true")
+		}
+
+		// Send back the form, keeping what was typed if it was wrong
+		tag := admintag(name)
+		if err != nil {
+			tag.Meta, tag.Aliases, tag.Error = meta, aliases, err.Error()
+		}
+		if err := tmpl.ExecuteTemplate(w, "tag", tag); err != nil {
+			log.Println(err)
+		}
+	})
+
+	// Get the tags page, htmx searches it with a POST
+	tags := func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		expand := TagID(r.Form.Get("expand"))
+		if expand != "" && redirect(w, r, expand) {
+			return
+		}
+		tagspage(w, r, expand)
+	}
+	http.HandleFunc("GET /tags", tags)
+	http.HandleFunc("POST /tags", tags)
 }
@@ -0,0 +1,909 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCombinedTags(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc":    `Title = "Garbage collection"` + "\n" + `Date = 2024-03-01T00:00:00Z` + "\n" + `Tags = ["go", "memory"]`,
+		"rust":  `Title = "Ownership"` + "\n" + `Date = 2024-05-01T00:00:00Z` + "\n" + `Tags = ["rust", "memory"]`,
+		"chans": `Title = "Channels"` + "\n" + `Date = 2024-01-01T00:00:00Z` + "\n" + `Tags = ["go"]`,
+		"paris": `Title = "Paris"` + "\n" + `Date = 2023-07-01T00:00:00Z` + "\n" + `Tags = ["travel"]`,
+	})
+	mux := testMux(t)
+	HandleTags(ps, new(Session))
+	t.Chdir("..")
+
+	tests := []struct {
+		name   string
+		query  string
+		has    []string
+		hasNot []string
+		order  []string
+	}{
+		{
+			name:   "all",
+			query:  "all=go,memory",
+			has:    []string{"Posts with all of these tags", ">Garbage collection</a>", `href="http://localhost/tags?any=go%2Cmemory"`},
+			hasNot: []string{">Ownership</a>", ">Channels</a>"},
+		},
+		{
+			name:   "any, newest first",
+			query:  "any=rust,travel",
+			has:    []string{"Posts with any of these tags"},
+			order:  []string{">Ownership</a>", ">Paris</a>"},
+			hasNot: []string{">Garbage collection</a>"},
+		},
+		{
+			name:  "names ignore case",
+			query: "all=GO",
+			has:   []string{">Garbage collection</a>", ">Channels</a>"},
+		},
+		{
+			name:  "removing a tag and narrowing down",
+			query: "all=go",
+			has: []string{
+				`href="http://localhost/tags" title="Remove go"`,
+				`<a href="http://localhost/tags?all=go%2Cmemory">#️⃣memory</a> <em>(1)</em>`,
+			},
+		},
+		{
+			name:   "tags that don't exist",
+			query:  "all=go,nope",
+			has:    []string{"<s>nope</s>", "No posts have all of these tags"},
+			hasNot: []string{">Channels</a>"},
+		},
+		{
+			name:  "searching shows the normal list",
+			query: "all=go&Search=",
+			has:   []string{"Search Posts by Tag"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/tags?"+test.query, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d", w.Code)
+			}
+			for _, want := range test.has {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("page doesn't have %s:\n%s", want, w.Body)
+				}
+			}
+			last := -1
+			for _, want := range test.order {
+				i := strings.Index(w.Body.String(), want)
+				if i <= last {
+					t.Errorf("%s isn't after the ones before it:\n%s", want, w.Body)
+				}
+				last = i
+			}
+			for _, want := range test.hasNot {
+				if strings.Contains(w.Body.String(), want) {
+					t.Errorf("page has %s", want)
+				}
+			}
+		})
+	}
+}
+
+func TestTagSlug(t *testing.T) {
+	tests := []struct {
+		name string
+		slug TagID
+	}{
+		{"Go", "go"},
+		{"Go Generics", "go-generics"},
+		{"  spaced   out  ", "spaced-out"},
+		{"lang/go", "lang-go"},
+		{"C++", "c"},
+		{"v1.2", "v1-2"},
+		{"Café au lait", "cafe-au-lait"},
+		{"Ünïcödé", "unicode"},
+		{"ﬁsh", "fish"},
+		{"日本語", "日本語"},
+		{"!!!", "tag"},
+		{"", "tag"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if slug := TagSlug(test.name); slug != test.slug {
+				t.Errorf("got %q, want %q", slug, test.slug)
+			}
+		})
+	}
+}
+
+func TestGetTagID(t *testing.T) {
+	db := newTagDB()
+
+	steps := []struct {
+		name   string
+		retire bool // Retire the tag instead of getting its slug
+		slug   TagID
+	}{
+		{name: "C", slug: "c"},
+		{name: "C#", slug: "c-2"},
+		{name: "c", slug: "c"},
+		{name: "C#", slug: "c-2"},
+		{name: "C#", retire: true},
+		// The dead tag's slug doesn't get handed out to some other tag
+		{name: "C++", slug: "c-3"},
+		// But the tag gets it back when it's used again
+		{name: "c#", slug: "c-2"},
+		{name: "Go Generics", slug: "go-generics"},
+		{name: "go generics", slug: "go-generics"},
+	}
+
+	for _, step := range steps {
+		if step.retire {
+			db.retire(step.name)
+			if _, ok := db.Tags[step.name]; ok {
+				t.Fatalf("%s wasn't retired", step.name)
+			}
+			continue
+		}
+		if slug := db.GetTagID(step.name); slug != step.slug {
+			t.Fatalf("slug of %s is %q, want %q", step.name, slug, step.slug)
+		}
+	}
+	if len(db.Retired) != 0 {
+		t.Errorf("slugs that got used again are still retired: %v", db.Retired)
+	}
+}
+
+func TestFindTagID(t *testing.T) {
+	db := newTagDB()
+	db.GetTagID("C")
+	db.GetTagID("C#")
+	db.Aliases["csharp"] = "C#"
+
+	tests := []struct {
+		name string
+		slug TagID
+	}{
+		{"C", "c"},
+		{"C#", "c-2"},
+		{"c#", "c-2"},
+		{"csharp", "c-2"},
+		{"Go Generics", "go-generics"},
+	}
+	for _, test := range tests {
+		if slug := db.FindTagID(test.name); slug != test.slug {
+			t.Errorf("slug of %s is %q, want %q", test.name, slug, test.slug)
+		}
+	}
+	if len(db.Tags) != 2 {
+		t.Errorf("looking up slugs added tags: %v", db.Tags)
+	}
+}
+
+func TestLoadTagDBNumbersSlugsInOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		tagsfile  string // Nothing to start from without one
+		tags      map[string]TagID
+		redirects map[TagID]TagID
+	}{
+		{
+			name: "made from the posts",
+			tags: map[string]TagID{"C": "c", "C#": "c-2", "C++": "c-3", "lang": "lang", "lang/Go": "lang-go"},
+		},
+		{
+			name:      "switched from random ids",
+			tagsfile:  "\"C++\" = \"aaa\"\n\"C#\" = \"bbb\"\nC = \"ccc\"\n",
+			tags:      map[string]TagID{"C": "c", "C#": "c-2", "C++": "c-3"},
+			redirects: map[TagID]TagID{"ccc": "c", "bbb": "c-2", "aaa": "c-3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writePostInfo(t, dir, "one", `Title = "One"`+"\n"+`Tags = ["C++", "lang/Go"]`)
+			writePostInfo(t, dir, "two", `Title = "Two"`+"\n"+`Tags = ["C#"]`)
+			writePostInfo(t, dir, "three", `Title = "Three"`+"\n"+`Tags = ["C"]`)
+			writePostInfo(t, dir, "page", `Title = "About"`+"\n"+`Page = "about"`+"\n"+`Tags = ["About"]`)
+			if test.tagsfile != "" {
+				if err := os.WriteFile(filepath.Join(dir, "tags.toml"), []byte(test.tagsfile), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err := LoadTagDB(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(db.Tags, test.tags) {
+				t.Errorf("tags are %v, want %v", db.Tags, test.tags)
+			}
+			if test.redirects != nil && !maps.Equal(db.Redirects, test.redirects) {
+				t.Errorf("redirects are %v, want %v", db.Redirects, test.redirects)
+			}
+
+			// Loading it again gives the same thing back
+			again, err := LoadTagDB(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(again.Tags, db.Tags) {
+				t.Errorf("tags are %v after loading again, want %v", again.Tags, db.Tags)
+			}
+		})
+	}
+}
+
+func TestOldTagIDsRedirect(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc": `Title = "Garbage collection"` + "\n" + `Tags = ["Go Generics"]`,
+	})
+	ps.TagDB.Redirects["abcdef"] = "go-generics"
+	mux := testMux(t)
+	HandleTags(ps, new(Session))
+
+	for _, target := range []string{"/tags?expand=abcdef", "/tags/abcdef"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+target, nil))
+		if want := "http://localhost/tags/go-generics"; w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("%s went to %d %s, want %s", target, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+}
+
+func TestRetiredTagIsGone(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc": `Title = "Garbage collection"` + "\n" + `Tags = ["Go"]`,
+	})
+	ps.TagDB.retire("Go")
+	mux := testMux(t)
+	HandleTags(ps, new(Session))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/tags/go", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("got %d for a retired tag", w.Code)
+	}
+}
+
+func TestTagMetaValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		meta TagMeta
+		want TagMeta
+		ok   bool
+	}{
+		{"nothing", TagMeta{}, TagMeta{}, true},
+		{"trims", TagMeta{Description: " Go *things* \n", Color: " #3b82f6 ", Icon: " 🐹 "}, TagMeta{Description: "Go *things*", Color: "#3b82f6", Icon: "🐹"}, true},
+		{"short color", TagMeta{Color: "#FFF"}, TagMeta{Color: "#FFF"}, true},
+		{"named color", TagMeta{Color: "red"}, TagMeta{}, false},
+		{"css injection", TagMeta{Color: "#fff;background:url(x)"}, TagMeta{}, false},
+		{"image icon", TagMeta{Icon: "/static/go.png"}, TagMeta{Icon: "/static/go.png"}, true},
+		{"long icon", TagMeta{Icon: "way too long"}, TagMeta{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := test.meta.Validate()
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v", err)
+			}
+			if test.ok && meta != test.want {
+				t.Errorf("got %+v, want %+v", meta, test.want)
+			}
+		})
+	}
+}
+
+func TestTagMetaHTML(t *testing.T) {
+	tests := []struct {
+		meta TagMeta
+		icon string
+	}{
+		{TagMeta{}, "#️⃣"},
+		{TagMeta{Icon: "<b>"}, "&lt;b&gt;"},
+		{TagMeta{Icon: `/static/"go".png`}, `<img class="tag-icon" src="/static/&#34;go&#34;.png" alt="" />`},
+	}
+	for _, test := range tests {
+		if icon := string(test.meta.IconHTML()); icon != test.icon {
+			t.Errorf("icon of %+v is %s, want %s", test.meta, icon, test.icon)
+		}
+	}
+	if html := string(TagMeta{Description: "Posts about *Go*"}.HTML()); html != "<p>Posts about <em>Go</em></p>\n" {
+		t.Errorf("description is %q", html)
+	}
+}
+
+func TestEditTagMeta(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc": `Title = "Garbage collection"` + "\n" + `Tags = ["Go"]`,
+	})
+	ps.Cfg.Password = "hunter2"
+	session := NewSession()
+	mux := testMux(t)
+	HandleTags(ps, &session)
+	t.Chdir("..")
+
+	edit := func(tag string, form url.Values, cookie bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://localhost/admin/tags/"+tag, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie {
+			r.AddCookie(session.GetCookie())
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	meta := url.Values{"Description": {"Posts about *Go*"}, "Color": {"#00add8"}, "Icon": {"🐹"}}
+
+	if w := edit("go", meta, false); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d without logging in", w.Code)
+	}
+	if w := edit("nope", meta, true); w.Code != http.StatusNotFound {
+		t.Errorf("got %d for a tag that doesn't exist", w.Code)
+	}
+	if w := edit("go", url.Values{"Color": {"red"}}, true); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a bad color", w.Code)
+	}
+	if w := edit("go", meta, true); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin/tags#admin-tag-go" {
+		t.Errorf("got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// It gets saved with the tags
+	db, err := LoadTagDB(ps.Cfg.PostDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (TagMeta{Description: "Posts about *Go*", Color: "#00add8", Icon: "🐹"}); db.Meta["Go"] != want {
+		t.Errorf("saved %+v, want %+v", db.Meta["Go"], want)
+	}
+
+	// With htmx the form comes back, with what was typed when it's wrong
+	r := httptest.NewRequest("POST", "http://localhost/admin/tags/go", strings.NewReader("Color=blue"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("HX-Request", "true")
+	r.AddCookie(session.GetCookie())
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `value="blue"`) || !strings.Contains(w.Body.String(), "Colors have to look like") {
+		t.Errorf("form is:\n%s", w.Body)
+	}
+
+	// Clearing everything removes the tag's metadata
+	if w := edit("go", url.Values{}, true); w.Code != http.StatusSeeOther {
+		t.Errorf("got %d", w.Code)
+	}
+	if _, ok := ps.TagDB.Meta["Go"]; ok {
+		t.Error("metadata is still there after clearing it")
+	}
+}
+
+func TestNestedTags(t *testing.T) {
+	if got := CleanTag(" lang / Go //generics "); got != "lang/Go/generics" {
+		t.Errorf("cleaned up to %q", got)
+	}
+	if parent, ok := ParentTag("lang/go/generics"); !ok || parent != "lang/go" {
+		t.Errorf("parent is %q", parent)
+	}
+	if _, ok := ParentTag("lang"); ok {
+		t.Error("lang has a parent")
+	}
+
+	under := []struct {
+		name, parent string
+		want         bool
+	}{
+		{"lang/go", "lang", true},
+		{"Lang/Go/generics", "lang/go", true},
+		{"lang", "lang", true},
+		{"language", "lang", false},
+		{"lang", "lang/go", false},
+	}
+	for _, test := range under {
+		if got := IsTagUnder(test.name, test.parent); got != test.want {
+			t.Errorf("%s under %s is %v", test.name, test.parent, got)
+		}
+	}
+
+	got := WithParentTags([]string{"lang/go/generics", "lang/rust", "travel"})
+	if want := []string{"lang/go/generics", "lang/go", "lang", "lang/rust", "travel"}; !slices.Equal(got, want) {
+		t.Errorf("with parents is %v, want %v", got, want)
+	}
+}
+
+func TestNestedTagsPage(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc":    `Title = "Garbage collection"` + "\n" + `Tags = ["lang/go"]`,
+		"rust":  `Title = "Ownership"` + "\n" + `Tags = ["lang / rust"]`,
+		"paris": `Title = "Paris"` + "\n" + `Tags = ["travel"]`,
+	})
+
+	// Posts count towards the tags they're under
+	if got := slices.Sorted(slices.Values(ps.ByTag["lang"])); !slices.Equal(got, []PostID{"gc", "rust"}) {
+		t.Errorf("posts under lang are %v", got)
+	}
+	if got, _ := ps.SearchAndRank("tag:lang"); len(got) != 2 {
+		t.Errorf("searching tag:lang found %v", got)
+	}
+
+	mux := testMux(t)
+	HandleTags(ps, new(Session))
+	t.Chdir("..")
+
+	get := func(target string) string {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost"+target, nil))
+		return w.Body.String()
+	}
+
+	page := get("/tags")
+	if !strings.Contains(page, `lang</a> <em>(2)</em>`) || !strings.Contains(page, "<summary>2 under lang</summary>") {
+		t.Errorf("lang isn't a parent with both posts:\n%s", page)
+	}
+	if strings.Contains(page, "<details open>") {
+		t.Error("nested tags are open without expanding one")
+	}
+	if page := get("/tags?expand=lang-go"); !strings.Contains(page, "<details open>") {
+		t.Errorf("expanding a nested tag doesn't open its parent:\n%s", page)
+	}
+}
+
+func TestRetag(t *testing.T) {
+	tests := []struct {
+		name      string
+		from, to  string
+		merge     bool
+		err       bool
+		files     map[PostID][]string // Tags of the posts that changed, as saved
+		tags      []string            // Every tag afterwards
+		redirects map[TagID]TagID     // Old slugs that have to go somewhere now
+		meta      string              // Tag that has Go's metadata afterwards
+		alias     string              // Tag that golang is another name for afterwards
+	}{
+		{
+			name:      "rename",
+			from:      "Go",
+			to:        "lang/go",
+			files:     map[PostID][]string{"a": {"lang/go"}, "b": {"lang/go/generics", "Rust"}},
+			tags:      []string{"Rust", "Travel", "lang", "lang/go", "lang/go/generics"},
+			redirects: map[TagID]TagID{"go": "lang-go", "go-generics": "lang-go-generics"},
+			meta:      "lang/go",
+			alias:     "lang/go",
+		},
+		{
+			name:  "only the case changes",
+			from:  "Go",
+			to:    "GO",
+			files: map[PostID][]string{"a": {"GO"}, "b": {"GO/generics", "Rust"}},
+			tags:  []string{"GO", "GO/generics", "Rust", "Travel"},
+			meta:  "GO",
+			alias: "GO",
+		},
+		{
+			name:      "merge",
+			from:      "Rust",
+			to:        "go",
+			merge:     true,
+			files:     map[PostID][]string{"b": {"go/generics", "go"}, "c": {"go"}},
+			tags:      []string{"Go", "Go/generics", "Travel"},
+			redirects: map[TagID]TagID{"rust": "go"},
+			meta:      "Go",
+			alias:     "Go",
+		},
+		{
+			name:  "delete",
+			from:  "Travel",
+			files: map[PostID][]string{"d": {}},
+			tags:  []string{"Go", "Go/generics", "Rust"},
+			meta:  "Go",
+			alias: "Go",
+		},
+		{name: "rename to a tag that exists", from: "Go", to: "rust", err: true},
+		{name: "merge into a tag that doesn't exist", from: "Go", to: "Zig", merge: true, err: true},
+		{name: "under itself", from: "Go", to: "go/lang", err: true},
+		{name: "same name", from: "Go", to: "Go", err: true},
+		{name: "tag that isn't there", from: "Zig", to: "Zag", err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps := testBlog(t, map[PostID]string{
+				"a": `Title = "A"` + "\n" + `Tags = ["Go"]`,
+				"b": `Title = "B"` + "\n" + `Tags = ["go/generics", "Rust"]`,
+				"c": `Title = "C"` + "\n" + `Tags = ["Rust"]`,
+				"d": `Title = "D"` + "\n" + `Tags = ["Travel"]`,
+			})
+			ps.TagDB.Aliases["golang"] = "Go"
+			ps.TagDB.Meta["Go"] = TagMeta{Color: "#00add8"}
+
+			changed, err := ps.Retag(test.from, test.to, test.merge)
+			if test.err {
+				if _, ok := err.(*RetagError); !ok {
+					t.Fatalf("got %v, want a *RetagError", err)
+				}
+				if len(changed) != 0 {
+					t.Errorf("changed %v even though it failed", changed)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			slices.Sort(changed)
+			if want := slices.Sorted(maps.Keys(test.files)); !slices.Equal(changed, want) {
+				t.Errorf("changed %v, want %v", changed, want)
+			}
+			for id, want := range test.files {
+				info, err := LoadPostInfo(filepath.Join(ps.Cfg.PostDir, string(id)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(info.Tags, want) {
+					t.Errorf("post %s has the tags %q, want %q", id, info.Tags, want)
+				}
+			}
+
+			if tags := slices.Sorted(maps.Keys(ps.ByTag)); !slices.Equal(tags, test.tags) {
+				t.Errorf("tags are %q, want %q", tags, test.tags)
+			}
+			for old, want := range test.redirects {
+				if got := ps.TagDB.Redirects[old]; got != want {
+					t.Errorf("%s redirects to %q, want %q", old, got, want)
+				}
+			}
+			if meta := ps.TagDB.Meta[test.meta]; meta.Color != "#00add8" {
+				t.Errorf("%s doesn't have the metadata, there is %v", test.meta, ps.TagDB.Meta)
+			}
+			if tag := ps.TagDB.Canonical("golang"); tag != test.alias {
+				t.Errorf("golang is another name for %s, want %s", tag, test.alias)
+			}
+
+			// The tags are the same once it all gets loaded again
+			again, err := NewPostStats(ps.Cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tags := slices.Sorted(maps.Keys(again.ByTag)); !slices.Equal(tags, test.tags) {
+				t.Errorf("tags are %q after loading again, want %q", tags, test.tags)
+			}
+		})
+	}
+}
+
+func TestRetagHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		tag    TagID
+		action string
+		to     string
+		code   int
+	}{
+		{"rename", "go", "rename", "lang/go", http.StatusSeeOther},
+		{"only the case changes", "go", "rename", "GO", http.StatusSeeOther},
+		{"merge", "rust", "merge", "go", http.StatusSeeOther},
+		{"delete", "rust", "delete", "", http.StatusSeeOther},
+		{"no action", "go", "", "lang/go", http.StatusBadRequest},
+		{"no name", "go", "rename", " / ", http.StatusBadRequest},
+		{"rename to a tag that exists", "go", "rename", "Rust", http.StatusBadRequest},
+		{"merge into a tag that doesn't exist", "go", "merge", "Zig", http.StatusBadRequest},
+		{"under itself", "go", "rename", "Go/lang", http.StatusBadRequest},
+		{"tag that isn't there", "zig", "rename", "Zag", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ps := testBlog(t, map[PostID]string{
+				"a": `Title = "A"` + "\n" + `Tags = ["Go"]`,
+				"b": `Title = "B"` + "\n" + `Tags = ["Rust"]`,
+			})
+			session := NewSession()
+			mux := testMux(t)
+			HandleTags(ps, &session)
+
+			form := url.Values{"Action": {test.action}, "To": {test.to}}
+			r := httptest.NewRequest("POST", "http://localhost/admin/tags/"+string(test.tag)+"/retag", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(session.GetCookie())
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Fatalf("got %d, want %d: %s", w.Code, test.code, w.Body)
+			}
+
+			// Nothing changes when it's refused
+			if test.code != http.StatusSeeOther {
+				if tags := slices.Sorted(maps.Keys(ps.ByTag)); !slices.Equal(tags, []string{"Go", "Rust"}) {
+					t.Errorf("tags are %q after being refused", tags)
+				}
+			}
+		})
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	db := newTagDB()
+	db.Tags = map[string]TagID{
+		"Go":      "go",
+		"go":      "go-2", // Left over from before tags ignored case
+		"lang":    "lang",
+		"lang/Go": "lang-go",
+		"Rust":    "rust",
+	}
+	db.Aliases = map[string]string{
+		"golang":    "Go",
+		"Rust Lang": "rust",
+		"languages": "lang",
+	}
+
+	tests := []struct {
+		name  string
+		canon string
+	}{
+		{"Go", "Go"},
+		{"go", "Go"},
+		{" GO ", "Go"},
+		{"golang", "Go"},
+		{"GoLang", "Go"},
+		{"golang/generics", "Go/generics"},
+		{"rust lang", "Rust"},
+		{"lang/go", "lang/Go"},
+		{"languages/go", "lang/Go"},
+		{"lang // go", "lang/Go"},
+		{"Zig", "Zig"},
+		{"", ""},
+		{" / ", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if canon := db.Canonical(test.name); canon != test.canon {
+				t.Errorf("got %q, want %q", canon, test.canon)
+			}
+		})
+	}
+}
+
+func TestTagSpellings(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"a": `Title = "A"` + "\n" + `Tags = ["Go"]`,
+		"b": `Title = "B"` + "\n" + `Tags = ["GO", "go/Web"]`,
+		"c": `Title = "C"` + "\n" + `Tags = ["golang"]`,
+	})
+	ps.TagDB.Aliases["golang"] = "go"
+	if err := ps.TagDB.Save(ps.Cfg.PostDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every spelling and alias goes under the one that sorts first
+	ps, err := NewPostStats(ps.Cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byTag := make(map[string][]PostID)
+	for tag, ids := range ps.ByTag {
+		byTag[tag] = slices.Sorted(slices.Values(ids))
+	}
+	if want := map[string][]PostID{"GO": {"a", "b", "c"}, "GO/Web": {"b"}}; !maps.EqualFunc(byTag, want, slices.Equal) {
+		t.Errorf("tags are %v, want %v", byTag, want)
+	}
+	if got, _ := ps.SearchAndRank("tag:golang"); len(got) != 3 {
+		t.Errorf("searching for the alias found %v", got)
+	}
+
+	// The posts keep their own spelling
+	info, err := LoadPostInfo(filepath.Join(ps.Cfg.PostDir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(info.Tags, []string{"GO", "go/Web"}) {
+		t.Errorf("post b has the tags %v", info.Tags)
+	}
+}
+
+func TestNearDuplicates(t *testing.T) {
+	db := newTagDB()
+	db.Tags = map[string]TagID{"test": "test", "Go Generics": "go-generics", "javascript": "javascript"}
+	db.Aliases = map[string]string{"golang": "Go"}
+
+	got := db.NearDuplicates([]string{"tests", "go-generics", "TEST", "golang", "rust", "javascrip"})
+	want := []string{
+		`The new tag "go-generics" looks a lot like the tag "Go Generics"`,
+		`The new tag "javascrip" looks a lot like the tag "javascript"`,
+		`The new tag "tests" looks a lot like the tag "test"`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSetAliases(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"a": `Title = "A"` + "\n" + `Tags = ["Go"]`,
+		"b": `Title = "B"` + "\n" + `Tags = ["golang"]`,
+		"c": `Title = "C"` + "\n" + `Tags = ["golang/web"]`,
+		"d": `Title = "D"` + "\n" + `Tags = ["Rust"]`,
+	})
+	golang := ps.TagDB.Tags["golang"]
+
+	steps := []struct {
+		name    string
+		tag     string
+		aliases []string
+		err     bool
+		changed []PostID
+		byTag   map[string][]PostID
+	}{
+		{
+			name:    "posts move to the tag",
+			tag:     "Go",
+			aliases: []string{" golang ", ""},
+			changed: []PostID{"b", "c"},
+			byTag:   map[string][]PostID{"Go": {"a", "b", "c"}, "Go/web": {"c"}, "Rust": {"d"}},
+		},
+		{
+			name:    "setting the same ones again changes nothing",
+			tag:     "Go",
+			aliases: []string{"golang"},
+			changed: []PostID{},
+			byTag:   map[string][]PostID{"Go": {"a", "b", "c"}, "Go/web": {"c"}, "Rust": {"d"}},
+		},
+		{
+			name:    "under itself",
+			tag:     "Go",
+			aliases: []string{"go/lang"},
+			err:     true,
+		},
+		{
+			name:    "tag that isn't there",
+			tag:     "Zig",
+			aliases: []string{"ziglang"},
+			err:     true,
+		},
+		{
+			name:    "posts go back when the alias is taken away",
+			tag:     "Go",
+			aliases: []string{},
+			changed: []PostID{"b", "c"},
+			byTag:   map[string][]PostID{"Go": {"a"}, "golang": {"b", "c"}, "golang/web": {"c"}, "Rust": {"d"}},
+		},
+	}
+
+	for _, step := range steps {
+		changed, err := ps.SetAliases(step.tag, step.aliases)
+		if step.err {
+			if _, ok := err.(*RetagError); !ok {
+				t.Fatalf("%s: got %v, want a *RetagError", step.name, err)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		slices.Sort(changed)
+		if !slices.Equal(changed, step.changed) {
+			t.Errorf("%s: changed %v, want %v", step.name, changed, step.changed)
+		}
+		ps.Lock.RLock()
+		byTag := make(map[string][]PostID)
+		for tag, ids := range ps.ByTag {
+			byTag[tag] = slices.Sorted(slices.Values(ids))
+		}
+		ps.Lock.RUnlock()
+		if !maps.EqualFunc(byTag, step.byTag, slices.Equal) {
+			t.Errorf("%s: tags are %v, want %v", step.name, byTag, step.byTag)
+		}
+
+		// Links to the old tag go to the new one while it's an alias
+		_, aliased := ps.TagDB.Redirects[golang]
+		if want := len(step.aliases) > 0; aliased != want {
+			t.Errorf("%s: old slug redirects = %v, want %v", step.name, aliased, want)
+		}
+	}
+
+	// The posts keep the name they were written with
+	info, err := LoadPostInfo(filepath.Join(ps.Cfg.PostDir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(info.Tags, []string{"golang"}) {
+		t.Errorf("post b has the tags %v", info.Tags)
+	}
+
+	// And the aliases survive the tags being saved again
+	if _, err := ps.SetAliases("Go", []string{"golang"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadTagDB(ps.Cfg.PostDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliases := db.AliasesOf("Go"); !slices.Equal(aliases, []string{"golang"}) {
+		t.Errorf("aliases of Go are %v after loading again", aliases)
+	}
+}
+
+func TestTagLandingPage(t *testing.T) {
+	posts := map[PostID]string{
+		"rust": `Title = "Ownership"` + "\n" + `Date = 2024-01-01T00:00:00Z` + "\n" + `Tags = ["lang/rust"]`,
+	}
+	for i := 1; i <= 12; i++ {
+		posts[PostID(fmt.Sprintf("go%02d", i))] = fmt.Sprintf("Title = \"Go %02d\"\nDate = 2023-%02d-01T00:00:00Z\nTags = [\"lang/go\"]", i, i)
+	}
+	ps := testBlog(t, posts)
+	mux := testMux(t)
+	HandleTags(ps, new(Session))
+	t.Chdir("..")
+
+	get := func(target string, htmx bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://localhost"+target, nil)
+		if htmx {
+			r.Header.Set("HX-Request", "true")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	// Newest first, a page at a time
+	page := get("/tags/lang-go", false).Body.String()
+	for _, want := range []string{
+		"<title>Posts tagged lang/go</title>",
+		`<a href="http://localhost/tags/lang">⬆️ lang</a> <em>(13)</em>`,
+		`hx-get="http://localhost/tags/lang-go?LoadFrom=10"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page doesn't have %s:\n%s", want, page)
+		}
+	}
+	if !strings.Contains(page, ">Go 12</a>") || !strings.Contains(page, ">Go 03</a>") || strings.Contains(page, ">Go 02</a>") {
+		t.Errorf("first page has the wrong posts:\n%s", page)
+	}
+	if strings.Index(page, ">Go 12</a>") > strings.Index(page, ">Go 11</a>") {
+		t.Error("posts aren't newest first")
+	}
+
+	// Scrolling only gets the next posts
+	more := get("/tags/lang-go?LoadFrom=10", true).Body.String()
+	if strings.Contains(more, "<html") || !strings.Contains(more, ">Go 02</a>") || !strings.Contains(more, ">Go 01</a>") ||
+		strings.Contains(more, ">Go 03</a>") || strings.Contains(more, "LoadFrom") {
+		t.Errorf("next posts are:\n%s", more)
+	}
+	if w := get("/tags/lang-go?LoadFrom=20", true); w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("scrolling past the end got %d: %s", w.Code, w.Body)
+	}
+
+	// Without htmx there are links both ways
+	if page := get("/tags/lang-go?LoadFrom=10", false).Body.String(); !strings.Contains(page, `<a href="http://localhost/tags/lang-go">⬆️ Newer posts</a>`) {
+		t.Errorf("second page has no way back:\n%s", page)
+	}
+
+	// Parents list what's under them
+	page = get("/tags/lang", false).Body.String()
+	for _, want := range []string{
+		`<a href="http://localhost/tags/lang-go">#️⃣lang/go</a> <em>(12)</em>`,
+		`<a href="http://localhost/tags/lang-rust">#️⃣lang/rust</a> <em>(1)</em>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page doesn't have %s:\n%s", want, page)
+		}
+	}
+
+	if w := get("/tags/zig", false); w.Code != http.StatusNotFound {
+		t.Errorf("tag that doesn't exist got %d", w.Code)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Builds links to pages on the site. Base is the scheme and host that the links
+// point to, like https://blog.eklipsed.net
+type Links struct {
+	Base string
+}
+
+// Gets the scheme that the request came in on and whether it's actually known.
+// The proxy's header is only believed when it's trusted, anyone can send it
+func requestScheme(r *http.Request, trustProxy bool) (string, bool) {
+	if r.TLS != nil {
+		return "https", true
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); trustProxy && (proto == "http" || proto == "https") {
+		return proto, true
+	}
+	return "http", false
+}
+
+// Gets the scheme and host that the request came in on
+func requestOrigin(r *http.Request, trustProxy bool) string {
+	scheme, _ := requestScheme(r, trustProxy)
+	return scheme + "://" + r.Host
+}
+
+// Gets the links for a request, the configured base url is used if there is one
+func (ps *PostStats) Links(r *http.Request) Links {
+	if ps.Cfg.BaseURL != "" {
+		return Links{Base: ps.Cfg.BaseURL}
+	}
+	return Links{Base: requestOrigin(r, ps.Cfg.TrustProxy)}
+}
+
+// Makes links that are relative to the site root absolute
+func (l Links) Abs(link string) string {
+	if strings.HasPrefix(link, "/") {
+		return l.Base + link
+	}
+	return link
+}
+
+func (l Links) Home() string {
+	return l.Base + "/"
+}
+
+func (l Links) Post(id PostID) string {
+	return l.Base + "/post/" + string(id)
+}
+
+func (l Links) Page(slug string) string {
+	return l.Base + "/" + slug
+}
+
+func (l Links) Tag(id TagID) string {
+	return l.Base + "/tags/" + string(id)
+}
+
+// Page listing the posts with all or any of some tags, mode is either "all" or "any"
+func (l Links) TagSet(mode string, names []string) string {
+	if len(names) == 0 {
+		return l.Base + "/tags"
+	}
+	return l.Base + "/tags?" + mode + "=" + url.QueryEscape(strings.Join(names, ","))
+}
+
+func (l Links) Attachment(id PostID, file string) string {
+	return l.Base + attachmentPath(id, file)
+}
+
+// Path that attachments of a post are served at
+func attachmentPath(id PostID, file string) string {
+	return path.Join("/attachments", string(id), file)
+}
+
+// The one url that a page should be known by
+func (l Links) Canonical(r *http.Request) string {
+	if r.URL.Path == "/home" {
+		return l.Home()
+	}
+	return l.Base + r.URL.Path
+}
+
+// Functions that every template on the site can use
+func (ps *PostStats) TemplateFuncs(r *http.Request) template.FuncMap {
+	links := ps.Links(r)
+	return template.FuncMap{
+		"formatTime": FormatDate,
+		"mentions": func(id PostID) []Webmention {
+			return ps.Mentions.Get(id, true)
+		},
+		"baseURL": func() string {
+			return links.Base
+		},
+		"canonicalURL": func() string {
+			return links.Canonical(r)
+		},
+		"postURL": func(id any) string {
+			return links.Post(PostID(fmt.Sprint(id)))
+		},
+		"tagURL": func(name string) string {
+			ps.Lock.RLock()
+			defer ps.Lock.RUnlock()
+			return links.Tag(ps.TagDB.FindTagID(name))
+		},
+		"attachmentURL": func(id PostID, file string) string {
+			return links.Attachment(id, file)
+		},
+		"tagIcon": func(name string) template.HTML {
+			ps.Lock.RLock()
+			meta := ps.TagDB.MetaFor(name)
+			ps.Lock.RUnlock()
+			return meta.IconHTML()
+		},
+		"tagColor": func(name string) string {
+			ps.Lock.RLock()
+			defer ps.Lock.RUnlock()
+			return ps.TagDB.MetaFor(name).Color
+		},
+		"related": func(id PostID) []RelatedPost {
+			return ps.Related.Get(id)
+		},
+		"pages": func() []NavPage {
+			return ps.NavPages(links)
+		},
+		"newsletter": func() bool {
+			return ps.Cfg.SMTPAddr != ""
+		},
+	}
+}
+
+// Redirects requests that didn't come in on the configured base url
+func CanonicalRedirect(cfg *BlogConfig, next http.Handler) http.Handler {
+	base, err := url.Parse(cfg.BaseURL)
+	if cfg.BaseURL == "" || err != nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Behind a proxy that doesn't say what scheme it got, plain http is all
+		// that can be seen. Redirecting then would never end
+		scheme, known := requestScheme(r, cfg.TrustProxy)
+		if strings.EqualFold(r.Host, base.Host) && (!known || scheme == base.Scheme) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Keep the method and body of anything that isn't just reading a page
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, cfg.BaseURL+r.URL.RequestURI(), code)
+	})
+}
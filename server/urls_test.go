@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLinks(t *testing.T) {
+	links := Links{Base: "https://blog.example"}
+	tests := []struct {
+		got, want string
+	}{
+		{links.Home(), "https://blog.example/"},
+		{links.Post("abc"), "https://blog.example/post/abc"},
+		{links.Tag("go-generics"), "https://blog.example/tags/go-generics"},
+		{links.Attachment("abc", "cat.png"), "https://blog.example/attachments/abc/cat.png"},
+		{links.Abs("/about"), "https://blog.example/about"},
+		{links.Abs("https://elsewhere.example/about"), "https://elsewhere.example/about"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("got %s, want %s", test.got, test.want)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"/home":     "https://blog.example/",
+		"/":         "https://blog.example/",
+		"/post/abc": "https://blog.example/post/abc",
+	} {
+		r := httptest.NewRequest("GET", "http://localhost:3000"+path+"?Search=go", nil)
+		if canonical := links.Canonical(r); canonical != want {
+			t.Errorf("canonical url of %s is %s, want %s", path, canonical, want)
+		}
+	}
+}
+
+func TestRequestOrigin(t *testing.T) {
+	tests := []struct {
+		name  string
+		tls   bool
+		trust bool
+		proto string
+		want  string
+	}{
+		{"plain", false, false, "", "http://blog.example"},
+		{"tls", true, false, "", "https://blog.example"},
+		{"behind a proxy", false, true, "https", "https://blog.example"},
+		{"untrusted proxy header", false, false, "https", "http://blog.example"},
+		{"nonsense from the proxy", false, true, "gopher", "http://blog.example"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/post/abc", nil)
+			r.Host = "blog.example"
+			if test.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if test.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", test.proto)
+			}
+			if origin := requestOrigin(r, test.trust); origin != test.want {
+				t.Errorf("got %s, want %s", origin, test.want)
+			}
+		})
+	}
+}
+
+func TestPostStatsLinks(t *testing.T) {
+	ps := &PostStats{Cfg: &BlogConfig{}}
+	r := httptest.NewRequest("GET", "http://localhost:3000/", nil)
+	if links := ps.Links(r); links.Base != "http://localhost:3000" {
+		t.Errorf("base is %s without a base url", links.Base)
+	}
+	ps.Cfg.BaseURL = "https://blog.example"
+	if links := ps.Links(r); links.Base != "https://blog.example" {
+		t.Errorf("base is %s with a base url", links.Base)
+	}
+}
+
+func TestCanonicalRedirect(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name     string
+		base     string
+		method   string
+		url      string
+		proto    string // Set by a trusted proxy
+		code     int
+		location string
+	}{
+		{"no base url", "", "GET", "http://localhost:3000/post/abc", "", http.StatusTeapot, ""},
+		{"already there", "http://blog.example", "GET", "http://blog.example/post/abc", "", http.StatusTeapot, ""},
+		{"host in another case", "http://blog.example", "GET", "http://Blog.Example/post/abc", "", http.StatusTeapot, ""},
+		{"other host", "http://blog.example", "GET", "http://localhost:3000/post/abc?x=1", "", http.StatusMovedPermanently, "http://blog.example/post/abc?x=1"},
+		{"other scheme", "https://blog.example", "GET", "http://blog.example/", "http", http.StatusMovedPermanently, "https://blog.example/"},
+		{"scheme the proxy didn't say", "https://blog.example", "GET", "http://blog.example/", "", http.StatusTeapot, ""},
+		{"tls ended at the proxy", "https://blog.example", "GET", "http://blog.example/", "https", http.StatusTeapot, ""},
+		{"posting keeps the method", "http://blog.example", "POST", "http://localhost:3000/webmention", "", http.StatusPermanentRedirect, "http://blog.example/webmention"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := CanonicalRedirect(&BlogConfig{BaseURL: test.base, TrustProxy: test.proto != ""}, next)
+			r := httptest.NewRequest(test.method, test.url, nil)
+			if test.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", test.proto)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.code || w.Header().Get("Location") != test.location {
+				t.Errorf("got %d to %q, want %d to %q", w.Code, w.Header().Get("Location"), test.code, test.location)
+			}
+		})
+	}
+}
+
+func TestTagURLFunc(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{
+		"gc": `Title = "Garbage collection"` + "\n" + `Tags = ["Go"]`,
+	})
+	tagURL := ps.TemplateFuncs(httptest.NewRequest("GET", "http://localhost/", nil))["tagURL"].(func(string) string)
+
+	// Pages get rendered while posts change, so it only reads the tags
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ps.Add("gc"); err != nil {
+			t.Error(err)
+		}
+	}()
+	if url := tagURL("go"); url != "http://localhost/tags/go" {
+		t.Errorf("url of go is %s", url)
+	}
+	if url := tagURL("Go Generics"); url != "http://localhost/tags/go-generics" {
+		t.Errorf("url of a tag no post has is %s", url)
+	}
+	<-done
+
+	ps.Lock.RLock()
+	defer ps.Lock.RUnlock()
+	if _, ok := ps.TagDB.Tags["Go Generics"]; ok {
+		t.Error("getting the url of a tag added it")
+	}
+}
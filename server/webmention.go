@@ -0,0 +1,564 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/net/html"
+)
+
+// A verified mention of one of our posts from somewhere else on the web
+type Webmention struct {
+	Source    string
+	Target    string
+	Type      string // One of like, repost, reply or mention
+	Author    string
+	AuthorURL string
+	Content   string
+	Received  time.Time
+	Approved  bool
+}
+
+// Text shown next to the author when rendering a mention
+func (m Webmention) Verb() string {
+	switch m.Type {
+	case "like":
+		return "liked this"
+	case "repost":
+		return "reposted this"
+	case "reply":
+		return "replied"
+	default:
+		return "mentioned this"
+	}
+}
+
+func (m Webmention) Icon() string {
+	switch m.Type {
+	case "like":
+		return "❤️"
+	case "repost":
+		return "🔁"
+	case "reply":
+		return "💬"
+	default:
+		return "🔗"
+	}
+}
+
+// A webmention that was received but still has to be verified
+type webmentionRequest struct {
+	ID     PostID
+	Source string
+	Target string
+}
+
+// Stores all webmentions for every post in a single file in the post directory
+type WebmentionDB struct {
+	Mentions map[PostID][]Webmention
+	Lock     sync.RWMutex
+	dir      string
+}
+
+func LoadWebmentionDB(dir string) (*WebmentionDB, error) {
+	db := &WebmentionDB{
+		Mentions: make(map[PostID][]Webmention),
+		dir:      dir,
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "webmentions.toml")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := toml.Unmarshal(data, &db.Mentions); err != nil {
+			// Mentions can always be sent again, so a corrupted file is not fatal
+			log.Println(err)
+			db.Mentions = make(map[PostID][]Webmention)
+		}
+	}
+	return db, nil
+}
+
+// Saves the database, expects the lock to already be held
+func (db *WebmentionDB) save() error {
+	if data, err := toml.Marshal(db.Mentions); err != nil {
+		return err
+	} else {
+		return WriteFileAtomic(filepath.Join(db.dir, "webmentions.toml"), data, 0664)
+	}
+}
+
+// Gets the mentions for a post, oldest first
+func (db *WebmentionDB) Get(id PostID, approvedOnly bool) []Webmention {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	mentions := make([]Webmention, 0, len(db.Mentions[id]))
+	for _, m := range db.Mentions[id] {
+		if !approvedOnly || m.Approved {
+			mentions = append(mentions, m)
+		}
+	}
+	return mentions
+}
+
+// Adds or replaces the mention from the same source
+func (db *WebmentionDB) Put(id PostID, m Webmention) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	mentions := db.Mentions[id]
+	if i := slices.IndexFunc(mentions, func(o Webmention) bool { return o.Source == m.Source }); i != -1 {
+		// Keep moderation decisions when the source gets updated
+		m.Approved = mentions[i].Approved
+		mentions[i] = m
+	} else {
+		mentions = append(mentions, m)
+	}
+	db.Mentions[id] = mentions
+	return db.save()
+}
+
+// Returns false if there was no mention from the source
+func (db *WebmentionDB) Delete(id PostID, source string) (bool, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	mentions := db.Mentions[id]
+	i := slices.IndexFunc(mentions, func(o Webmention) bool { return o.Source == source })
+	if i == -1 {
+		return false, nil
+	}
+	if mentions = slices.Delete(mentions, i, i+1); len(mentions) == 0 {
+		delete(db.Mentions, id)
+	} else {
+		db.Mentions[id] = mentions
+	}
+	return true, db.save()
+}
+
+// Returns false if there was no mention from the source
+func (db *WebmentionDB) Approve(id PostID, source string) (bool, error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	i := slices.IndexFunc(db.Mentions[id], func(o Webmention) bool { return o.Source == source })
+	if i == -1 {
+		return false, nil
+	}
+	db.Mentions[id][i].Approved = true
+	return true, db.save()
+}
+
+// Number of mentions waiting for moderation
+func (db *WebmentionDB) Pending() int {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+
+	pending := 0
+	for _, mentions := range db.Mentions {
+		for _, m := range mentions {
+			if !m.Approved {
+				pending++
+			}
+		}
+	}
+	return pending
+}
+
+// Drops every mention of a post
+func (db *WebmentionDB) RemovePost(id PostID) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+
+	if _, ok := db.Mentions[id]; !ok {
+		return nil
+	}
+	delete(db.Mentions, id)
+	return db.save()
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, attr := range n.Attr {
+		if attr.Key == "class" && slices.Contains(strings.Fields(attr.Val), class) {
+			return true
+		}
+	}
+	return false
+}
+
+func getAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// Finds the first node (including n) that matches
+func findNode(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findNode(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func nodeText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+// Resolves href against base and strips the fragment so links can be compared
+func resolveLink(base *url.URL, href string) string {
+	if u, err := base.Parse(strings.TrimSpace(href)); err != nil {
+		return ""
+	} else {
+		u.Fragment = ""
+		return strings.TrimSuffix(u.String(), "/")
+	}
+}
+
+// Looks through the source document for a link to target and pulls out what
+// microformats information it can. Returns false if target isn't linked to.
+func parseWebmention(doc *html.Node, source, target string) (Webmention, bool) {
+	m := Webmention{
+		Source: source,
+		Target: target,
+		Type:   "mention",
+	}
+	base, err := url.Parse(source)
+	if err != nil {
+		return m, false
+	}
+	target = resolveLink(base, target)
+
+	link := findNode(doc, func(n *html.Node) bool {
+		return n.Type == html.ElementNode && n.Data == "a" && resolveLink(base, getAttr(n, "href")) == target
+	})
+	if link == nil {
+		return m, false
+	}
+
+	switch {
+	case hasClass(link, "u-like-of"):
+		m.Type = "like"
+	case hasClass(link, "u-repost-of"):
+		m.Type = "repost"
+	case hasClass(link, "u-in-reply-to"):
+		m.Type = "reply"
+	}
+
+	// Try to find who wrote it, falling back on the host of the source
+	m.Author, m.AuthorURL = base.Host, base.Scheme+"://"+base.Host
+	if author := findNode(doc, func(n *html.Node) bool { return hasClass(n, "p-author") }); author != nil {
+		if name := findNode(author, func(n *html.Node) bool { return hasClass(n, "p-name") }); name != nil {
+			m.Author = nodeText(name)
+		} else if text := nodeText(author); text != "" {
+			m.Author = text
+		}
+		if href := getAttr(author, "href"); href != "" {
+			m.AuthorURL = resolveLink(base, href)
+		} else if u := findNode(author, func(n *html.Node) bool { return hasClass(n, "u-url") }); u != nil {
+			m.AuthorURL = resolveLink(base, getAttr(u, "href"))
+		}
+	}
+
+	// Only replies show their content
+	if m.Type == "reply" {
+		content := findNode(doc, func(n *html.Node) bool {
+			return hasClass(n, "e-content") || hasClass(n, "p-content")
+		})
+		if content != nil {
+			m.Content = nodeText(content)
+			if runes := []rune(m.Content); len(runes) > 500 {
+				m.Content = string(runes[:500]) + "…"
+			}
+		}
+	}
+
+	return m, true
+}
+
+// Refuses to connect to this machine or the local network. Anyone can send a
+// url to fetch, this stops them from using the server to reach what's behind it
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("Not connecting to the non public address %s", ip)
+	}
+	return nil
+}
+
+// A client for fetching urls that came from outside. The check happens when
+// connecting so redirects and names that resolve to local addresses are caught too
+func newPublicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// Fetches the source and makes sure that it actually links to the target
+func (db *WebmentionDB) verify(client *http.Client, req webmentionRequest) {
+	resp, err := client.Get(req.Source)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// The source was deleted so the mention should be too
+	if resp.StatusCode == http.StatusGone {
+		if _, err := db.Delete(req.ID, req.Source); err != nil {
+			log.Println(err)
+		}
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		log.Printf("Webmention source %s returned %s\n", req.Source, resp.Status)
+		return
+	}
+
+	doc, err := html.Parse(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if m, ok := parseWebmention(doc, req.Source, req.Target); !ok {
+		log.Printf("Webmention source %s doesn't link to %s\n", req.Source, req.Target)
+		if _, err := db.Delete(req.ID, req.Source); err != nil {
+			log.Println(err)
+		}
+	} else {
+		m.Received = time.Now()
+		if err := db.Put(req.ID, m); err != nil {
+			log.Println(err)
+		}
+		log.Printf("Received %s from %s for post %s\n", m.Type, m.Source, req.ID)
+	}
+}
+
+// Makes sure that target is a post on this site, returning the post's id
+func (ps *PostStats) targetPost(r *http.Request, target *url.URL) (PostID, bool) {
+	if base, err := url.Parse(ps.Links(r).Base); err != nil {
+		return "", false
+	} else if !strings.EqualFold(target.Host, base.Host) && !strings.EqualFold(target.Host, r.Host) {
+		return "", false
+	}
+
+	id, ok := strings.CutPrefix(strings.TrimSuffix(target.Path, "/"), "/post/")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		return "", false
+	}
+
+	ps.Lock.RLock()
+	defer ps.Lock.RUnlock()
+	_, ok = ps.Posts[PostID(id)]
+	return PostID(id), ok
+}
+
+func HandleWebmentions(ps *PostStats, session *Session) {
+	type Mention struct {
+		Webmention
+		ID    PostID
+		Title string
+	}
+
+	// Verify mentions one at a time in the background
+	queue := make(chan webmentionRequest, 64)
+	go func() {
+		client := newPublicClient()
+		for req := range queue {
+			ps.Mentions.verify(client, req)
+		}
+	}()
+
+	http.HandleFunc("POST /webmention", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		source, err := url.Parse(r.PostForm.Get("source"))
+		if err != nil || (source.Scheme != "http" && source.Scheme != "https") {
+			http.Error(w, "Invalid source URL", http.StatusBadRequest)
+			return
+		}
+		target, err := url.Parse(r.PostForm.Get("target"))
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			http.Error(w, "Invalid target URL", http.StatusBadRequest)
+			return
+		}
+		if source.String() == target.String() {
+			http.Error(w, "Source and target must be different", http.StatusBadRequest)
+			return
+		}
+
+		id, ok := ps.targetPost(r, target)
+		if !ok {
+			http.Error(w, "Target is not a post on this site", http.StatusBadRequest)
+			return
+		}
+
+		select {
+		case queue <- webmentionRequest{ID: id, Source: source.String(), Target: target.String()}:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "Too many webmentions, try again later", http.StatusServiceUnavailable)
+		}
+	})
+
+	// Gets every mention, pending mentions first and newest first after that
+	getmentions := func(term string) []Mention {
+		mentions := make([]Mention, 0)
+		ps.Mentions.Lock.RLock()
+		ps.Lock.RLock()
+		for id, list := range ps.Mentions.Mentions {
+			for _, m := range list {
+				if term != "" && !strings.Contains(strings.ToLower(m.Source+" "+m.Author+" "+m.Content), term) {
+					continue
+				}
+				mentions = append(mentions, Mention{
+					Webmention: m,
+					ID:         id,
+					Title:      ps.Posts[id].Title,
+				})
+			}
+		}
+		ps.Lock.RUnlock()
+		ps.Mentions.Lock.RUnlock()
+
+		slices.SortFunc(mentions, func(a, b Mention) int {
+			if a.Approved != b.Approved {
+				if b.Approved {
+					return -1
+				}
+				return 1
+			}
+			return b.Received.Compare(a.Received)
+		})
+		return mentions
+	}
+
+	http.HandleFunc("/admin/webmentions", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			http.ServeFile(w, r, "views/admin-pass.html")
+			return
+		}
+
+		tmpl, err := template.New("base").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/admin-webmentions.html", "views/nav.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		exec := "base"
+		if r.Form.Has("Search") {
+			exec = "mentions"
+		}
+		if err := tmpl.ExecuteTemplate(w, exec, struct {
+			Title        string
+			SearchTarget string
+			Mentions     []Mention
+		}{
+			Title:        "Webmentions",
+			SearchTarget: "#mentions-list",
+			Mentions:     getmentions(strings.ToLower(strings.TrimSpace(r.Form.Get("Search")))),
+		}); err != nil {
+			log.Println(err)
+		}
+	})
+
+	http.HandleFunc("POST /admin/webmentions/{postid}/approve", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			return
+		}
+
+		tmpl, err := template.New("mention").Funcs(ps.TemplateFuncs(r)).ParseFiles("views/admin-webmentions.html", "views/nav.html")
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		id := PostID(r.PathValue("postid"))
+		source := r.Form.Get("source")
+		if ok, err := ps.Mentions.Approve(id, source); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Send back the updated row
+		for _, m := range ps.Mentions.Get(id, true) {
+			if m.Source != source {
+				continue
+			}
+			ps.Lock.RLock()
+			title := ps.Posts[id].Title
+			ps.Lock.RUnlock()
+			if err := tmpl.ExecuteTemplate(w, "mention", Mention{Webmention: m, ID: id, Title: title}); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	})
+
+	http.HandleFunc("DELETE /admin/webmentions/{postid}", func(w http.ResponseWriter, r *http.Request) {
+		if !session.CheckAndAccept(w, r, ps.Cfg.Password) {
+			return
+		}
+
+		if ok, err := ps.Mentions.Delete(PostID(r.PathValue("postid")), r.Form.Get("source")); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if !ok {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
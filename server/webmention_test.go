@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestParseWebmention(t *testing.T) {
+	const target = "https://blog.example/post/abc"
+	tests := []struct {
+		name      string
+		page      string
+		ok        bool
+		kind      string
+		author    string
+		authorURL string
+		content   string
+	}{
+		{
+			name: "no link",
+			page: `<p>Nothing to see here, <a href="https://blog.example/post/other">other post</a></p>`,
+		},
+		{
+			name:      "plain mention",
+			page:      `<p>Read <a href="https://blog.example/post/abc">this</a></p>`,
+			ok:        true,
+			kind:      "mention",
+			author:    "them.example",
+			authorURL: "https://them.example",
+		},
+		{
+			name:      "link with a fragment and slash",
+			page:      `<a href="https://blog.example/post/abc/#comments">here</a>`,
+			ok:        true,
+			kind:      "mention",
+			author:    "them.example",
+			authorURL: "https://them.example",
+		},
+		{
+			name:      "like",
+			page:      `<a class="u-like-of" href="https://blog.example/post/abc">liked</a>`,
+			ok:        true,
+			kind:      "like",
+			author:    "them.example",
+			authorURL: "https://them.example",
+		},
+		{
+			name:      "repost",
+			page:      `<a class="h-cite u-repost-of" href="https://blog.example/post/abc">reposted</a>`,
+			ok:        true,
+			kind:      "repost",
+			author:    "them.example",
+			authorURL: "https://them.example",
+		},
+		{
+			name: "reply with an author",
+			page: `<article class="h-entry">
+				<a class="p-author h-card" href="/me"><span class="p-name">Someone  Else</span></a>
+				<a class="u-in-reply-to" href="https://blog.example/post/abc">In reply to</a>
+				<div class="e-content">Great   post!</div>
+			</article>`,
+			ok:        true,
+			kind:      "reply",
+			author:    "Someone Else",
+			authorURL: "https://them.example/me",
+			content:   "Great post!",
+		},
+		{
+			name: "author with a nested url",
+			page: `<div class="p-author h-card"><a class="u-url" href="https://them.example/about">Them</a></div>
+				<a href="https://blog.example/post/abc">link</a>`,
+			ok:        true,
+			kind:      "mention",
+			author:    "Them",
+			authorURL: "https://them.example/about",
+		},
+		{
+			name:      "only replies keep their content",
+			page:      `<a class="u-like-of" href="https://blog.example/post/abc">liked</a><p class="e-content">Hi</p>`,
+			ok:        true,
+			kind:      "like",
+			author:    "them.example",
+			authorURL: "https://them.example",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := html.Parse(strings.NewReader(test.page))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, ok := parseWebmention(doc, "https://them.example/notes/1", target)
+			if ok != test.ok {
+				t.Fatalf("found a link = %v, want %v", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if m.Type != test.kind || m.Author != test.author || m.AuthorURL != test.authorURL || m.Content != test.content {
+				t.Errorf("got %q by %q (%q) saying %q, want %q by %q (%q) saying %q",
+					m.Type, m.Author, m.AuthorURL, m.Content, test.kind, test.author, test.authorURL, test.content)
+			}
+		})
+	}
+}
+
+func TestParseWebmentionLongReply(t *testing.T) {
+	page := `<a class="u-in-reply-to" href="https://blog.example/post/abc">re</a><p class="e-content">` +
+		strings.Repeat("é", 600) + `</p>`
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := parseWebmention(doc, "https://them.example/", "https://blog.example/post/abc")
+	if !ok {
+		t.Fatal("didn't find the link")
+	}
+	if got := []rune(m.Content); len(got) != 501 || got[500] != '…' {
+		t.Errorf("content is %d runes, want it cut to 500 and an ellipsis", len(got))
+	}
+}
+
+func TestVerifyWebmention(t *testing.T) {
+	const target = "https://blog.example/post/abc"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/links", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<a class="u-like-of" href="` + target + `">liked</a>`))
+	})
+	mux.HandleFunc("/nolink", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<p>Nothing</p>`))
+	})
+	mux.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		existing bool // Whether there already was a mention from the source
+		want     bool // Whether there is one afterwards
+	}{
+		{"new mention", "/links", false, true},
+		{"updated mention", "/links", true, true},
+		{"link got removed", "/nolink", true, false},
+		{"never linked", "/nolink", false, false},
+		{"source is gone", "/gone", true, false},
+		{"errors keep what was there", "/broken", true, true},
+		{"errors don't add anything", "/broken", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, err := LoadWebmentionDB(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := srv.URL + test.path
+			if test.existing {
+				if err := db.Put("abc", Webmention{Source: source, Target: target, Type: "mention", Approved: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db.verify(srv.Client(), webmentionRequest{ID: "abc", Source: source, Target: target})
+			mentions := db.Get("abc", false)
+			if got := len(mentions) == 1; got != test.want {
+				t.Fatalf("has a mention = %v, want %v", got, test.want)
+			}
+			if test.want && test.existing && !mentions[0].Approved {
+				t.Error("updating a mention lost its approval")
+			}
+		})
+	}
+}
+
+func TestReceiveWebmention(t *testing.T) {
+	mentions, err := LoadWebmentionDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := &PostStats{Posts: map[PostID]PostInfo{"abc": {Title: "A post"}}, Mentions: mentions, Cfg: &BlogConfig{}}
+	mux := testMux(t)
+	HandleWebmentions(ps, new(Session))
+
+	tests := []struct {
+		name   string
+		source string
+		target string
+		code   int
+	}{
+		{"accepted", "https://them.example/notes/1", "http://blog.example/post/abc", http.StatusAccepted},
+		{"trailing slash", "https://them.example/notes/1", "http://blog.example/post/abc/", http.StatusAccepted},
+		{"source isn't http", "ftp://them.example/notes/1", "http://blog.example/post/abc", http.StatusBadRequest},
+		{"no target", "https://them.example/notes/1", "", http.StatusBadRequest},
+		{"same source and target", "http://blog.example/post/abc", "http://blog.example/post/abc", http.StatusBadRequest},
+		{"other site", "https://them.example/notes/1", "http://other.example/post/abc", http.StatusBadRequest},
+		{"not a post", "https://them.example/notes/1", "http://blog.example/about", http.StatusBadRequest},
+		{"post that doesn't exist", "https://them.example/notes/1", "http://blog.example/post/xyz", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"source": {test.source}, "target": {test.target}}
+			r := httptest.NewRequest("POST", "http://blog.example/webmention", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("got %d, want %d: %s", w.Code, test.code, w.Body)
+			}
+		})
+	}
+}
+
+func TestVerifyRefusesLocalSources(t *testing.T) {
+	const target = "https://blog.example/post/abc"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<a href="` + target + `">link</a>`))
+	}))
+	defer srv.Close()
+
+	db, err := LoadWebmentionDB(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.verify(newPublicClient(), webmentionRequest{ID: "abc", Source: srv.URL, Target: target})
+	if mentions := db.Get("abc", false); len(mentions) != 0 {
+		t.Errorf("verified a mention from %s", srv.URL)
+	}
+}
+
+func TestPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.215.14:443", true},
+		{"[2606:4700::1111]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"224.0.0.1:80", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			if err := publicOnly("tcp", test.address, nil); (err == nil) != test.public {
+				t.Errorf("got %v, want public = %v", err, test.public)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// How many of the newest posts go into the feed
+const feedLength = 20
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+	Content    atomContent    `xml:"content"`
+}
+
+// A post that was deleted, see RFC 6721
+type atomDeleted struct {
+	XMLName xml.Name `xml:"http://purl.org/atompub/tombstones/1.0 deleted-entry"`
+	Ref     string   `xml:"ref,attr"`
+	When    string   `xml:"when,attr"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+	Deleted []atomDeleted
+}
+
+func feedURL(links Links) string {
+	return links.Abs("/feed.xml")
+}
+
+// Builds the Atom feed of the newest posts
+func (ps *PostStats) AtomFeed(links Links, hub string) ([]byte, error) {
+	ps.Lock.RLock()
+	ids := slices.Clone(ps.ByDate[:min(feedLength, len(ps.ByDate))])
+	ps.Lock.RUnlock()
+	return ps.atomFeed(links, hub, ids, nil)
+}
+
+// Builds a feed of just some posts, and of posts that were deleted
+func (ps *PostStats) atomFeed(links Links, hub string, ids []PostID, deleted []PostID) ([]byte, error) {
+	feed := atomFeed{
+		Title:   ps.Cfg.Title,
+		ID:      links.Home(),
+		Author:  ps.Cfg.Author,
+		Entries: make([]atomEntry, 0, len(ids)),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feedURL(links)},
+			{Rel: "alternate", Type: "text/html", Href: links.Home()},
+			{Rel: "hub", Href: hub},
+		},
+	}
+
+	var newest time.Time
+	for _, id := range ids {
+		post, err := LoadPost(filepath.Join(ps.Cfg.PostDir, string(id)))
+		if err != nil {
+			return nil, err
+		}
+
+		updated := post.Info.Updated
+		if updated.IsZero() {
+			updated = post.Info.Date
+		}
+		if updated.After(newest) {
+			newest = updated
+		}
+
+		entry := atomEntry{
+			Title:     post.Info.Title,
+			ID:        links.Post(id),
+			Link:      atomLink{Rel: "alternate", Href: links.Post(id)},
+			Published: post.Info.Date.Format(time.RFC3339),
+			Updated:   updated.Format(time.RFC3339),
+			Summary:   post.Summary,
+			Content:   atomContent{Type: "html", Body: string(post.Document)},
+		}
+		for _, tag := range post.Info.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	for _, id := range deleted {
+		newest = time.Now()
+		feed.Deleted = append(feed.Deleted, atomDeleted{Ref: links.Post(id), When: newest.Format(time.RFC3339)})
+	}
+
+	// A blog without posts still needs a valid date
+	if newest.IsZero() {
+		newest = time.Now()
+	}
+	feed.Updated = newest.Format(time.RFC3339)
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// A feed reader that wants to be told when the feed changes
+type WebSubscription struct {
+	Callback string
+	Topic    string
+	Secret   string `toml:",omitempty"`
+	Expires  time.Time
+}
+
+// Pings an outside hub when the feed changes, or acts as a small hub itself
+// when there isn't one configured
+type WebSub struct {
+	ps            *PostStats
+	client        *http.Client // For pinging the configured hub
+	callbacks     *http.Client // For subscribers, their callbacks can point anywhere
+	queue         *RetryQueue
+	subscriptions []WebSubscription
+	lock          sync.RWMutex
+}
+
+func LoadWebSub(ps *PostStats) (*WebSub, error) {
+	ws := &WebSub{
+		ps:            ps,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		callbacks:     newPublicClient(),
+		queue:         NewRetryQueue("websub", 5, time.Minute),
+		subscriptions: make([]WebSubscription, 0),
+	}
+
+	var file struct{ Subscriptions []WebSubscription }
+	if data, err := os.ReadFile(filepath.Join(ps.Cfg.PostDir, "websub.toml")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := toml.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		ws.subscriptions = file.Subscriptions
+	}
+	return ws, nil
+}
+
+// Saves the subscriptions, expects the lock to already be held
+func (ws *WebSub) save() error {
+	if data, err := toml.Marshal(struct{ Subscriptions []WebSubscription }{ws.subscriptions}); err != nil {
+		return err
+	} else {
+		return WriteFileAtomic(filepath.Join(ws.ps.Cfg.PostDir, "websub.toml"), data, 0600)
+	}
+}
+
+// Url of the hub that subscribers should use
+func (ws *WebSub) hub(links Links) string {
+	if ws.ps.Cfg.WebSubHub != "" {
+		return ws.ps.Cfg.WebSubHub
+	}
+	return links.Abs("/websub")
+}
+
+// Tells the configured hub that the feed at topic has changed
+func (ws *WebSub) ping(topic string) error {
+	resp, err := ws.client.PostForm(ws.ps.Cfg.WebSubHub, url.Values{
+		"hub.mode": {"publish"},
+		"hub.url":  {topic},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Hub %s returned %s", ws.ps.Cfg.WebSubHub, resp.Status)
+	}
+	return nil
+}
+
+// Posts the entry of a post that changed to a subscriber, meant to be run
+// from the queue
+func (ws *WebSub) distribute(sub WebSubscription, event PostEvent, id PostID) error {
+	topic, err := url.Parse(sub.Topic)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	links := Links{Base: topic.Scheme + "://" + topic.Host}
+	var feed []byte
+	if event == PostDeleted {
+		feed, err = ws.ps.atomFeed(links, ws.hub(links), nil, []PostID{id})
+	} else {
+		feed, err = ws.ps.atomFeed(links, ws.hub(links), []PostID{id}, nil)
+	}
+	if os.IsNotExist(err) {
+		// Deleted before it got sent, that gets sent on its own
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Callback, bytes.NewReader(feed))
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	req.Header.Set("Content-Type", "application/atom+xml")
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, ws.hub(links)))
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, sub.Topic))
+	if sub.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write(feed)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := ws.callbacks.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		// The subscriber doesn't want updates anymore
+		ws.lock.Lock()
+		defer ws.lock.Unlock()
+		ws.subscriptions = slices.DeleteFunc(ws.subscriptions, func(s WebSubscription) bool {
+			return s.Callback == sub.Callback && s.Topic == sub.Topic
+		})
+		return ws.save()
+	} else if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", sub.Callback, resp.Status)
+	}
+	return nil
+}
+
+// Lets everyone know that the feed changed, subscribers only get sent the post
+// that changed
+func (ws *WebSub) postListener(event PostEvent, id PostID, info PostInfo) {
+	if ws.ps.Cfg.WebSubHub != "" {
+		if ws.ps.Cfg.BaseURL == "" {
+			log.Println("websub: BLOG_BASE_URL needs to be set to ping a hub")
+			return
+		}
+		topic := feedURL(Links{Base: ws.ps.Cfg.BaseURL})
+		ws.queue.Push(func(int) error { return ws.ping(topic) })
+		return
+	}
+
+	ws.lock.Lock()
+	ws.subscriptions = slices.DeleteFunc(ws.subscriptions, func(s WebSubscription) bool {
+		return time.Now().After(s.Expires)
+	})
+	subs := slices.Clone(ws.subscriptions)
+	ws.lock.Unlock()
+
+	for _, sub := range subs {
+		ws.queue.Push(func(int) error { return ws.distribute(sub, event, id) })
+	}
+}
+
+// Makes sure the subscriber actually asked for a (un)subscription before doing it
+func (ws *WebSub) verify(mode string, sub WebSubscription, lease int) error {
+	callback, err := url.Parse(sub.Callback)
+	if err != nil {
+		return err
+	}
+	challenge := newToken()
+	query := callback.Query()
+	query.Set("hub.mode", mode)
+	query.Set("hub.topic", sub.Topic)
+	query.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(lease))
+	}
+	callback.RawQuery = query.Encode()
+
+	resp, err := ws.callbacks.Get(callback.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 || string(body) != challenge {
+		log.Printf("websub: %s didn't confirm %s\n", sub.Callback, mode)
+		return nil
+	}
+
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.subscriptions = slices.DeleteFunc(ws.subscriptions, func(s WebSubscription) bool {
+		return s.Callback == sub.Callback && s.Topic == sub.Topic
+	})
+	if mode == "subscribe" {
+		sub.Expires = time.Now().Add(time.Duration(lease) * time.Second)
+		ws.subscriptions = append(ws.subscriptions, sub)
+	}
+	log.Printf("websub: %s %sd to %s\n", sub.Callback, mode, sub.Topic)
+	return ws.save()
+}
+
+func HandleWebSub(ps *PostStats) {
+	ws, err := LoadWebSub(ps)
+	if err != nil {
+		log.Println(err)
+		log.Println("WebSub is disabled")
+		return
+	}
+	ps.Listen(ws.postListener)
+
+	http.HandleFunc("GET /feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		links := ps.Links(r)
+		feed, err := ps.AtomFeed(links, ws.hub(links))
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, ws.hub(links)))
+		w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="self"`, feedURL(links)))
+		w.Header().Set("Content-Type", "application/atom+xml")
+		w.Write(feed)
+	})
+
+	// Only act as a hub when there isn't a real one
+	if ps.Cfg.WebSubHub != "" {
+		return
+	}
+	http.HandleFunc("POST /websub", func(w http.ResponseWriter, r *http.Request) {
+		mode := r.FormValue("hub.mode")
+		if mode != "subscribe" && mode != "unsubscribe" {
+			http.Error(w, "hub.mode must be subscribe or unsubscribe", http.StatusBadRequest)
+			return
+		}
+
+		// We are only a hub for our own feed
+		topic, err := url.Parse(r.FormValue("hub.topic"))
+		base, _ := url.Parse(ps.Links(r).Base)
+		if err != nil || topic.Path != "/feed.xml" || (!strings.EqualFold(topic.Host, base.Host) && !strings.EqualFold(topic.Host, r.Host)) {
+			http.Error(w, "hub.topic must be this site's feed", http.StatusBadRequest)
+			return
+		}
+		callback, err := url.Parse(r.FormValue("hub.callback"))
+		if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") {
+			http.Error(w, "hub.callback must be an http(s) url", http.StatusBadRequest)
+			return
+		}
+
+		// Default to ten days, and don't let subscriptions go unchecked for too long
+		lease := 10 * 24 * 60 * 60
+		if l, err := strconv.Atoi(r.FormValue("hub.lease_seconds")); err == nil && l > 0 {
+			lease = min(l, 30*24*60*60)
+		}
+
+		sub := WebSubscription{
+			Callback: callback.String(),
+			Topic:    topic.String(),
+			Secret:   r.FormValue("hub.secret"),
+		}
+		ws.queue.Push(func(int) error { return ws.verify(mode, sub, lease) })
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
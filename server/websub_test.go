@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testWebSub(t *testing.T) *WebSub {
+	t.Helper()
+	ps := testBlog(t, map[PostID]string{
+		"old": `Title = "Old post"` + "\n" + `Date = 2024-01-01T00:00:00Z` + "\n" + `Tags = ["go"]`,
+		"new": `Title = "New post"` + "\n" + `Date = 2024-03-01T00:00:00Z` + "\n" + `Updated = 2024-04-01T00:00:00Z`,
+	})
+	ps.Cfg.Title = "My Blog"
+	ps.Cfg.Author = "Jo"
+	ws, err := LoadWebSub(ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestAtomFeed(t *testing.T) {
+	ws := testWebSub(t)
+	links := Links{Base: "https://blog.example"}
+	data, err := ws.ps.AtomFeed(links, ws.hub(links))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatal(err)
+	}
+	if feed.Title != "My Blog" || feed.Author != "Jo" || feed.ID != "https://blog.example/" {
+		t.Errorf("feed is %q by %q at %q", feed.Title, feed.Author, feed.ID)
+	}
+	// The newest change to any post
+	if feed.Updated != "2024-04-01T00:00:00Z" {
+		t.Errorf("feed was updated %s", feed.Updated)
+	}
+	wantLinks := []atomLink{
+		{Rel: "self", Type: "application/atom+xml", Href: "https://blog.example/feed.xml"},
+		{Rel: "alternate", Type: "text/html", Href: "https://blog.example/"},
+		{Rel: "hub", Href: "https://blog.example/websub"},
+	}
+	if !slices.Equal(feed.Links, wantLinks) {
+		t.Errorf("links are %+v", feed.Links)
+	}
+
+	if len(feed.Entries) != 2 {
+		t.Fatalf("got %d entries", len(feed.Entries))
+	}
+	newest, oldest := feed.Entries[0], feed.Entries[1]
+	if newest.ID != "https://blog.example/post/new" || newest.Link.Href != newest.ID || newest.Title != "New post" {
+		t.Errorf("newest entry is %+v", newest)
+	}
+	if newest.Published != "2024-03-01T00:00:00Z" || newest.Updated != "2024-04-01T00:00:00Z" {
+		t.Errorf("newest entry was published %s and updated %s", newest.Published, newest.Updated)
+	}
+	// Posts that weren't updated use the date they were posted
+	if oldest.Updated != "2024-01-01T00:00:00Z" {
+		t.Errorf("oldest entry was updated %s", oldest.Updated)
+	}
+	if !slices.Equal(oldest.Categories, []atomCategory{{Term: "go"}}) {
+		t.Errorf("oldest entry has the categories %v", oldest.Categories)
+	}
+	if oldest.Summary != "Some text" || oldest.Content.Type != "html" || !strings.Contains(oldest.Content.Body, "Some text") {
+		t.Errorf("oldest entry has the summary %q and content %+v", oldest.Summary, oldest.Content)
+	}
+}
+
+func TestAtomFeedWithoutPosts(t *testing.T) {
+	ps := testBlog(t, map[PostID]string{})
+	data, err := ps.AtomFeed(Links{Base: "https://blog.example"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var feed atomFeed
+	if err := xml.Unmarshal(data, &feed); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := time.Parse(time.RFC3339, feed.Updated); err != nil || time.Since(updated) > time.Minute {
+		t.Errorf("empty feed was updated %q", feed.Updated)
+	}
+}
+
+// A feed reader that checks the challenge and keeps what gets pushed to it
+type fakeSubscriber struct {
+	lock     sync.Mutex
+	confirm  bool            // Whether to echo the challenge back
+	status   int             // Status to answer pushes with
+	verified url.Values      // Query of the last verification request
+	pushes   []*http.Request // Pushed requests, with the body in pushed
+	pushed   []string
+}
+
+func (s *fakeSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.Method == http.MethodGet {
+		s.verified = r.URL.Query()
+		if s.confirm {
+			w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+		} else {
+			w.Write([]byte("no thanks"))
+		}
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	s.pushes = append(s.pushes, r)
+	s.pushed = append(s.pushed, string(body))
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+	}
+}
+
+func TestWebSubVerify(t *testing.T) {
+	ws := testWebSub(t)
+	sub := &fakeSubscriber{confirm: true}
+	srv := httptest.NewServer(sub)
+	defer srv.Close()
+	ws.callbacks = srv.Client()
+
+	callback := srv.URL + "/callback?feed=1"
+	if err := ws.verify("subscribe", WebSubscription{Callback: callback, Topic: "https://blog.example/feed.xml"}, 3600); err != nil {
+		t.Fatal(err)
+	}
+	if sub.verified.Get("hub.mode") != "subscribe" || sub.verified.Get("hub.topic") != "https://blog.example/feed.xml" ||
+		sub.verified.Get("hub.lease_seconds") != "3600" || sub.verified.Get("feed") != "1" {
+		t.Errorf("verified with %v", sub.verified)
+	}
+	if len(ws.subscriptions) != 1 || ws.subscriptions[0].Callback != callback {
+		t.Fatalf("subscriptions are %+v", ws.subscriptions)
+	}
+
+	// Subscribing again just renews it
+	if err := ws.verify("subscribe", WebSubscription{Callback: callback, Topic: "https://blog.example/feed.xml"}, 7200); err != nil {
+		t.Fatal(err)
+	}
+	if len(ws.subscriptions) != 1 {
+		t.Fatalf("subscriptions are %+v", ws.subscriptions)
+	}
+
+	// It got saved
+	again, err := LoadWebSub(ws.ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.subscriptions) != 1 || again.subscriptions[0].Callback != callback {
+		t.Errorf("saved %+v", again.subscriptions)
+	}
+
+	// Nothing happens without the subscriber's say so
+	sub.confirm = false
+	if err := ws.verify("unsubscribe", WebSubscription{Callback: callback, Topic: "https://blog.example/feed.xml"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(ws.subscriptions) != 1 {
+		t.Fatalf("unsubscribed without confirming")
+	}
+	if err := ws.verify("subscribe", WebSubscription{Callback: srv.URL + "/other", Topic: "https://blog.example/feed.xml"}, 3600); err != nil {
+		t.Fatal(err)
+	}
+	if len(ws.subscriptions) != 1 {
+		t.Fatalf("subscribed without confirming")
+	}
+
+	sub.confirm = true
+	if err := ws.verify("unsubscribe", WebSubscription{Callback: callback, Topic: "https://blog.example/feed.xml"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sub.verified["hub.lease_seconds"]; ok {
+		t.Error("unsubscribing has a lease")
+	}
+	if len(ws.subscriptions) != 0 {
+		t.Errorf("still subscribed: %+v", ws.subscriptions)
+	}
+}
+
+func TestWebSubRefusesLocalCallbacks(t *testing.T) {
+	ws := testWebSub(t)
+	sub := &fakeSubscriber{confirm: true}
+	srv := httptest.NewServer(sub)
+	defer srv.Close()
+
+	// Anyone can subscribe with any callback
+	subscription := WebSubscription{Callback: srv.URL + "/callback", Topic: "https://blog.example/feed.xml"}
+	if err := ws.verify("subscribe", subscription, 3600); err == nil || len(ws.subscriptions) != 0 {
+		t.Errorf("verified a local callback: %v", err)
+	}
+	ws.subscriptions = append(ws.subscriptions, subscription)
+	if err := ws.distribute(subscription, PostUpdated, "new"); err == nil {
+		t.Error("pushed to a local callback")
+	}
+	if sub.verified != nil || len(sub.pushes) != 0 {
+		t.Errorf("the local callback got requests")
+	}
+}
+
+func TestWebSubDistribute(t *testing.T) {
+	ws := testWebSub(t)
+	sub := &fakeSubscriber{}
+	srv := httptest.NewServer(sub)
+	defer srv.Close()
+	ws.callbacks = srv.Client()
+
+	subscription := WebSubscription{Callback: srv.URL + "/callback", Topic: "https://blog.example/feed.xml", Secret: "shh"}
+	ws.subscriptions = append(ws.subscriptions, subscription)
+	if err := ws.distribute(subscription, PostUpdated, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sub.pushes) != 1 {
+		t.Fatalf("got %d pushes", len(sub.pushes))
+	}
+	r, body := sub.pushes[0], sub.pushed[0]
+	if r.Header.Get("Content-Type") != "application/atom+xml" {
+		t.Errorf("Content-Type is %s", r.Header.Get("Content-Type"))
+	}
+	wantLinks := []string{`<https://blog.example/websub>; rel="hub"`, `<https://blog.example/feed.xml>; rel="self"`}
+	if links := r.Header.Values("Link"); !slices.Equal(links, wantLinks) {
+		t.Errorf("Link headers are %v", links)
+	}
+	mac := hmac.New(sha256.New, []byte("shh"))
+	mac.Write([]byte(body))
+	if sig := r.Header.Get("X-Hub-Signature"); sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("X-Hub-Signature is %s", sig)
+	}
+	// Only the post that changed gets pushed
+	var feed atomFeed
+	if err := xml.Unmarshal([]byte(body), &feed); err != nil || len(feed.Entries) != 1 || feed.Entries[0].Title != "New post" {
+		t.Errorf("pushed %s", body)
+	}
+
+	// Deleted posts get a tombstone
+	if err := ws.distribute(subscription, PostDeleted, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if body := sub.pushed[1]; !strings.Contains(body, `deleted-entry`) || !strings.Contains(body, `ref="https://blog.example/post/gone"`) {
+		t.Errorf("pushed %s", body)
+	}
+
+	// A post deleted before it got pushed isn't sent
+	if err := ws.distribute(subscription, PostUpdated, "gone"); err != nil || len(sub.pushes) != 2 {
+		t.Errorf("pushed a post that's gone: %v", err)
+	}
+
+	// Errors get tried again
+	sub.status = http.StatusInternalServerError
+	if err := ws.distribute(subscription, PostUpdated, "new"); err == nil {
+		t.Error("no error when the subscriber failed")
+	}
+
+	// Subscribers can tell the hub to stop
+	sub.status = http.StatusGone
+	if err := ws.distribute(subscription, PostUpdated, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ws.subscriptions) != 0 {
+		t.Errorf("still subscribed: %+v", ws.subscriptions)
+	}
+}
+
+func TestWebSubHub(t *testing.T) {
+	ps := testWebSub(t).ps
+	mux := testMux(t)
+	HandleWebSub(ps)
+
+	tests := []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{
+			name: "subscribe",
+			form: url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://blog.example/feed.xml"}, "hub.callback": {"https://reader.example/cb"}},
+			code: http.StatusAccepted,
+		},
+		{
+			name: "unsubscribe",
+			form: url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {"http://blog.example/feed.xml"}, "hub.callback": {"https://reader.example/cb"}},
+			code: http.StatusAccepted,
+		},
+		{
+			name: "publish",
+			form: url.Values{"hub.mode": {"publish"}, "hub.url": {"http://blog.example/feed.xml"}},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "other site's feed",
+			form: url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://other.example/feed.xml"}, "hub.callback": {"https://reader.example/cb"}},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "not the feed",
+			form: url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://blog.example/post/new"}, "hub.callback": {"https://reader.example/cb"}},
+			code: http.StatusBadRequest,
+		},
+		{
+			name: "callback isn't http",
+			form: url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://blog.example/feed.xml"}, "hub.callback": {"file:///etc/passwd"}},
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://blog.example/websub", strings.NewReader(test.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != test.code {
+				t.Errorf("got %d, want %d: %s", w.Code, test.code, w.Body)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.example/feed.xml", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/atom+xml" {
+		t.Fatalf("feed got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if links := w.Header().Values("Link"); !slices.Contains(links, `<http://blog.example/websub>; rel="hub"`) {
+		t.Errorf("feed has the links %v", links)
+	}
+}
+
+func TestWebSubOutsideHub(t *testing.T) {
+	ps := testWebSub(t).ps
+	ps.Cfg.WebSubHub = "https://hub.example/"
+	mux := testMux(t)
+	HandleWebSub(ps)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://blog.example/feed.xml", nil))
+	if links := w.Header().Values("Link"); !slices.Contains(links, `<https://hub.example/>; rel="hub"`) {
+		t.Errorf("feed has the links %v", links)
+	}
+
+	// The blog isn't a hub itself then
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "http://blog.example/websub", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("hub got %d", w.Code)
+	}
+}
+
+func TestWebSubPing(t *testing.T) {
+	var lock sync.Mutex
+	var pinged url.Values
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		r.ParseForm()
+		pinged = r.PostForm
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hub.Close()
+
+	ws := testWebSub(t)
+	ws.ps.Cfg.WebSubHub = hub.URL
+	ws.client = hub.Client()
+	if err := ws.ping("https://blog.example/feed.xml"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if pinged.Get("hub.mode") != "publish" || pinged.Get("hub.url") != "https://blog.example/feed.xml" {
+		t.Errorf("pinged with %v", pinged)
+	}
+}
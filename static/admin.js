@@ -29,13 +29,14 @@ const sendData = async (url, formData) => {
     body: formData,
   });
 
+  if (!response.ok) throw new Error(await response.text());
   return response.text();
 };
 
-const badUpload = () => {
+const badUpload = (err) => {
   const hdr = document.createElement("h3");
   const em = document.createElement("em");
-  em.innerText = "Bad upload!";
+  em.innerText = err?.message ? `Bad upload: ${err.message}` : "Bad upload!";
   hdr.appendChild(em);
   fileList.replaceChildren(hdr);
 };
@@ -54,11 +55,7 @@ uploadForm.addEventListener("submit", async (event) => {
     const content = (await sendData("/admin/upload", new FormData(uploadForm))).split(
       "\n",
     );
-    let href = `${window.location.protocol}//${window.location.hostname}`;
-    if (window.location.port) {
-      href += `:${window.location.port}`;
-    }
-    href += `/post/${content[1]}`;
+    const href = content[2];
 
     const hdr = document.createElement("h3");
     const span = document.createElement("span");
@@ -68,9 +65,20 @@ uploadForm.addEventListener("submit", async (event) => {
     link.href = href;
     link.innerText = content[0];
     hdr.appendChild(link);
-    fileList.replaceChildren(hdr);
-  } catch {
-    badUpload();
+
+    // Show anything that looked off about the post
+    const warnings = document.createElement("ul");
+    for (const line of content.slice(3)) {
+      if (!line.startsWith("Warning: ")) continue;
+      const node = document.createElement("li");
+      const em = document.createElement("em");
+      em.innerText = line;
+      node.appendChild(em);
+      warnings.appendChild(node);
+    }
+    fileList.replaceChildren(hdr, warnings);
+  } catch (err) {
+    badUpload(err);
   } finally {
     submitPost.style.visibility = "hidden";
     uploadForm.reset();
@@ -102,8 +110,8 @@ const updatePost = async (event) => {
     const content = await sendData("/admin/update/" + post, new FormData(uploadForm));
     const entry = document.getElementById(`post-${post}`);
     entry.outerHTML = content;
-  } catch {
-    badUpload();
+  } catch (err) {
+    badUpload(err);
   } finally {
     submitPost.style.visibility = "hidden";
     uploadForm.reset();
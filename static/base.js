@@ -1,12 +1,7 @@
 document.body.addEventListener('click', async (event) => {
   if (!event.target.classList.contains('copy-header')) return;
   
-  url = ''
-  url += window.location.protocol
-  url += '//' + window.location.hostname
-  if (window.location.port) {
-    url += ':' + window.location.port
-  }
+  url = document.body.dataset.baseUrl
   url += '/post/' + event.target.getAttribute('post')
   if (event.target.id) {
     url += '#' + event.target.id